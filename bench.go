@@ -0,0 +1,330 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+	"github.com/gregdel/pushover"
+)
+
+// Tokens that the stand-in for the Pushover API accepts. They only need to
+// look real.
+const (
+	benchAppToken  = "abenchbenchbenchbenchbenchbenc"
+	benchUserToken = "ubenchbenchbenchbenchbenchbenc"
+)
+
+// benchDrainTimeout bounds how long the bench subcommand waits for its own
+// instance to deliver what it was sent.
+const benchDrainTimeout = time.Minute
+
+// benchCommand submits synthetic messages to an instance at a steady rate and
+// reports how many it accepted and how quickly, so that a deployment can be
+// sized before it has to absorb a storm of alerts. With -mock, it starts an
+// instance of its own, configured by any flags that follow its own, that
+// delivers to a stand-in for the Pushover API instead.
+func benchCommand(args []string) int {
+	var m sendMessage
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Func("to", "send to this `address`, or a bare user token (may be repeated)", func(s string) error {
+		m.to = append(m.to, s)
+		return nil
+	})
+	fs.StringVar(&m.from, "from", "", "send from this `address`")
+	addr := fs.String("addr", "localhost:25", "submit over SMTP to the server at this address:port")
+	useTLS := fs.Bool("tls", false, "connect with TLS, for servers that don't use STARTTLS")
+	insecure := fs.Bool("insecure", false, "don't verify the server's TLS certificate")
+	apiURL := fs.String("url", "", "submit to the HTTP API at this `URL`, such as http://localhost:8080, instead of SMTP")
+	fs.StringVar(&m.user, "user", "", "log in as this user, with the password in $SMTP_TRANSLATOR_PASSWORD")
+	rate := fs.Float64("rate", 10, "submit this many messages per second (0 for as many as -concurrency allows)")
+	duration := fs.Duration("duration", 10*time.Second, "keep submitting for this long")
+	count := fs.Int("n", 0, "stop after this many messages (0 for no limit)")
+	concurrency := fs.Int("concurrency", 10, "submit up to this many messages at once")
+	size := fs.Int("size", 256, "make each body this many bytes long")
+	mock := fs.Bool("mock", false, "benchmark an instance started with the flags that follow, delivering to a stand-in for Pushover")
+	mockLatency := fs.Duration("mock-latency", 100*time.Millisecond, "make the stand-in for Pushover take this long to answer")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator bench [flags] -to recipient")
+		fmt.Fprintln(fs.Output(), "       smtp-translator bench [flags] -mock [server flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if env, ok := os.LookupEnv("SMTP_TRANSLATOR_ADDR"); ok && !given["addr"] {
+		*addr = env
+	}
+	if *mock && len(m.to) == 0 {
+		m.to = []string{benchUserToken}
+	}
+	if len(m.to) == 0 || (fs.NArg() > 0 && !*mock) || *concurrency < 1 || *rate < 0 {
+		fs.Usage()
+		return 2
+	}
+	for i, to := range m.to {
+		if !strings.Contains(to, "@") {
+			m.to[i] = to + "@pushover.net"
+		}
+	}
+	m.password = os.Getenv("SMTP_TRANSLATOR_PASSWORD")
+
+	var t *smtp.Translator
+	var po *benchPushover
+	if *mock {
+		var err error
+		t, po, err = startBench(fs.Args(), *mockLatency)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		*addr = t.Config().Addr
+		*useTLS = len(t.Config().TLSKeyPairs) > 0 && !t.Config().Starttls && !t.Config().StarttlsReq
+		*insecure = true
+		*apiURL = ""
+	}
+
+	submit := func(m *sendMessage) error {
+		if *apiURL != "" {
+			_, err := sendAPI(*apiURL, m)
+			return err
+		}
+		return sendSMTP(*addr, *useTLS, *insecure, m)
+	}
+	results := benchRun(submit, &m, *rate, *duration, *count, *concurrency, *size)
+	results.print(os.Stdout)
+
+	if t != nil {
+		// The instance may still be queuing messages it has accepted, so wait
+		// for the notifications themselves.
+		want := int64(results.sent * len(m.to))
+		ok := po.wait(want, benchDrainTimeout)
+		po.print(os.Stdout, results.start)
+		ctx, cancel := context.WithTimeout(context.Background(), smtp.ShutdownTimeout)
+		defer cancel()
+		t.Shutdown(ctx)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "error: only %d of %d notifications delivered after %s\n", po.delivered.Load(), want, benchDrainTimeout)
+			return 1
+		}
+	}
+	if results.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// benchResults are the outcomes of a run of the bench subcommand.
+type benchResults struct {
+	start, end time.Time
+	sent       int
+	failed     int
+	firstErr   error
+	latencies  []time.Duration
+}
+
+// benchRun submits copies of m, numbered in their titles and padded to size
+// bytes, at rate per second until duration has passed or count have been
+// started, with no more than concurrency at a time.
+func benchRun(submit func(*sendMessage) error, m *sendMessage, rate float64, duration time.Duration, count, concurrency, size int) *benchResults {
+	r := &benchResults{start: time.Now()}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	deadline := r.start.Add(duration)
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	for i := 0; count == 0 || i < count; i++ {
+		if interval > 0 {
+			time.Sleep(time.Until(r.start.Add(time.Duration(i) * interval)))
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		slots <- struct{}{}
+		mm := *m
+		mm.title = fmt.Sprintf("bench %d", i+1)
+		mm.body = benchBody(i+1, size)
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			began := time.Now()
+			err := submit(&mm)
+			took := time.Since(began)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				r.failed++
+				if r.firstErr == nil {
+					r.firstErr = err
+				}
+				return
+			}
+			r.sent++
+			r.latencies = append(r.latencies, took)
+		}()
+	}
+	wg.Wait()
+	r.end = time.Now()
+	return r
+}
+
+// benchBody returns the body of the nth message, size bytes long.
+func benchBody(n, size int) string {
+	s := fmt.Sprintf("bench message %d ", n)
+	if len(s) >= size {
+		return s[:size]
+	}
+	return s + strings.Repeat("x", size-len(s))
+}
+
+func (r *benchResults) print(w io.Writer) {
+	elapsed := r.end.Sub(r.start)
+	fmt.Fprintf(w, "submitted %d messages in %s (%.1f/s), %d failed\n",
+		r.sent, elapsed.Round(time.Millisecond), float64(r.sent)/elapsed.Seconds(), r.failed)
+	if r.firstErr != nil {
+		fmt.Fprintln(w, "first error:", r.firstErr)
+	}
+	if len(r.latencies) == 0 {
+		return
+	}
+	slices.Sort(r.latencies)
+	at := func(p float64) time.Duration {
+		return r.latencies[int(p*float64(len(r.latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Fprintf(w, "latency: p50 %s, p90 %s, p99 %s, max %s\n", at(0.5), at(0.9), at(0.99), at(1))
+}
+
+// startBench starts an instance of SMTP Translator, configured by args, that
+// listens on a loopback port and delivers to a stand-in for the Pushover API,
+// which answers after latency. Unless another app token is configured, it
+// sends with one that the stand-in accepts.
+func startBench(args []string, latency time.Duration) (*smtp.Translator, *benchPushover, error) {
+	if _, ok := os.LookupEnv("PUSHOVER_TOKEN"); !ok {
+		os.Setenv("PUSHOVER_TOKEN", benchAppToken)
+	}
+	c, err := smtp.LoadConfig(flag.NewFlagSet("bench -mock", flag.ExitOnError), args)
+	if err != nil {
+		return nil, nil, err
+	}
+	po := &benchPushover{latency: latency}
+	poln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go http.Serve(poln, po)
+	pushover.APIEndpoint = "http://" + poln.Addr().String() + "/1"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Addr = ln.Addr().String()
+	c.HTTPAddr = ""
+	c.SummaryInterval = 0
+	logger := newLogger(os.Stderr, c.LogFormat, max(c.LogLevel, slog.LevelWarn), false)
+	t := smtp.NewTranslator(c, logger)
+	go t.Serve(ln)
+	return t, po, nil
+}
+
+// A benchPushover stands in for the Pushover API. It accepts every user token
+// and notification, and counts the notifications.
+type benchPushover struct {
+	latency time.Duration
+
+	delivered atomic.Int64
+	last      atomic.Int64
+}
+
+func (po *benchPushover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(po.latency)
+	w.Header().Set("Content-Type", "application/json")
+	var resp any
+	switch r.URL.Path {
+	case "/1/users/validate.json":
+		resp = map[string]any{"status": 1, "devices": []string{"bench"}, "request": newBenchID()}
+	case "/1/messages.json":
+		// One request may notify several users.
+		po.delivered.Add(int64(strings.Count(r.FormValue("user"), ",") + 1))
+		po.last.Store(time.Now().UnixNano())
+		// The Pushover library expects to be told the app's limits.
+		w.Header().Set("X-Limit-App-Limit", "10000")
+		w.Header().Set("X-Limit-App-Remaining", "10000")
+		w.Header().Set("X-Limit-App-Reset", fmt.Sprint(time.Now().Add(24*time.Hour).Unix()))
+		resp = map[string]any{"status": 1, "request": newBenchID()}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		resp = map[string]any{"status": 0, "errors": []string{"not found"}}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// wait waits up to timeout for n notifications to arrive, and reports whether
+// they did.
+func (po *benchPushover) wait(n int64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for po.delivered.Load() < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (po *benchPushover) print(w io.Writer, start time.Time) {
+	n := po.delivered.Load()
+	if n == 0 {
+		fmt.Fprintln(w, "delivered 0 notifications")
+		return
+	}
+	elapsed := time.Unix(0, po.last.Load()).Sub(start)
+	fmt.Fprintf(w, "delivered %d notifications in %s (%.1f/s)\n",
+		n, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+}
+
+var benchIDs atomic.Int64
+
+// newBenchID returns a request ID for the stand-in for Pushover.
+func newBenchID() string {
+	return fmt.Sprintf("bench-%d", benchIDs.Add(1))
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	netsmtp "net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/YoRyan/smtp-translator/smtp"
+	"github.com/gregdel/pushover"
+)
+
+// A command is a subcommand of SMTP Translator. It receives the arguments that
+// follow its name and returns the process's exit status.
+type command func(args []string) int
+
+var commands = map[string]command{
+	"batch":          batchCommand,
+	"bench":          benchCommand,
+	"check":          checkCommand,
+	"export":         exportCommand,
+	"init":           initCommand,
+	"healthcheck":    healthcheckCommand,
+	"import":         importCommand,
+	"send":           sendCommand,
+	"send-test":      sendTestCommand,
+	"sendmail":       sendmailCommand,
+	"silence":        silenceCommand,
+	"stats":          statsCommand,
+	"validate-token": validateTokenCommand,
+	"version":        versionCommand}
+
+// checkCommand validates the configuration and every file it refers to without
+// starting the server, so that a deployment can be gated on the result.
+func checkCommand(args []string) int {
+	c, err := smtp.LoadConfig(flag.NewFlagSet("check", flag.ExitOnError), args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	problems := c.Check()
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "error:", p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Println("configuration OK")
+	return 0
+}
+
+// batchCommand delivers notifications read from standard input as lines of
+// JSON, in the form the HTTP API takes, so that cron jobs and pipelines can use
+// the routing and retries without a running server.
+func batchCommand(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 0, "give up on notifications not delivered after this long (0 to keep retrying)")
+	c, err := smtp.LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	logger := newLogger(os.Stderr, c.LogFormat, c.LogLevel, false)
+	failed, err := smtp.NewTranslator(c, logger).Batch(ctx, os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintln(os.Stderr, "error:", failed, "failed")
+		return 1
+	}
+	return 0
+}
+
+// sendTestCommand sends a test notification to a recipient address, parsing it
+// just as it would an email submitted over SMTP, so that tokens and
+// connectivity can be verified without a mail client.
+func sendTestCommand(args []string) int {
+	fs := flag.NewFlagSet("send-test", flag.ExitOnError)
+	from := fs.String("from", "", "send the test from this `address` (required for -multiapp)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator send-test [flags] recipient")
+		fs.PrintDefaults()
+	}
+	c, err := smtp.LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	rcpt := fs.Arg(0)
+	if *from == "" {
+		*from = "smtp-translator@" + c.Hostname
+	}
+
+	data := "From: " + *from + "\r\n" +
+		"To: " + rcpt + "\r\n" +
+		"Subject: SMTP Translator test\r\n" +
+		"\r\n" +
+		"This is a test notification from SMTP Translator on " + c.Hostname + ".\r\n"
+	msg, err := mail.ReadMessage(bytes.NewReader([]byte(data)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	env, err := parse.MakeEnvelope(c.Sender("", *from), nil, msg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	env.Data = []byte(data)
+	env.Plaintext = c.Plaintext
+	ds := c.Deliveries(env, rcpt)
+	if len(ds) == 0 {
+		fmt.Fprintln(os.Stderr, "error: cannot deliver to", rcpt)
+		return 1
+	}
+	status := 0
+	for _, d := range ds {
+		dest := d.To.UserToken
+		if dest == "" {
+			dest = d.Route.Kind + " route for " + rcpt
+		}
+		if _, err := d.Send(); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", dest+":", err)
+			status = 1
+			continue
+		}
+		fmt.Println("sent test notification to", dest)
+	}
+	return status
+}
+
+// validateTokenCommand checks with Pushover that the configured app token can
+// notify a user or group, and explains what is wrong if it cannot.
+func validateTokenCommand(args []string) int {
+	fs := flag.NewFlagSet("validate-token", flag.ExitOnError)
+	from := fs.String("from", "", "take the app token from this `address` (for -multiapp)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator validate-token [flags] recipient")
+		fs.PrintDefaults()
+	}
+	c, err := smtp.LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	rcpt := fs.Arg(0)
+	if !strings.Contains(rcpt, "@") {
+		rcpt += "@pushover.net"
+	}
+	parsedRcpts := c.Recipients(rcpt)
+	if len(parsedRcpts) == 0 {
+		fmt.Fprintln(os.Stderr, "error: not a Pushover user key or address:", fs.Arg(0))
+		return 1
+	}
+	status := 0
+	for _, parsedRcpt := range parsedRcpts {
+		details, err := validateTokens(c.Sender("", *from).AppToken, parsedRcpt)
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "error:", err)
+			status = 1
+		case details.Group == 1:
+			fmt.Println("OK: the app token can notify group", parsedRcpt.UserToken)
+		default:
+			fmt.Println("OK: the app token can notify user", parsedRcpt.UserToken,
+				"on devices", strings.Join(details.Devices, ", "))
+		}
+	}
+	return status
+}
+
+// validateTokens asks Pushover whether an app token can notify a recipient. If
+// it cannot, the error says why.
+func validateTokens(appToken string, rcpt *parse.Recipient) (*pushover.RecipientDetails, error) {
+	if appToken == "" {
+		return nil, errors.New("no app token; set $PUSHOVER_TOKEN, or with -multiapp, pass -from")
+	}
+	details, err := pushover.New(appToken).GetRecipientDetails(pushover.NewRecipient(rcpt.UserToken))
+	switch {
+	case err == pushover.ErrInvalidToken:
+		return nil, fmt.Errorf("app token %q is malformed; app tokens are 30 letters and digits", appToken)
+	case err == pushover.ErrInvalidRecipientToken:
+		return nil, fmt.Errorf("user key %q is malformed; user and group keys are 30 letters and digits", rcpt.UserToken)
+	case err != nil:
+		return nil, fmt.Errorf("could not reach Pushover: %v", err)
+	case details.Status != 1:
+		// Pushover's own messages are specific, such as "application token is
+		// invalid" or "user key is invalid".
+		if len(details.Errors) == 0 {
+			return nil, errors.New("Pushover rejected the tokens")
+		}
+		return nil, errors.New("Pushover rejected the tokens: " + strings.Join(details.Errors, "; "))
+	case details.Group == 1:
+		return details, nil
+	case len(details.Devices) == 0:
+		return nil, fmt.Errorf("user %s has no active devices; install the Pushover app and log in", rcpt.UserToken)
+	}
+	if rcpt.Device != "" {
+		for _, device := range strings.Split(rcpt.Device, ",") {
+			found := false
+			for _, d := range details.Devices {
+				found = found || d == device
+			}
+			if !found {
+				return nil, fmt.Errorf("user %s has no device named %q (has %s)",
+					rcpt.UserToken, device, strings.Join(details.Devices, ", "))
+			}
+		}
+	}
+	return details, nil
+}
+
+// healthcheckCommand connects to a running server and checks that it answers a
+// NOOP, for use as a container health check. Rather than load the whole
+// configuration, it only reads -addr, which may also be set with
+// $SMTP_TRANSLATOR_ADDR.
+func healthcheckCommand(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	addr := fs.String("addr", ":25", "address:port the server listens on")
+	useTLS := fs.Bool("tls", false, "connect with TLS, for servers that don't use STARTTLS")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up after this long")
+	fs.Parse(args)
+	if err := smtp.LoadConfigEnv(fs); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := healthcheck(*addr, *useTLS, *timeout); err != nil {
+		fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		return 1
+	}
+	return 0
+}
+
+func healthcheck(addr string, useTLS bool, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if useTLS {
+		// There is no way to know which name the certificate is for, and the
+		// server is almost always local anyway.
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+	client, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	if err := client.Noop(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// statsCommand prints the statistics kept in the configured -stats-file.
+func statsCommand(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the statistics as JSON")
+	c, err := smtp.LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if c.Stats == nil {
+		fmt.Fprintln(os.Stderr, "error: no -stats-file is configured")
+		return 1
+	}
+	counts := c.Stats.Counts()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(counts)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "since\t"+counts.Since.Format(time.RFC1123))
+	fmt.Fprintf(w, "accepted\t%d\n", counts.Accepted)
+	fmt.Fprintf(w, "dropped\t%d\n", counts.Dropped)
+	fmt.Fprintf(w, "delivered\t%d\n", counts.Delivered)
+	fmt.Fprintf(w, "failed\t%d\n", counts.Failed)
+	for _, table := range []struct {
+		heading string
+		tallies map[string]*smtp.Tally
+	}{{"BACKEND", counts.Backends}, {"RECIPIENT", counts.Recipients}} {
+		keys := make([]string, 0, len(table.tallies))
+		for k := range table.tallies {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, table.heading+"\tDELIVERED\tFAILED")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", k, table.tallies[k].Delivered, table.tallies[k].Failed)
+		}
+	}
+	w.Flush()
+	return 0
+}
+
+// versionCommand prints the version of SMTP Translator and how it was built.
+func versionCommand(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the build information as JSON")
+	fs.Parse(args)
+	info := smtp.ReadBuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+		return 0
+	}
+	fmt.Printf("smtp-translator %s (%s, %s)\n", info.Version, info.GoVersion, info.Platform)
+	if info.Revision != "" {
+		modified := ""
+		if info.Modified {
+			modified = ", modified"
+		}
+		fmt.Printf("revision %s (%s%s)\n", info.Revision, info.Time, modified)
+	}
+	keys := make([]string, 0, len(info.Settings))
+	for k := range info.Settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s=%s\n", k, info.Settings[k])
+	}
+	return 0
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+)
+
+// exportTimeout bounds a download by the export subcommand.
+const exportTimeout = 5 * time.Minute
+
+// exportCommand downloads the queued and dead notifications of a running
+// instance through its admin API, as an mbox or into a maildir, for inspection
+// or for moving them to another instance.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8080", "the `URL` of the instance's HTTP server")
+	state := fs.String("state", "", "export only pending or dead notifications")
+	out := fs.String("o", "-", "write the mbox to this `file`")
+	maildir := fs.String("maildir", "", "write each notification into this maildir `directory` instead of an mbox")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator export [flags]")
+		fmt.Fprintln(fs.Output(), "The admin token is read from $SMTP_TRANSLATOR_ADMIN_TOKEN.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	body, err := fetchExport(*base, *state, os.Getenv("SMTP_TRANSLATOR_ADMIN_TOKEN"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer body.Close()
+	var n int
+	if *maildir != "" {
+		n, err = writeMaildir(*maildir, body)
+	} else {
+		n, err = writeMbox(*out, body)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d notification(s)\n", n)
+	return 0
+}
+
+// fetchExport requests the mbox from the admin API.
+func fetchExport(base, state, token string) (io.ReadCloser, error) {
+	path := "/admin/queue/export"
+	if state != "" {
+		path += "?state=" + url.QueryEscape(state)
+	}
+	resp, err := adminRequest(http.MethodGet, base, path, token, nil, exportTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// adminRequest makes a request to the admin API of a running instance and
+// returns the response if it succeeded, or the error it reported.
+func adminRequest(method, base, path, token string, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	r, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var result struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&result) != nil || result.Error == "" {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, errors.New(result.Error)
+	}
+	return resp, nil
+}
+
+// writeMbox copies the mbox to path, or to standard output for "-", and counts
+// its messages.
+func writeMbox(path string, r io.Reader) (int, error) {
+	var buf bytes.Buffer
+	n := 0
+	err := smtp.ReadMbox(io.TeeReader(r, &buf), func([]byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return n, err
+	}
+	return n, os.WriteFile(path, buf.Bytes(), 0o600)
+}
+
+// writeMaildir delivers each message in the mbox into the maildir at dir,
+// creating it if need be.
+func writeMaildir(dir string, r io.Reader) (int, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return 0, err
+		}
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	n := 0
+	err := smtp.ReadMbox(r, func(data []byte) error {
+		now := time.Now()
+		name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+		tmp := filepath.Join(dir, "tmp", name)
+		if err := os.WriteFile(tmp, data, 0o600); err != nil {
+			return err
+		}
+		n++
+		return os.Rename(tmp, filepath.Join(dir, "new", name))
+	})
+	return n, err
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+)
+
+// importCommand delivers the messages in mbox files and maildirs again, as if
+// they had just been received, for recovering from an outage or for moving
+// notifications exported from another instance.
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 0, "give up on notifications not delivered after this long (0 to keep retrying)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator import [flags] [mbox or maildir ...]")
+		fs.PrintDefaults()
+	}
+	c, err := smtp.LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	logger := newLogger(os.Stderr, c.LogFormat, c.LogLevel, false)
+
+	var readErr error
+	count, skipped := 0, 0
+	msgs := func(yield func(*smtp.ImportedMessage) bool) {
+		readErr = readArchives(paths, func(name string, data []byte) error {
+			m, err := smtp.ParseImported(data)
+			if err == nil && len(m.To) == 0 {
+				err = errors.New("no recipients")
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %s: %v\n", name, err)
+				skipped++
+				return nil
+			}
+			count++
+			if !yield(m) {
+				return errStopReading
+			}
+			return nil
+		})
+	}
+	refused, malformed, failed, err := smtp.NewTranslator(c, logger).Import(ctx, msgs)
+	for _, rcpt := range refused {
+		fmt.Fprintf(os.Stderr, "error: %s: no such recipient\n", rcpt)
+	}
+	fmt.Fprintf(os.Stderr, "read %d message(s), skipped %d\n", count-malformed, skipped+malformed)
+	switch {
+	case readErr != nil:
+		fmt.Fprintln(os.Stderr, "error:", readErr)
+		return 1
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	case failed > 0:
+		fmt.Fprintln(os.Stderr, "error:", failed, "failed")
+		return 1
+	case len(refused) > 0:
+		return 1
+	}
+	return 0
+}
+
+// errStopReading is returned by the function passed to readArchives to stop
+// early.
+var errStopReading = errors.New("stop reading")
+
+// readArchives calls f with the name and contents of each message in paths,
+// which name mbox files, "-" for an mbox on standard input, or maildirs, until
+// f returns an error.
+func readArchives(paths []string, f func(name string, data []byte) error) error {
+	for _, path := range paths {
+		var err error
+		if info, serr := os.Stat(path); serr == nil && info.IsDir() {
+			err = readMaildir(path, f)
+		} else {
+			n := 0
+			err = readMboxFile(path, func(data []byte) error {
+				n++
+				return f(fmt.Sprintf("%s message %d", path, n), data)
+			})
+		}
+		if errors.Is(err, errStopReading) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMboxFile reads an mbox from path, or from standard input for "-".
+func readMboxFile(path string, f func(data []byte) error) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	return smtp.ReadMbox(r, f)
+}
+
+// readMaildir reads the messages in the cur and new subdirectories of a
+// maildir. Deleted messages, whose flags include T, are left out. A directory
+// of .eml files, such as the -dead-letter-dir, may be read as well.
+func readMaildir(dir string, f func(name string, data []byte) error) error {
+	var files []string
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			_, flags, _ := strings.Cut(e.Name(), ":2,")
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") && !strings.Contains(flags, "T") {
+				files = append(files, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	emls, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	for _, name := range append(files, emls...) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := f(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
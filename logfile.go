@@ -0,0 +1,131 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is appended to the name of a log file when it is rotated.
+const backupTimeFormat = "20060102-150405.000"
+
+// A logFile is a log file that rotates itself. Once writing to it would make
+// it larger than maxSize bytes, it is renamed with the time appended and a new
+// file is started. Old files beyond maxBackups, or older than maxAge, are
+// deleted; zero means no limit.
+type logFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openLogFile opens a log file for appending, creating it if necessary.
+func openLogFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.prune()
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the old file rather than losing lines.
+			l.maxSize = 0
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file out of the way and starts a new one.
+func (l *logFile) rotate() error {
+	backup := l.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(l.path, backup); err != nil {
+		return err
+	}
+	old := l.f
+	if err := l.open(); err != nil {
+		os.Rename(backup, l.path)
+		return err
+	}
+	old.Close()
+	go l.prune()
+	return nil
+}
+
+// prune deletes rotated files that exceed the limits.
+func (l *logFile) prune() {
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(m, l.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// The time format sorts in order of age, so put the newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		if l.maxBackups > 0 && i >= l.maxBackups {
+			os.Remove(b)
+			continue
+		}
+		if l.maxAge > 0 {
+			if fi, err := os.Stat(b); err == nil && time.Since(fi.ModTime()) > l.maxAge {
+				os.Remove(b)
+			}
+		}
+	}
+}
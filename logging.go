@@ -0,0 +1,143 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// newLogger creates a logger that writes records of at least the given level
+// to w in the given format, either "plain" or "json". If stamp is set, plain
+// lines begin with the time.
+func newLogger(w io.Writer, format string, level slog.Leveler, stamp bool) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+	}
+	return slog.New(&plainHandler{mu: new(sync.Mutex), w: w, level: level, stamp: stamp})
+}
+
+// A plainHandler writes each record on a line of its own as the message
+// followed by its attributes in key=value form, without a timestamp or level,
+// which the service manager usually adds. When writing to a file, the handler
+// adds the time itself:
+//
+//	reloaded TLS certificate component=tls path=/etc/ssl/mycert.pem
+//	2020-05-01T12:00:00.000Z reloaded TLS certificate component=tls path=/etc/ssl/mycert.pem
+//
+// Strings are quoted only if they contain spaces, quotes, or other characters
+// that would make the line ambiguous.
+type plainHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	stamp  bool
+	attrs  string
+	prefix string
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if h.stamp && !r.Time.IsZero() {
+		b.WriteString(r.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00") + " ")
+	}
+	b.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteString(h.attrs)
+	b.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		h.appendAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs = b.String() + h.attrs
+	return &h2
+}
+
+func (h *plainHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+func (h *plainHandler) appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			h.appendAttr(b, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	b.WriteString(" " + prefix + a.Key + "=")
+	var s string
+	switch x := v.Any().(type) {
+	case fmt.Stringer:
+		s = x.String()
+	case encoding.TextMarshaler:
+		text, _ := x.MarshalText()
+		s = string(text)
+	default:
+		s = v.String()
+	}
+	// Values that are already quoted stay as they are.
+	if _, err := strconv.Unquote(s); needsQuoting(s) && (err != nil || s[0] != '"') {
+		s = strconv.Quote(s)
+	}
+	b.WriteString(s)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package notify
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/gregdel/pushover"
+)
+
+// MaxBatchUsers is the most users that Pushover notifies with one request, per
+// https://pushover.net/api#identifiers
+const MaxBatchUsers = 50
+
+// batchValidations bounds how many users of a batch are validated at once.
+const batchValidations = 4
+
+// batchKey is what Deliveries must have in common to share a request.
+type batchKey struct {
+	appToken   string
+	push       pushover.Message
+	attachment []byte
+	validate   bool
+}
+
+func (k *batchKey) equal(o *batchKey) bool {
+	return k.appToken == o.appToken && k.push == o.push && bytes.Equal(k.attachment, o.attachment) && k.validate == o.validate
+}
+
+// batchKey returns the key that a Delivery is batched by, or nil if it must be
+// sent on its own. Deliveries to a device are never batched, because device
+// names belong to users.
+func (d *Delivery) batchKey() *batchKey {
+	if d.Route.Kind != RoutePushover || d.From.AppToken == "" || d.To.UserToken == "" || d.To.Device != "" {
+		return nil
+	}
+	push, attachment := pushoverMessage(d.Envelope, d.Text)
+	return &batchKey{d.From.AppToken, *push, attachment, !d.SkipValidation}
+}
+
+// Batch groups Deliveries that Pushover can take in one request: those from the
+// same app to different users, with the same notification. Groups keep the
+// order of ds and hold up to MaxBatchUsers Deliveries each, and a Delivery that
+// cannot be batched is in a group of its own.
+func Batch(ds []*Delivery) [][]*Delivery {
+	var (
+		groups [][]*Delivery
+		keys   []*batchKey
+	)
+next:
+	for _, d := range ds {
+		k := d.batchKey()
+		if k != nil {
+			for i, g := range groups {
+				if keys[i] == nil || !keys[i].equal(k) || len(g) >= MaxBatchUsers || hasUser(g, d.To.UserToken) {
+					continue
+				}
+				groups[i] = append(g, d)
+				continue next
+			}
+		}
+		groups = append(groups, []*Delivery{d})
+		keys = append(keys, k)
+	}
+	return groups
+}
+
+func hasUser(ds []*Delivery, user string) bool {
+	for _, d := range ds {
+		if d.To.UserToken == user {
+			return true
+		}
+	}
+	return false
+}
+
+// SendBatch delivers a group of Deliveries made by Batch, and returns the
+// outcome of each. Unless validation is skipped, every user is validated first,
+// and those that are invalid fail on their own. The rest are notified with one
+// request, but if Pushover refuses it, perhaps because one user cannot receive
+// the notification, each Delivery is sent separately, so that errors are blamed
+// on the right recipient. If the request fails in any other way, such as a
+// timeout or a server error, Pushover may have notified the users after all, so
+// rather than risk notifying them twice, every Delivery fails and may be resent.
+func SendBatch(ds []*Delivery) (retryable []bool, errs []error) {
+	retryable, errs = make([]bool, len(ds)), make([]error, len(ds))
+	if len(ds) == 1 {
+		retryable[0], errs[0] = ds[0].Send()
+		return
+	}
+	if !ds[0].SkipValidation {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, batchValidations)
+		for i, d := range ds {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				errs[i] = validateUser(d.From.AppToken, d.To.UserToken)
+			}()
+		}
+		wg.Wait()
+	}
+	var (
+		valid []int
+		users []string
+	)
+	for i, d := range ds {
+		if errs[i] == nil {
+			valid = append(valid, i)
+			users = append(users, d.To.UserToken)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	push, attachment := pushoverMessage(ds[valid[0]].Envelope, ds[valid[0]].Text)
+	requestID, refused, err := postMessage(ds[valid[0]].From.AppToken, strings.Join(users, ","), push, attachment)
+	for _, i := range valid {
+		d := ds[i]
+		switch {
+		case refused:
+			d.Receipt, retryable[i], errs[i] = sendPushover(d.Envelope, d.Text, false)
+		case err != nil:
+			retryable[i], errs[i] = true, err
+		default:
+			d.Receipt = requestID
+		}
+	}
+	return
+}
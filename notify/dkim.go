@@ -0,0 +1,206 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package notify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimHeaders are the header fields that DKIM signatures cover, when a message
+// has them, in the order they are listed.
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding"}
+
+// A DKIM signs messages forwarded to relays per RFC 6376, with relaxed
+// canonicalization, so that they pass the checks of receiving mail servers.
+type DKIM struct {
+	Domain   string
+	Selector string
+
+	key crypto.Signer
+}
+
+// LoadDKIM reads a PEM-encoded RSA or Ed25519 private key for signing as
+// domain with a selector.
+func LoadDKIM(path, domain, selector string) (*DKIM, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM-encoded key", path)
+	}
+	var key any
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("%s: only RSA and Ed25519 keys can sign DKIM", path)
+	}
+	return &DKIM{Domain: domain, Selector: selector, key: key.(crypto.Signer)}, nil
+}
+
+// Sign returns msg with a DKIM-Signature header field added to the top.
+func (d *DKIM) Sign(msg []byte) ([]byte, error) {
+	header, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		header, body, ok = bytes.Cut(msg, []byte("\n\n"))
+	}
+	if !ok {
+		header, body = msg, nil
+	}
+	fields := splitHeader(string(header))
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	h := sha256.New()
+	var signed []string
+	for _, name := range dkimHeaders {
+		// Verifiers take fields from the bottom up.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fieldName(fields[i]), name) {
+				h.Write([]byte(relaxedField(fields[i]) + "\r\n"))
+				signed = append(signed, name)
+				break
+			}
+		}
+	}
+	if len(signed) == 0 || signed[0] != "From" {
+		return nil, errors.New("dkim: message has no From: field")
+	}
+
+	alg := "rsa-sha256"
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		alg = "ed25519-sha256"
+	}
+	sig := "DKIM-Signature: v=1; a=" + alg + "; c=relaxed/relaxed; d=" + d.Domain +
+		"; s=" + d.Selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) +
+		"; h=" + strings.Join(signed, ":") +
+		";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n\tb="
+	h.Write([]byte(relaxedField(sig)))
+	digest := h.Sum(nil)
+
+	var opts crypto.SignerOpts = crypto.SHA256
+	if alg == "ed25519-sha256" {
+		// RFC 8463 signs the digest itself with pure Ed25519.
+		opts = crypto.Hash(0)
+	}
+	b, err := d.key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	sig += base64.StdEncoding.EncodeToString(b)
+	return append([]byte(sig+"\r\n"), msg...), nil
+}
+
+// splitHeader splits a message header into its fields, each with any folded
+// continuation lines.
+func splitHeader(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// relaxedField canonicalizes a header field per RFC 6376, section 3.4.2,
+// without its final line break.
+func relaxedField(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(compressSpace(value))
+}
+
+// relaxedBody canonicalizes a message body per RFC 6376, section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	var b strings.Builder
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(compressSpace(line), " ")
+		if line == "" {
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line + "\r\n")
+	}
+	return []byte(b.String())
+}
+
+// compressSpace reduces each run of spaces and tabs to a single space.
+func compressSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package notify delivers parsed emails as Pushover notifications, or along
+// other routes such as ntfy topics and SMTP relays.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/gregdel/pushover"
+)
+
+// Pushover API limits per https://pushover.net/api#limits
+const (
+	MaxEmailLength    = 1024
+	MaxTitleLength    = 250
+	MaxUrlLength      = 512
+	MaxUrlTitleLength = 100
+	MaxAttachmentSize = 2621440
+)
+
+// pushoverTimeout bounds each request to the Pushover API, so that an endpoint
+// that hangs cannot hold up a queue worker for good.
+const pushoverTimeout = 30 * time.Second
+
+// pushoverClient makes every request to the Pushover API. The Pushover library
+// always sends with http.DefaultClient, which never times out, so the requests
+// are made here and the library supplies only the types. Its transport keeps
+// enough connections to the API alive for every queue worker to reuse one.
+var pushoverClient = &http.Client{
+	Timeout: pushoverTimeout,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: pushoverTimeout,
+		ExpectContinueTimeout: time.Second}}
+
+// Text holds the phrases that SMTP Translator adds to notifications, so that
+// they can be translated.
+type Text struct {
+	NoSubject          string
+	AttachmentTooLarge string
+	Spam               string
+	DeliveredTo        string
+}
+
+// DefaultText is the English Text.
+var DefaultText = &Text{
+	NoSubject:          "(no subject)",
+	AttachmentTooLarge: "(attachment too large)",
+	Spam:               "[SPAM]",
+	DeliveredTo:        "delivered to:"}
+
+// SendPushover converts an Envelope into a Pushover notification. In the event
+// of an error condition, retryable indicates whether or not the Envelope can be
+// resent. If text is nil, DefaultText is used.
+func SendPushover(e *parse.Envelope, text *Text) (retryable bool, err error) {
+	_, retryable, err = sendPushover(e, text, true)
+	return
+}
+
+// sendPushover is SendPushover, but it also returns the request ID that
+// Pushover assigned to the notification, and validates the recipient first
+// only if asked to.
+func sendPushover(e *parse.Envelope, text *Text, validate bool) (requestID string, retryable bool, err error) {
+	if e.From.AppToken == "" || e.To.UserToken == "" {
+		retryable = false
+		err = errors.New("missing app or user token")
+		return
+	}
+	if validate {
+		if err = validateUser(e.From.AppToken, e.To.UserToken); err != nil {
+			retryable = false
+			return
+		}
+	}
+
+	push, attachment := pushoverMessage(e, text)
+	requestID, _, err = postMessage(e.From.AppToken, e.To.UserToken, push, attachment)
+	return requestID, false, err
+}
+
+// validateUser asks Pushover whether a user token is valid.
+func validateUser(appToken, user string) error {
+	params := url.Values{"token": {appToken}, "user": {user}}
+	_, _, err := postPushover("/users/validate.json", "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
+	return err
+}
+
+// postMessage sends a notification to user, which may be a comma-separated
+// list of users, and returns the request ID that Pushover assigned to it.
+// refused reports whether Pushover answered that it would not send the
+// notification, as opposed to the request failing without a clear answer.
+func postMessage(appToken, user string, push *pushover.Message, attachment []byte) (requestID string, refused bool, err error) {
+	params := url.Values{
+		"token":    {appToken},
+		"user":     {user},
+		"message":  {push.Message},
+		"priority": {strconv.Itoa(push.Priority)}}
+	if push.Title != "" {
+		params.Set("title", push.Title)
+	}
+	if push.DeviceName != "" {
+		params.Set("device", push.DeviceName)
+	}
+	if push.Sound != "" {
+		params.Set("sound", push.Sound)
+	}
+	if push.HTML {
+		params.Set("html", "1")
+	}
+	if push.Priority == pushover.PriorityEmergency {
+		params.Set("retry", strconv.FormatFloat(push.Retry.Seconds(), 'f', -1, 64))
+		params.Set("expire", strconv.FormatFloat(push.Expire.Seconds(), 'f', -1, 64))
+	}
+
+	var (
+		body        bytes.Buffer
+		contentType string
+	)
+	if attachment == nil {
+		body.WriteString(params.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	} else {
+		w := multipart.NewWriter(&body)
+		for k := range params {
+			w.WriteField(k, params.Get(k))
+		}
+		fw, err := w.CreateFormFile("attachment", "attachment")
+		if err != nil {
+			return "", false, err
+		}
+		fw.Write(attachment)
+		if err := w.Close(); err != nil {
+			return "", false, err
+		}
+		contentType = w.FormDataContentType()
+	}
+	return postPushover("/messages.json", contentType, &body)
+}
+
+// postPushover posts a request to the Pushover API and returns the request ID
+// of the answer. refused is as for postMessage.
+func postPushover(path, contentType string, body io.Reader) (requestID string, refused bool, err error) {
+	resp, err := pushoverClient.Post(pushover.APIEndpoint+path, contentType, body)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", false, pushover.ErrHTTPPushover
+	}
+	var result struct {
+		Status  int             `json:"status"`
+		Request string          `json:"request"`
+		Errors  pushover.Errors `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", false, err
+	}
+	if result.Status != 1 {
+		// Only a 4xx answer with a status of 0 says for certain that the
+		// request was refused.
+		refused = resp.StatusCode >= http.StatusBadRequest && result.Status == 0
+		if len(result.Errors) == 0 {
+			return "", refused, errors.New("pushover: request refused")
+		}
+		return "", refused, result.Errors
+	}
+	return result.Request, false, nil
+}
+
+// pushoverMessage converts an Envelope into a Pushover notification, phrased
+// with text. The attachment is returned separately, and is nil if there is none
+// to send.
+func pushoverMessage(e *parse.Envelope, text *Text) (push *pushover.Message, attachment []byte) {
+	if text == nil {
+		text = DefaultText
+	}
+	validAttachment := e.Attachment != nil && len(e.Attachment) <= MaxAttachmentSize
+	title := e.Subject
+	if title == "" {
+		title = text.NoSubject
+	}
+	if e.From.ShowAddress {
+		title += " (" + e.From.Label() + ")"
+	}
+	if e.Attachment != nil && !validAttachment {
+		title += " " + text.AttachmentTooLarge
+	}
+
+	push = &pushover.Message{
+		Message:    truncate(e.Body, MaxEmailLength),
+		Title:      truncate(title, MaxTitleLength),
+		Priority:   e.To.Priority,
+		DeviceName: e.To.Device,
+		Sound:      e.To.Sound,
+		HTML:       !e.Plaintext}
+	if e.To.RetrySec != 0 {
+		push.Retry = time.Duration(e.To.RetrySec) * time.Second
+	}
+	if e.To.ExpireSec != 0 {
+		push.Expire = time.Duration(e.To.ExpireSec) * time.Second
+	}
+	if validAttachment {
+		attachment = e.Attachment
+	}
+	return
+}
+
+// AppLimits asks Pushover how many messages an app can still send this month.
+func AppLimits(appToken string) (*pushover.Limit, error) {
+	resp, err := pushoverClient.Get(pushover.APIEndpoint + "/apps/limits.json?token=" + url.QueryEscape(appToken))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var limits struct {
+		Status    int      `json:"status"`
+		Errors    []string `json:"errors"`
+		Limit     int      `json:"limit"`
+		Remaining int      `json:"remaining"`
+		Reset     int64    `json:"reset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&limits); err != nil {
+		return nil, err
+	}
+	if limits.Status != 1 {
+		return nil, errors.New("pushover: " + strings.Join(limits.Errors, ", "))
+	}
+	return &pushover.Limit{
+		Total:     limits.Limit,
+		Remaining: limits.Remaining,
+		NextReset: time.Unix(limits.Reset, 0)}, nil
+}
+
+// AppendFooter ends a notification body with footer, first shortening the body
+// if the two together would be too long for Pushover, so that the footer is
+// not the part that gets cut off.
+func AppendFooter(body, footer string) string {
+	if room := MaxEmailLength - len(footer); room > 4 {
+		body = truncate(body, room)
+	}
+	return body + footer
+}
+
+func truncate(s string, maxLength int) string {
+	if len(s) >= maxLength {
+		return s[0:maxLength-4] + "..."
+	} else {
+		return s
+	}
+}
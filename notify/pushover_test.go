@@ -0,0 +1,242 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/gregdel/pushover"
+)
+
+const (
+	testApp  = "azGDORePK8gMaC0QOYAMyEEuzJnyUi"
+	testUser = "uQiRzpo4DXghDmr9QzzfQu27cmVRsG"
+)
+
+// fakePushover is a Pushover API that records the requests it receives.
+// Validation fails for the users in invalid, and messages to several users
+// are refused if any of them is in refuse.
+type fakePushover struct {
+	mu       sync.Mutex
+	invalid  []string
+	refuse   []string
+	requests []url.Values
+}
+
+func (f *fakePushover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	form := r.Form
+	form.Set("path", r.URL.Path)
+	f.requests = append(f.requests, form)
+	users := strings.Split(form.Get("user"), ",")
+	switch {
+	case r.URL.Path == "/1/users/validate.json" && slices.Contains(f.invalid, users[0]):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":0,"errors":["user identifier is invalid"]}`)
+	case r.URL.Path == "/1/messages.json" && slices.ContainsFunc(users, func(u string) bool { return slices.Contains(f.refuse, u) }):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":0,"errors":["user is disabled"]}`)
+	default:
+		fmt.Fprintf(w, `{"status":1,"request":"req-%d"}`, len(f.requests))
+	}
+}
+
+// paths returns the paths of the requests received so far.
+func (f *fakePushover) paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var paths []string
+	for _, form := range f.requests {
+		paths = append(paths, form.Get("path"))
+	}
+	return paths
+}
+
+// usePushover points the Pushover API at h for the rest of the test.
+func usePushover(t *testing.T, h http.Handler) {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	endpoint := pushover.APIEndpoint
+	pushover.APIEndpoint = srv.URL + "/1"
+	t.Cleanup(func() { pushover.APIEndpoint = endpoint })
+}
+
+func testDelivery(user string) *Delivery {
+	return &Delivery{
+		Envelope: &parse.Envelope{
+			From:    &parse.Sender{AppToken: testApp, Address: "nas@example.com"},
+			To:      &parse.Recipient{UserToken: user},
+			Subject: "Backup finished",
+			Body:    "All done."},
+		Route: defaultRoute}
+}
+
+func TestSendPushover(t *testing.T) {
+	f := &fakePushover{}
+	usePushover(t, f)
+	d := testDelivery(testUser)
+	d.To.Device = "phone"
+	d.To.Priority = pushover.PriorityHigh
+	if retryable, err := d.Send(); err != nil || retryable {
+		t.Fatalf("Send() = %v, %v", retryable, err)
+	}
+	if got, want := f.paths(), []string{"/1/users/validate.json", "/1/messages.json"}; !slices.Equal(got, want) {
+		t.Fatalf("requests = %q, want %q", got, want)
+	}
+	if d.Receipt != "req-2" {
+		t.Errorf("Receipt = %q, want %q", d.Receipt, "req-2")
+	}
+	msg := f.requests[1]
+	for k, want := range map[string]string{
+		"token":    testApp,
+		"user":     testUser,
+		"device":   "phone",
+		"priority": "1",
+		"title":    "Backup finished",
+		"message":  "All done.",
+		"html":     "1",
+	} {
+		if got := msg.Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestSendPushoverInvalid(t *testing.T) {
+	f := &fakePushover{invalid: []string{testUser}}
+	usePushover(t, f)
+	d := testDelivery(testUser)
+	retryable, err := d.Send()
+	var perr pushover.Errors
+	if !errors.As(err, &perr) || retryable {
+		t.Fatalf("Send() = %v, %v, want a Pushover error", retryable, err)
+	}
+	if got := f.paths(); len(got) != 1 {
+		t.Errorf("requests = %q, want only the validation", got)
+	}
+
+	d.SkipValidation = true
+	f.requests = nil
+	if _, err := d.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.paths(), []string{"/1/messages.json"}; !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	const (
+		other    = "uAbcdefghijklmnopqrstuvwxyz123"
+		disabled = "uDisabledUserxxxxxxxxxxxxxxxxx"
+		invalid  = "uInvalidUserxxxxxxxxxxxxxxxxxx"
+	)
+	f := &fakePushover{invalid: []string{invalid}}
+	usePushover(t, f)
+	ds := []*Delivery{testDelivery(testUser), testDelivery(other), testDelivery(invalid)}
+	if groups := Batch(ds); len(groups) != 1 {
+		t.Fatalf("Batch() made %d groups, want 1", len(groups))
+	}
+	retryable, errs := SendBatch(ds)
+	if errs[0] != nil || errs[1] != nil || errs[2] == nil || slices.Contains(retryable, true) {
+		t.Fatalf("SendBatch() = %v, %v", retryable, errs)
+	}
+	msg := f.requests[len(f.requests)-1]
+	if got, want := msg.Get("user"), testUser+","+other; msg.Get("path") != "/1/messages.json" || got != want {
+		t.Fatalf("last request was to %s for %q, want one message for %q", msg.Get("path"), got, want)
+	}
+	if ds[0].Receipt == "" || ds[0].Receipt != ds[1].Receipt {
+		t.Errorf("receipts = %q, %q, want the same request", ds[0].Receipt, ds[1].Receipt)
+	}
+
+	// A refused batch is sent again one user at a time.
+	f = &fakePushover{refuse: []string{disabled}}
+	usePushover(t, f)
+	ds = []*Delivery{testDelivery(testUser), testDelivery(disabled)}
+	for _, d := range ds {
+		d.SkipValidation = true
+	}
+	retryable, errs = SendBatch(ds)
+	if errs[0] != nil || errs[1] == nil || slices.Contains(retryable, true) {
+		t.Fatalf("SendBatch() = %v, %v", retryable, errs)
+	}
+	if got := f.paths(); len(got) != 3 {
+		t.Errorf("requests = %q, want the batch and then one per user", got)
+	}
+}
+
+func TestPushoverTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	usePushover(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer close(hang)
+	timeout := pushoverClient.Timeout
+	pushoverClient.Timeout = 100 * time.Millisecond
+	defer func() { pushoverClient.Timeout = timeout }()
+
+	ds := []*Delivery{testDelivery(testUser), testDelivery("uAbcdefghijklmnopqrstuvwxyz123")}
+	for _, d := range ds {
+		d.SkipValidation = true
+	}
+	done := make(chan struct{})
+	var (
+		retryable []bool
+		errs      []error
+	)
+	go func() {
+		retryable, errs = SendBatch(ds)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendBatch() hung")
+	}
+	for i := range ds {
+		if errs[i] == nil || !retryable[i] {
+			t.Errorf("delivery %d: retryable = %v, err = %v, want a retryable timeout", i, retryable[i], errs[i])
+		}
+	}
+	if _, err := ds[0].Send(); err == nil {
+		t.Error("Send() succeeded against a hung server")
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package notify
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// relayTimeout bounds each delivery to a relay.
+const relayTimeout = time.Minute
+
+// errRelayNoTLS means that a relay that must be reached over TLS doesn't offer
+// STARTTLS, which retrying won't fix.
+var errRelayNoTLS = errors.New("relay does not offer STARTTLS")
+
+// A relay is the parsed target of a relay Route.
+type relay struct {
+	addr, host     string
+	implicitTLS    bool
+	requireTLS     bool
+	user, password string
+}
+
+// parseRelay parses the target of a relay Route.
+func parseRelay(target string) (*relay, error) {
+	if !strings.Contains(target, "://") {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		return &relay{addr: target, host: host}, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	r := &relay{host: u.Hostname()}
+	port := u.Port()
+	switch u.Scheme {
+	case "smtp":
+		if port == "" {
+			port = "25"
+		}
+	case "smtps":
+		r.implicitTLS = true
+		if port == "" {
+			port = "465"
+		}
+	default:
+		return nil, errors.New("relay URL must begin with smtp:// or smtps://")
+	}
+	if r.host == "" {
+		return nil, errors.New("relay URL has no host")
+	}
+	r.addr = net.JoinHostPort(r.host, port)
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+		r.requireTLS = true
+	}
+	switch starttls := u.Query().Get("starttls"); starttls {
+	case "":
+	case "required":
+		r.requireTLS = true
+	default:
+		return nil, fmt.Errorf("unknown starttls option: %s", starttls)
+	}
+	return r, nil
+}
+
+// sendRelay forwards the original message to another SMTP server, signing it
+// first if dkim is not nil.
+func sendRelay(target string, e *parse.Envelope, dkim *DKIM) (retryable bool, err error) {
+	r, err := parseRelay(target)
+	if err != nil {
+		return false, err
+	}
+	data := e.Data
+	if dkim != nil {
+		if data, err = dkim.Sign(data); err != nil {
+			return false, err
+		}
+	}
+	err = r.send(e.From.Address, e.Rcpt, data)
+	if err == nil {
+		return false, nil
+	}
+	var tpErr *textproto.Error
+	if err == errRelayNoTLS {
+		return false, err
+	} else if errors.As(err, &tpErr) {
+		// Permanent failures are 5xx.
+		return tpErr.Code < 500, err
+	}
+	return true, err
+}
+
+func (r *relay) send(from, to string, data []byte) error {
+	conn, err := net.DialTimeout("tcp", r.addr, relayTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	tlsConfig := &tls.Config{ServerName: r.host}
+	if r.implicitTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, r.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !r.implicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if r.requireTLS {
+			return errRelayNoTLS
+		}
+	}
+	if r.user != "" {
+		var auth smtp.Auth = smtp.PlainAuth("", r.user, r.password, r.host)
+		if _, mechs := c.Extension("AUTH"); !hasWord(mechs, "PLAIN") && hasWord(mechs, "LOGIN") {
+			auth = loginAuth{r.user, r.password}
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func hasWord(s, word string) bool {
+	for _, w := range strings.Fields(s) {
+		if strings.EqualFold(w, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginAuth implements the LOGIN mechanism, which some servers offer instead
+// of PLAIN. It is only used over TLS.
+type loginAuth struct {
+	user, password string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.user), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
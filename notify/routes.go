@@ -0,0 +1,272 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/YoRyan/smtp-translator/plugin"
+	"github.com/gregdel/pushover"
+)
+
+// Kinds of Route.
+const (
+	// RoutePushover parses recipients as Pushover user tokens or aliases.
+	RoutePushover = "pushover"
+	// RouteNtfy publishes to the ntfy topic named by the local part.
+	RouteNtfy = "ntfy"
+	// RouteRelay forwards messages unchanged to another SMTP server, given
+	// as host:port or as a URL in the form of
+	// smtp[s]://[user:password@]host[:port][?starttls=required]. smtps
+	// connects with TLS, and smtp upgrades with STARTTLS if the server offers
+	// it, or fails if it doesn't and the relay requires it or has a user.
+	RouteRelay = "relay"
+	// RouteReject refuses recipients.
+	RouteReject = "reject"
+	// RoutePlugin hands messages to the notifier plugin at Target.
+	RoutePlugin = "plugin"
+)
+
+// ntfyTimeout bounds each request to an ntfy server.
+const ntfyTimeout = 30 * time.Second
+
+// ntfyClient makes requests to ntfy servers.
+var ntfyClient = &http.Client{Timeout: ntfyTimeout}
+
+// A Route decides what happens to mail for a recipient domain. Target is the
+// ntfy server URL, the relay's host:port or URL (see RouteRelay), or the
+// plugin's path.
+type Route struct {
+	Domain string
+	Kind   string
+	Target string
+}
+
+// Routes is a routing table. Domains are matched exactly, and the domain *
+// matches every address that nothing else does.
+type Routes []*Route
+
+// defaultRoute applies when no Route matches, so that SMTP Translator behaves
+// as it always has without a routing table.
+var defaultRoute = &Route{Domain: "*", Kind: RoutePushover}
+
+// ParseRoutes parses a comma-separated list of routes in the form of
+// domain=kind[:target].
+func ParseRoutes(list string) (Routes, error) {
+	var routes Routes
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		split := strings.SplitN(s, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return nil, errors.New("invalid route (expected domain=kind[:target]): " + s)
+		}
+		r := &Route{Domain: strings.ToLower(split[0])}
+		kindTarget := strings.SplitN(split[1], ":", 2)
+		r.Kind = kindTarget[0]
+		if len(kindTarget) == 2 {
+			r.Target = kindTarget[1]
+		}
+		switch r.Kind {
+		case RoutePushover, RouteReject:
+			if r.Target != "" {
+				return nil, errors.New("route takes no target: " + s)
+			}
+		case RouteNtfy, RouteRelay, RoutePlugin:
+			if r.Target == "" {
+				return nil, errors.New("route needs a target: " + s)
+			}
+		default:
+			return nil, errors.New("unknown route kind: " + s)
+		}
+		if r.Kind == RouteRelay {
+			if _, err := parseRelay(r.Target); err != nil {
+				return nil, fmt.Errorf("route %s: %v", s, err)
+			}
+		}
+		if r.Kind == RoutePlugin {
+			if err := plugin.Check(r.Target); err != nil {
+				return nil, fmt.Errorf("route %s: %v", s, err)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// Match returns the Route for a recipient address.
+func (routes Routes) Match(addr string) *Route {
+	domain := ""
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		domain = strings.ToLower(addr[at+1:])
+	}
+	catchAll := defaultRoute
+	for _, r := range routes {
+		if r.Domain == domain {
+			return r
+		} else if r.Domain == "*" && catchAll == defaultRoute {
+			catchAll = r
+		}
+	}
+	return catchAll
+}
+
+// Send delivers an Envelope along the Route, phrasing notifications with text,
+// or DefaultText if it is nil. In the event of an error condition, retryable
+// indicates whether or not the Envelope can be resent.
+func (r *Route) Send(e *parse.Envelope, text *Text) (retryable bool, err error) {
+	switch r.Kind {
+	case RouteNtfy:
+		return sendNtfy(r.Target, e)
+	case RouteRelay:
+		return sendRelay(r.Target, e, nil)
+	case RoutePlugin:
+		return plugin.Notify(r.Target, e)
+	default:
+		return SendPushover(e, text)
+	}
+}
+
+// pingTimeout bounds each connection made by Ping.
+const pingTimeout = 5 * time.Second
+
+// Ping checks that the server a Route delivers to can be reached, by connecting
+// to it. Routes that do not deliver over the network always succeed.
+func (r *Route) Ping() error {
+	var addr string
+	switch r.Kind {
+	case RoutePushover:
+		addr = pushover.APIEndpoint
+	case RouteNtfy:
+		addr = r.Target
+	case RouteRelay:
+		relay, err := parseRelay(r.Target)
+		if err != nil {
+			return err
+		}
+		addr = relay.addr
+	default:
+		return nil
+	}
+	if r.Kind != RouteRelay {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		addr = u.Host
+		if u.Port() == "" {
+			port := "443"
+			if u.Scheme == "http" {
+				port = "80"
+			}
+			addr = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, pingTimeout)
+	if err != nil {
+		return fmt.Errorf("%s route: %v", r.Kind, err)
+	}
+	return conn.Close()
+}
+
+// Ping checks every Route in the table, including the default one if there is
+// no catch-all, and returns the first error.
+func (routes Routes) Ping() error {
+	all := routes
+	if routes.Match("") == defaultRoute {
+		all = append(Routes{defaultRoute}, routes...)
+	}
+	for _, r := range all {
+		if err := r.Ping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendNtfy publishes an Envelope to the topic named by the local part of its
+// recipient address. Attachments are not forwarded.
+func sendNtfy(server string, e *parse.Envelope) (retryable bool, err error) {
+	topic := e.Rcpt
+	if at := strings.LastIndex(topic, "@"); at >= 0 {
+		topic = topic[:at]
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(server, "/")+"/"+topic, strings.NewReader(e.Body))
+	if err != nil {
+		return false, err
+	}
+	title := e.Subject
+	if e.From.ShowAddress {
+		title += " (" + e.From.Label() + ")"
+	}
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", title))
+	resp, err := ntfyClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	// Read the rest of the response so that the connection can be reused.
+	defer io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("ntfy: " + resp.Status)
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+	}
+	return false, nil
+}
+
+// A Delivery is an Envelope bound for a Route, and the Text to phrase it with.
+// Once it is sent to Pushover, Receipt holds the request ID that Pushover
+// assigned to it.
+type Delivery struct {
+	*parse.Envelope
+	Route   *Route
+	Text    *Text
+	Receipt string
+	// If SkipValidation is set, Pushover recipients are not validated before
+	// sending, saving a request; an invalid user token fails the send instead.
+	SkipValidation bool
+	// If DKIM is not nil, messages forwarded to relays are signed with it.
+	DKIM *DKIM
+}
+
+// Send delivers the Envelope along its Route.
+func (d *Delivery) Send() (retryable bool, err error) {
+	if d.Route.Kind == RoutePushover {
+		d.Receipt, retryable, err = sendPushover(d.Envelope, d.Text, !d.SkipValidation)
+		return
+	} else if d.Route.Kind == RouteRelay {
+		return sendRelay(d.Route.Target, d.Envelope, d.DKIM)
+	}
+	return d.Route.Send(d.Envelope, d.Text)
+}
@@ -0,0 +1,389 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package parse turns email addresses and messages into the Senders,
+// Recipients, and Envelopes that SMTP Translator delivers.
+package parse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// encodedWordRe finds an RFC 2047 encoded word.
+var encodedWordRe = regexp.MustCompile(`=\?[^\?]+\?[bBqQ]\?[^\?]+\?=`)
+
+// recipientFlagsRe matches the flags that may follow a user token.
+const recipientFlagsRe = `(?:>[\w,]+|#[-\+]?\d|!\w+|%\d+|\$\d+|\+\w+)*`
+
+// Tokens recognizes app and user tokens in addresses.
+type Tokens struct {
+	app, user *regexp.Regexp
+	// sender finds an app token in a sender address.
+	sender *regexp.Regexp
+	// recipient matches a recipient address, capturing the user token and
+	// its flags.
+	recipient *regexp.Regexp
+	// The indexes of the captures in sender and recipient.
+	appIndex, userIndex, flagsIndex int
+}
+
+// DefaultTokens recognizes Pushover's tokens, which begin with "a" and "u".
+var DefaultTokens = MustTokens(`a\w+`, `u\w+`)
+
+// NewTokens returns Tokens that recognize app and user tokens with regular
+// expressions that each match a whole token, such as [A-Za-z0-9]{30}. A user
+// token pattern must not match the characters that begin flags, ">#!%$+". An
+// empty pattern selects the default.
+func NewTokens(app, user string) (*Tokens, error) {
+	if app == "" {
+		app = `a\w+`
+	}
+	if user == "" {
+		user = `u\w+`
+	}
+	var t Tokens
+	// Compile each pattern alone first, so that errors quote it as given.
+	_, err := regexp.Compile(app)
+	if err == nil {
+		t.app, err = regexp.Compile(`^(?:` + app + `)$`)
+	}
+	if err == nil {
+		t.sender, err = regexp.Compile(`(?P<token>` + app + `)@`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("app token pattern: %v", err)
+	}
+	if _, err = regexp.Compile(user); err == nil {
+		t.user, err = regexp.Compile(`^(?:` + user + `)$`)
+	}
+	if err == nil {
+		t.recipient, err = regexp.Compile(`^(?P<token>` + user + `)(?P<flags>` + recipientFlagsRe + `)@`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("user token pattern: %v", err)
+	}
+	t.appIndex = t.sender.SubexpIndex("token")
+	t.userIndex = t.recipient.SubexpIndex("token")
+	t.flagsIndex = t.recipient.SubexpIndex("flags")
+	return &t, nil
+}
+
+// MustTokens is NewTokens, but it panics if a pattern is invalid.
+func MustTokens(app, user string) *Tokens {
+	t, err := NewTokens(app, user)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// IsAppToken reports whether s is an app token.
+func (t *Tokens) IsAppToken(s string) bool {
+	return t.app.MatchString(s)
+}
+
+// IsUserToken reports whether s is a user token.
+func (t *Tokens) IsUserToken(s string) bool {
+	return t.user.MatchString(s)
+}
+
+// recipientFlags are the characters that begin each flag in a recipient
+// address.
+const recipientFlags = ">#!%$+"
+
+// An Envelope represents an email that is finalized, parsed, and ready for
+// submission.
+type Envelope struct {
+	From       *Sender
+	To         *Recipient
+	Subject    string
+	Body       string
+	Attachment []byte
+
+	// The profile requested by the email's headers, if any.
+	Profile string
+
+	// If Plaintext is set, the body is not rendered as HTML.
+	Plaintext bool
+
+	// ID identifies the email in logs from the moment it is received.
+	ID string
+
+	// Where the email came from, for the audit log.
+	Client    string
+	User      string
+	Rcpt      string
+	MessageID string
+
+	// The original message, for routes that forward it as is.
+	Data []byte
+}
+
+// A Sender represents the source Pushover app token and the original email
+// From: address. In the future, there may be additional fields.
+type Sender struct {
+	AppToken    string
+	Address     string
+	ShowAddress bool
+
+	// If Name is set, it is shown in place of the address.
+	Name string
+}
+
+// Label returns how the Sender is shown in notifications.
+func (s *Sender) Label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Address
+}
+
+// DisplayName returns the display name of an address from a header, such as
+// Synology NAS in "Synology NAS" <no-reply@synology.local>, or the empty string
+// if there is none.
+func DisplayName(header string) string {
+	addr, err := mail.ParseAddress(header)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(addr.Name)
+}
+
+// A Recipient represents a valid Pushover destination with optional
+// fields to customize the notification.
+type Recipient struct {
+	UserToken string
+	Device    string
+	Priority  int
+	RetrySec  int
+	ExpireSec int
+	Sound     string
+	Profile   string
+}
+
+// ParseSender parses a From: address with DefaultTokens.
+func ParseSender(addr string) *Sender {
+	return DefaultTokens.ParseSender(addr)
+}
+
+// ParseSender parses a From: address. If the local part begins with an app
+// token, as it does in multiple app token mode, it is extracted.
+func (t *Tokens) ParseSender(addr string) (sndr *Sender) {
+	var s Sender
+	sndr = &s
+
+	s.Address = addr
+	app := t.sender.FindStringSubmatch(addr)
+	if len(app) == 0 {
+		return
+	}
+	s.AppToken = app[t.appIndex]
+	return
+}
+
+// ParseRecipient parses a recipient address with DefaultTokens.
+func ParseRecipient(addr string) *Recipient {
+	return DefaultTokens.ParseRecipient(addr)
+}
+
+// ParseRecipient parses a recipient address in the form of
+// usertoken[>device][#priority][%retry][$expire][!sound][+profile]@domain. The
+// UserToken of the result is empty if the address is not in this form.
+func (t *Tokens) ParseRecipient(addr string) (rcpt *Recipient) {
+	var r Recipient
+	rcpt = &r
+
+	user := t.recipient.FindStringSubmatch(addr)
+	if len(user) == 0 {
+		return
+	}
+	r.UserToken = user[t.userIndex]
+
+	// The pattern has already checked the flags, so each runs from its marker
+	// to the next, except that a priority is one digit with an optional sign.
+	// Where a flag is repeated, the first one counts.
+	var seen [256]bool
+	for opts := user[t.flagsIndex]; opts != ""; {
+		flag := opts[0]
+		end := 1
+		if flag == '#' {
+			end = len("#1")
+			if opts[1] == '-' || opts[1] == '+' {
+				end++
+			}
+		} else if i := strings.IndexAny(opts[1:], recipientFlags); i >= 0 {
+			end += i
+		} else {
+			end = len(opts)
+		}
+		value := opts[1:end]
+		opts = opts[end:]
+		if seen[flag] {
+			continue
+		}
+		seen[flag] = true
+		switch flag {
+		case '>':
+			r.Device = value
+		case '#':
+			r.Priority, _ = strconv.Atoi(value)
+		case '%':
+			r.RetrySec, _ = strconv.Atoi(value)
+		case '$':
+			r.ExpireSec, _ = strconv.Atoi(value)
+		case '!':
+			r.Sound = value
+		case '+':
+			r.Profile = value
+		}
+	}
+	return
+}
+
+// MakeEnvelope extracts plaintext versions of the Message's subject and body
+// as well as the binary version of the attachment, if any.
+func MakeEnvelope(sndr *Sender, rcpt *Recipient, m *mail.Message) (*Envelope, error) {
+	contentType := m.Header.Get("Content-Type")
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+
+	var (
+		body       string
+		attachment []byte
+	)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(m.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Type"), "text/") {
+				bodyb, err := readPooled(part)
+				if err != nil {
+					return nil, err
+				}
+				body, err = decodeAll(bodyb.String())
+				releasePooled(bodyb)
+				if err != nil {
+					return nil, err
+				}
+			} else if raw, err := readPooled(part); err == nil {
+				switch encoding := part.Header.Get("Content-Transfer-Encoding"); encoding {
+				case "base64":
+					// The attachment outlives the message, so only the
+					// encoded form comes from the pool.
+					buf := make([]byte, base64.StdEncoding.DecodedLen(raw.Len()))
+					nbytes, err := base64.StdEncoding.Decode(buf, raw.Bytes())
+					releasePooled(raw)
+					if err != nil {
+						return nil, err
+					}
+					attachment = buf[0:nbytes]
+				default:
+					releasePooled(raw)
+					return nil, errors.New("unknown multipart encoding " + encoding)
+				}
+			}
+		}
+	} else {
+		bodyb, err := readPooled(m.Body)
+		if err != nil {
+			return nil, err
+		}
+		body, err = decodeAll(bodyb.String())
+		releasePooled(bodyb)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		sub string
+		err error
+	)
+	if sub, err = decodeAll(m.Header.Get("Subject")); err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		From:       sndr,
+		To:         rcpt,
+		Subject:    sub,
+		Body:       body,
+		Attachment: attachment,
+		Profile:    strings.TrimSpace(m.Header.Get(ProfileHeader))}, nil
+}
+
+// maxPooledBuffer is the largest buffer kept for reuse, so that one huge
+// message does not pin its memory.
+const maxPooledBuffer = 1 << 20
+
+// bufferPool holds buffers for reading message parts, which are needed only
+// until they are decoded.
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// readPooled reads r into a buffer from the pool, which the caller must pass
+// to releasePooled once done with its contents.
+func readPooled(r io.Reader) (*bytes.Buffer, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		releasePooled(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releasePooled(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+func decodeAll(s string) (string, error) {
+	if m := encodedWordRe.FindStringIndex(s); len(m) >= 2 {
+		start := m[0]
+		end := m[1]
+		if d, err := new(mime.WordDecoder).Decode(s[start:end]); err != nil {
+			return "", err
+		} else {
+			if rest, err := decodeAll(s[end:]); err != nil {
+				return "", err
+			} else {
+				return s[:start] + d + rest, nil
+			}
+		}
+	} else {
+		return s, nil
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var recipientSeeds = []string{
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG>phone@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG#2%30$3600!siren@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG#-1>phone,tablet+night@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG#1#2!a!b@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG%99999999999999999999999@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG#@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG>@api.pushover.net",
+	"uQiRzpo4DXghDmr9QzzfQu27cmVRsG",
+	"ops@example.com",
+	"@",
+	"",
+}
+
+func TestParseRecipient(t *testing.T) {
+	for _, tt := range []struct {
+		addr string
+		want Recipient
+	}{
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net",
+			Recipient{UserToken: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG"}},
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG>phone,tablet#2%30$3600!siren+night@api.pushover.net",
+			Recipient{UserToken: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG", Device: "phone,tablet", Priority: 2, RetrySec: 30, ExpireSec: 3600, Sound: "siren", Profile: "night"}},
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG#-2@api.pushover.net",
+			Recipient{UserToken: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG", Priority: -2}},
+		// The first of a repeated flag counts.
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG!a!b#1#2@api.pushover.net",
+			Recipient{UserToken: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG", Sound: "a", Priority: 1}},
+		// A priority is a single digit.
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG#12@api.pushover.net", Recipient{}},
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG>@api.pushover.net", Recipient{}},
+		{"uQiRzpo4DXghDmr9QzzfQu27cmVRsG", Recipient{}},
+		{"ops@example.com", Recipient{}},
+	} {
+		if got := ParseRecipient(tt.addr); *got != tt.want {
+			t.Errorf("ParseRecipient(%q) = %+v, want %+v", tt.addr, *got, tt.want)
+		}
+	}
+}
+
+func TestParseSender(t *testing.T) {
+	for _, tt := range []struct {
+		addr, want string
+	}{
+		{"azGDORePK8gMaC0QOYAMyEEuzJnyUi@example.com", "azGDORePK8gMaC0QOYAMyEEuzJnyUi"},
+		{"nas-azGDORePK8gMaC0QOYAMyEEuzJnyUi@example.com", "azGDORePK8gMaC0QOYAMyEEuzJnyUi"},
+		{"ops@example.com", ""},
+		{"azGDORePK8gMaC0QOYAMyEEuzJnyUi", ""},
+	} {
+		got := ParseSender(tt.addr)
+		if got.AppToken != tt.want || got.Address != tt.addr {
+			t.Errorf("ParseSender(%q) = %+v, want app token %q", tt.addr, *got, tt.want)
+		}
+	}
+}
+
+// formatRecipient is the inverse of ParseRecipient.
+func formatRecipient(r *Recipient) string {
+	var sb strings.Builder
+	sb.WriteString(r.UserToken)
+	if r.Device != "" {
+		sb.WriteString(">" + r.Device)
+	}
+	if r.Priority != 0 {
+		sb.WriteString("#" + strconv.Itoa(r.Priority))
+	}
+	if r.RetrySec != 0 {
+		sb.WriteString("%" + strconv.Itoa(r.RetrySec))
+	}
+	if r.ExpireSec != 0 {
+		sb.WriteString("$" + strconv.Itoa(r.ExpireSec))
+	}
+	if r.Sound != "" {
+		sb.WriteString("!" + r.Sound)
+	}
+	if r.Profile != "" {
+		sb.WriteString("+" + r.Profile)
+	}
+	return sb.String() + "@api.pushover.net"
+}
+
+func FuzzParseRecipient(f *testing.F) {
+	for _, addr := range recipientSeeds {
+		f.Add(addr)
+	}
+	f.Fuzz(func(t *testing.T, addr string) {
+		r := ParseRecipient(addr)
+		if r.UserToken == "" {
+			if *r != (Recipient{}) {
+				t.Fatalf("ParseRecipient(%q) = %+v, has options but no user token", addr, *r)
+			}
+			return
+		}
+		if !DefaultTokens.IsUserToken(r.UserToken) || !strings.HasPrefix(addr, r.UserToken) {
+			t.Fatalf("ParseRecipient(%q) has user token %q", addr, r.UserToken)
+		}
+		if r.Priority < -9 || r.Priority > 9 || r.RetrySec < 0 || r.ExpireSec < 0 {
+			t.Fatalf("ParseRecipient(%q) = %+v, out of range", addr, *r)
+		}
+		for _, v := range []string{r.Device, r.Sound, r.Profile} {
+			if strings.ContainsAny(v, recipientFlags+"@") {
+				t.Fatalf("ParseRecipient(%q) = %+v, runs flags together", addr, *r)
+			}
+		}
+		again := formatRecipient(r)
+		if r2 := ParseRecipient(again); *r2 != *r {
+			t.Fatalf("ParseRecipient(%q) = %+v, but ParseRecipient(%q) = %+v", addr, *r, again, *r2)
+		}
+	})
+}
+
+func FuzzParseSender(f *testing.F) {
+	for _, addr := range []string{
+		"azGDORePK8gMaC0QOYAMyEEuzJnyUi@example.com",
+		"nas-azGDORePK8gMaC0QOYAMyEEuzJnyUi@example.com",
+		"a@b@c",
+		"nas@example.com",
+		"@",
+		"",
+	} {
+		f.Add(addr)
+	}
+	f.Fuzz(func(t *testing.T, addr string) {
+		s := ParseSender(addr)
+		if s.Address != addr {
+			t.Fatalf("ParseSender(%q) has address %q", addr, s.Address)
+		}
+		if s.AppToken == "" {
+			return
+		}
+		if !DefaultTokens.IsAppToken(s.AppToken) || !strings.Contains(addr, s.AppToken+"@") {
+			t.Fatalf("ParseSender(%q) has app token %q", addr, s.AppToken)
+		}
+		again := s.AppToken + "@example.com"
+		if s2 := ParseSender(again); s2.AppToken != s.AppToken {
+			t.Fatalf("ParseSender(%q) has app token %q, but ParseSender(%q) has %q", addr, s.AppToken, again, s2.AppToken)
+		}
+	})
+}
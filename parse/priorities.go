@@ -0,0 +1,113 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Retry and expiry given to notifications raised to emergency priority, which
+// Pushover requires them for, if they have none.
+const (
+	emergencyRetrySec  = 60
+	emergencyExpireSec = 3600
+)
+
+// PriorityRules set or adjust the priority of notifications whose subject or
+// body matches a pattern. The first rule that matches wins.
+type PriorityRules []*PriorityRule
+
+// A PriorityRule applies to notifications whose subject or body matches
+// Pattern. If Relative is set, it adds Priority to their priority, from the
+// address or profile; otherwise, it replaces it.
+type PriorityRule struct {
+	Pattern  *regexp.Regexp
+	Priority int
+	Relative bool
+}
+
+// ParsePriorityRules parses a comma-separated list of priority rules in the
+// form of pattern=change, where pattern is a regular expression and change is
+// either a priority written as it is in a recipient address, such as #2 or
+// #-1, or an adjustment, such as +1 or -1. For example, CRITICAL=#2,OK=-1.
+func ParsePriorityRules(list string) (PriorityRules, error) {
+	var rules PriorityRules
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.LastIndex(s, "=")
+		if i <= 0 {
+			return nil, errors.New("invalid priority rule (expected pattern=change): " + s)
+		}
+		pattern, change := s[:i], s[i+1:]
+		rule := &PriorityRule{Relative: !strings.HasPrefix(change, "#")}
+		n, err := strconv.Atoi(strings.TrimPrefix(change, "#"))
+		if rule.Relative && !strings.HasPrefix(change, "+") && !strings.HasPrefix(change, "-") {
+			err = errors.New("missing sign")
+		}
+		if err != nil || n < -4 || n > 4 || !rule.Relative && (n < -2 || n > 2) {
+			return nil, errors.New("invalid priority rule (expected a priority from #-2 to #2, or an adjustment such as +1): " + s)
+		}
+		rule.Priority = n
+		if rule.Pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, errors.New("invalid priority rule: " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Apply sets or adjusts the priority of a Recipient by the first rule that
+// matches the subject or body of an Envelope.
+func (rs PriorityRules) Apply(r *Recipient, e *Envelope) {
+	for _, rule := range rs {
+		if !rule.Pattern.MatchString(e.Subject) && !rule.Pattern.MatchString(e.Body) {
+			continue
+		}
+		if rule.Relative {
+			r.SetPriority(min(max(r.Priority+rule.Priority, -2), 2))
+		} else {
+			r.SetPriority(rule.Priority)
+		}
+		return
+	}
+}
+
+// SetPriority changes the priority of a Recipient, giving it a retry interval
+// and expiry if it becomes an emergency without them.
+func (r *Recipient) SetPriority(priority int) {
+	r.Priority = priority
+	if r.Priority == 2 {
+		if r.RetrySec == 0 {
+			r.RetrySec = emergencyRetrySec
+		}
+		if r.ExpireSec == 0 {
+			r.ExpireSec = emergencyExpireSec
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// ProfileHeader names the email header that selects a profile for every
+// recipient of a message that doesn't select one itself.
+const ProfileHeader = "X-Pushover-Profile"
+
+// profileToken stands in for a user token while parsing a profile's options.
+const profileToken = "uprofile"
+
+var profileNameRe = regexp.MustCompile(`^\w+$`)
+
+// Profiles holds named combinations of notification options, so that they need
+// not be spelled out in every recipient address. Each profile is a Recipient
+// without a user token.
+type Profiles map[string]*Recipient
+
+// ParseProfiles parses a comma-separated list of profiles in the form of
+// name=options, where options are written as they would be after a user token,
+// such as critical=#2%60$3600!siren.
+func ParseProfiles(list string) (Profiles, error) {
+	profiles := make(Profiles)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		split := strings.SplitN(s, "=", 2)
+		if len(split) != 2 || !profileNameRe.MatchString(split[0]) {
+			return nil, errors.New("invalid profile (expected name=options): " + s)
+		}
+		r := ParseRecipient(profileToken + split[1] + "@")
+		if r.UserToken != profileToken || r.Profile != "" {
+			return nil, errors.New("invalid profile options: " + s)
+		}
+		r.UserToken = ""
+		profiles[split[0]] = r
+	}
+	return profiles, nil
+}
+
+// Apply fills in the options a Recipient doesn't set itself from a profile. It
+// reports whether the profile exists.
+func (p Profiles) Apply(r *Recipient, name string) bool {
+	profile, ok := p[name]
+	if !ok {
+		return false
+	}
+	if r.Device == "" {
+		r.Device = profile.Device
+	}
+	if r.Priority == 0 {
+		r.Priority = profile.Priority
+	}
+	if r.RetrySec == 0 {
+		r.RetrySec = profile.RetrySec
+	}
+	if r.ExpireSec == 0 {
+		r.ExpireSec = profile.ExpireSec
+	}
+	if r.Sound == "" {
+		r.Sound = profile.Sound
+	}
+	return true
+}
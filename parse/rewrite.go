@@ -0,0 +1,157 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rewrites edit the subjects and bodies of notifications with regular
+// expressions, such as to strip footers or redact addresses.
+type Rewrites struct {
+	Path string
+
+	rules []*rewriteRule
+}
+
+type rewriteRule struct {
+	rcpt        string // empty for every recipient
+	field       string // subject or body
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// LoadRewrites reads a file of rewrites, one per line, in the form of
+// [recipient] field s/pattern/replacement/[i], where field is subject or body,
+// the pattern is a regular expression, and the replacement may refer to its
+// submatches as $1 and so on. Any character may take the place of the slashes,
+// and is escaped with a backslash. If recipient is given, as an address, a
+// local part such as ops@, or a domain such as @example.com, the rewrite
+// applies only to notifications for matching recipients. Lines beginning with #
+// are ignored. For example:
+//
+//	subject s/^\[JIRA\] //
+//	ops@ body s/\b\d+\.\d+\.\d+\.\d+\b/[redacted]/
+func LoadRewrites(path string) (*Rewrites, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rw := &Rewrites{Path: path}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRewrite(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+		rw.rules = append(rw.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func parseRewrite(line string) (*rewriteRule, error) {
+	r := new(rewriteRule)
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] != "subject" && fields[0] != "body" {
+		if !strings.Contains(fields[0], "@") {
+			return nil, fmt.Errorf("expected [recipient] subject|body s/pattern/replacement/, found %q", fields[0])
+		}
+		r.rcpt = strings.ToLower(fields[0])
+		line = strings.TrimSpace(line[len(fields[0]):])
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || fields[0] != "subject" && fields[0] != "body" {
+		return nil, fmt.Errorf("expected [recipient] subject|body s/pattern/replacement/")
+	}
+	r.field = fields[0]
+	expr := strings.TrimSpace(line[len(r.field):])
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, fmt.Errorf("expected s/pattern/replacement/, found %q", expr)
+	}
+	parts := splitEscaped(expr[2:], expr[1])
+	if len(parts) != 3 || parts[2] != "" && parts[2] != "i" {
+		return nil, fmt.Errorf("expected s%cpattern%[1]creplacement%[1]c[i], found %q", expr[1], expr)
+	}
+	pattern := parts[0]
+	if parts[2] == "i" {
+		pattern = "(?i)" + pattern
+	}
+	var err error
+	if r.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	r.replacement = parts[1]
+	return r, nil
+}
+
+// splitEscaped splits s at each delim that isn't escaped with a backslash,
+// removing the backslashes that escape delim and leaving any others.
+func splitEscaped(s string, delim byte) []string {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			b.WriteByte(delim)
+			i++
+		case s[i] == delim:
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return append(parts, b.String())
+}
+
+// Apply rewrites the subject and body of an Envelope for its recipient, in the
+// order the rewrites were given.
+func (rw *Rewrites) Apply(e *Envelope) {
+	if rw == nil {
+		return
+	}
+	rcpt := strings.ToLower(e.Rcpt)
+	for _, r := range rw.rules {
+		if r.rcpt != "" && !MatchAddress(r.rcpt, rcpt) {
+			continue
+		}
+		switch r.field {
+		case "subject":
+			e.Subject = r.pattern.ReplaceAllString(e.Subject, r.replacement)
+		case "body":
+			e.Body = r.pattern.ReplaceAllString(e.Body, r.replacement)
+		}
+	}
+}
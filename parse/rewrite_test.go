@@ -0,0 +1,132 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRewrite(t *testing.T) {
+	for _, tt := range []struct {
+		line                 string
+		rcpt, field, pattern string
+		replacement          string
+	}{
+		{`subject s/^\[JIRA\] //`, "", "subject", `^\[JIRA\] `, ""},
+		{`body s/a/b/i`, "", "body", `(?i)a`, "b"},
+		{`Ops@ body s|/var/log|[logs]|`, "ops@", "body", `/var/log`, "[logs]"},
+		{`@Example.com subject s/x\/y/$1/`, "@example.com", "subject", `x/y`, "$1"},
+		{`subject   s#a\#b#c\d#`, "", "subject", `a#b`, `c\d`},
+	} {
+		r, err := parseRewrite(tt.line)
+		if err != nil {
+			t.Errorf("parseRewrite(%q): %v", tt.line, err)
+			continue
+		}
+		if r.rcpt != tt.rcpt || r.field != tt.field || r.pattern.String() != tt.pattern || r.replacement != tt.replacement {
+			t.Errorf("parseRewrite(%q) = %q %q %q %q, want %q %q %q %q", tt.line,
+				r.rcpt, r.field, r.pattern, r.replacement, tt.rcpt, tt.field, tt.pattern, tt.replacement)
+		}
+	}
+	for _, line := range []string{
+		`s/a/b/`,
+		`title s/a/b/`,
+		`ops subject s/a/b/`,
+		`subject`,
+		`subject x/a/b/`,
+		`subject s/a/b`,
+		`subject s/a/b/g`,
+		`subject s/a/b/c/`,
+		`subject s/(/b/`,
+	} {
+		if _, err := parseRewrite(line); err == nil {
+			t.Errorf("parseRewrite(%q) succeeded", line)
+		}
+	}
+}
+
+func TestSplitEscaped(t *testing.T) {
+	for in, want := range map[string][]string{
+		`a/b/`:     {"a", "b", ""},
+		`a\/b/c/i`: {"a/b", "c", "i"},
+		`a\.b/c/`:  {`a\.b`, "c", ""},
+		`a\`:       {`a\`},
+		``:         {""},
+	} {
+		if got := splitEscaped(in, '/'); strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+			t.Errorf("splitEscaped(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rewrites")
+	if err := os.WriteFile(path, []byte(`# Strip the JIRA tag.
+subject s/^\[JIRA\] //
+
+ops@ body s/\b\d+\.\d+\.\d+\.\d+\b/[redacted]/
+@example.net subject s/(alert)/$1!/i
+body s/-- \n.*//
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rw, err := LoadRewrites(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		rcpt, subject, body string
+		wantSubject         string
+		wantBody            string
+	}{
+		{"ops@example.com", "[JIRA] Alert", "from 10.0.0.1\n-- \nsig",
+			"Alert", "from [redacted]\n"},
+		{"dev@example.com", "[JIRA] Alert", "from 10.0.0.1",
+			"Alert", "from 10.0.0.1"},
+		{"OPS@Example.NET", "ALERT: disk", "10.0.0.1",
+			"ALERT!: disk", "[redacted]"},
+	} {
+		e := &Envelope{Rcpt: tt.rcpt, Subject: tt.subject, Body: tt.body}
+		rw.Apply(e)
+		if e.Subject != tt.wantSubject || e.Body != tt.wantBody {
+			t.Errorf("rewriting for %s: %q, %q, want %q, %q", tt.rcpt, e.Subject, e.Body, tt.wantSubject, tt.wantBody)
+		}
+	}
+
+	var nilRewrites *Rewrites
+	e := &Envelope{Subject: "[JIRA] x"}
+	nilRewrites.Apply(e)
+	if e.Subject != "[JIRA] x" {
+		t.Errorf("nil Rewrites changed the subject to %q", e.Subject)
+	}
+
+	if err := os.WriteFile(path, []byte("subject s/a/b/\nbody s/(/b/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRewrites(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadRewrites() = %v, want an error on line 2", err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var soundNameRe = regexp.MustCompile(`^\w+$`)
+
+// SoundRules choose the sound of notifications that don't set one themselves,
+// by sender address or subject. The first rule that matches wins.
+type SoundRules []*SoundRule
+
+// A SoundRule plays Sound for notifications whose sender matches Sender, or
+// if Subject is set, whose subject matches Subject.
+type SoundRule struct {
+	// Sender is a whole address, a local part ending in @, or a domain
+	// beginning with @.
+	Sender  string
+	Subject *regexp.Regexp
+	Sound   string
+}
+
+// ParseSoundRules parses a comma-separated list of sound rules in the form of
+// match=sound, where match is a sender address such as ups@nas.local, a local
+// part such as ups@, a domain such as @nas.local, or a regular expression for
+// the subject between slashes, such as /battery/.
+func ParseSoundRules(list string) (SoundRules, error) {
+	var rules SoundRules
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.LastIndex(s, "=")
+		if i < 0 || !soundNameRe.MatchString(s[i+1:]) {
+			return nil, errors.New("invalid sound rule (expected match=sound): " + s)
+		}
+		match, rule := s[:i], &SoundRule{Sound: s[i+1:]}
+		if len(match) > 1 && strings.HasPrefix(match, "/") && strings.HasSuffix(match, "/") {
+			re, err := regexp.Compile(match[1 : len(match)-1])
+			if err != nil {
+				return nil, errors.New("invalid sound rule: " + err.Error())
+			}
+			rule.Subject = re
+		} else if strings.Contains(match, "@") {
+			rule.Sender = strings.ToLower(match)
+		} else {
+			return nil, errors.New("invalid sound rule (expected an address, ups@, @domain, or /subject/): " + s)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Match reports whether a rule applies to a notification.
+func (r *SoundRule) Match(sender, subject string) bool {
+	if r.Subject != nil {
+		return r.Subject.MatchString(subject)
+	}
+	return MatchAddress(r.Sender, strings.ToLower(sender))
+}
+
+// MatchAddress reports whether a lowercase address matches a pattern that is
+// a whole address, a local part ending in @, or a domain beginning with @.
+func MatchAddress(pattern, addr string) bool {
+	switch {
+	case strings.HasSuffix(pattern, "@"):
+		return strings.HasPrefix(addr, pattern)
+	case strings.HasPrefix(pattern, "@"):
+		return strings.HasSuffix(addr, pattern)
+	}
+	return addr == pattern
+}
+
+// Apply sets the sound of a Recipient that has none from the first rule that
+// matches the sender and subject of an Envelope.
+func (rs SoundRules) Apply(r *Recipient, e *Envelope) {
+	if r.Sound != "" || e.From == nil {
+		return
+	}
+	for _, rule := range rs {
+		if rule.Match(e.From.Address, e.Subject) {
+			r.Sound = rule.Sound
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package parse
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Fields of an Envelope that a Suppression can match.
+const (
+	SuppressFrom    = "from"
+	SuppressSubject = "subject"
+	SuppressBody    = "body"
+)
+
+// Suppressions discard messages known to be noise, such as routine reports,
+// before they are sent.
+type Suppressions []*Suppression
+
+// A Suppression discards messages whose Field matches Pattern.
+type Suppression struct {
+	Field   string
+	Pattern *regexp.Regexp
+}
+
+func (s *Suppression) String() string {
+	return s.Field + ":" + s.Pattern.String()
+}
+
+// ParseSuppressions parses a comma-separated list of suppressions in the form
+// of field:pattern, where field is from, subject, or body, and pattern is a
+// regular expression, such as subject:patrol read completed.
+func ParseSuppressions(list string) (Suppressions, error) {
+	var sups Suppressions
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		field, pattern, ok := strings.Cut(s, ":")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || field != SuppressFrom && field != SuppressSubject && field != SuppressBody {
+			return nil, errors.New("invalid suppression (expected from, subject, or body:pattern): " + s)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New("invalid suppression: " + err.Error())
+		}
+		sups = append(sups, &Suppression{Field: field, Pattern: re})
+	}
+	return sups, nil
+}
+
+// Match returns the first Suppression that matches an Envelope, or nil if
+// none does.
+func (sups Suppressions) Match(e *Envelope) *Suppression {
+	for _, s := range sups {
+		var value string
+		switch s.Field {
+		case SuppressFrom:
+			if e.From != nil {
+				value = e.From.Address
+			}
+		case SuppressSubject:
+			value = e.Subject
+		case SuppressBody:
+			value = e.Body
+		}
+		if s.Pattern.MatchString(value) {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package plugin runs external programs that filter or deliver notifications,
+// so that site-specific integrations need not be built into SMTP Translator.
+//
+// A plugin is any executable. It is started once per notification and reads a
+// Message as JSON from its standard input.
+//
+// A notifier plugin delivers the Message. It exits 0 if it succeeded,
+// ExitTempFail if the Message should be retried later, and with any other
+// status if the Message cannot be delivered.
+//
+// A filter plugin decides whether the Message is sent, and may change it. It
+// exits 0 to let the Message through, optionally writing the fields to change as
+// a JSON object to its standard output, or ExitDrop to discard it. Filters that fail in any
+// other way are ignored, so that a broken filter cannot swallow alerts.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// Exit statuses with special meanings.
+const (
+	// ExitTempFail, sendmail's EX_TEMPFAIL, asks for a retry.
+	ExitTempFail = 75
+	// ExitDrop, as in qmail, discards a Message.
+	ExitDrop = 99
+)
+
+// Timeout bounds each run of a plugin.
+const Timeout = 30 * time.Second
+
+// A Message is the JSON form of an Envelope that plugins receive. Filters may
+// change the Subject, Body, and notification options; other fields are
+// informational.
+type Message struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Subject    string `json:"subject"`
+	Body       string `json:"body"`
+	Attachment []byte `json:"attachment,omitempty"`
+
+	UserToken string `json:"user_token,omitempty"`
+	Device    string `json:"device,omitempty"`
+	Priority  int    `json:"priority"`
+	RetrySec  int    `json:"retry,omitempty"`
+	ExpireSec int    `json:"expire,omitempty"`
+	Sound     string `json:"sound,omitempty"`
+
+	ID        string `json:"id,omitempty"`
+	Client    string `json:"client,omitempty"`
+	User      string `json:"user,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// NewMessage converts an Envelope into a Message.
+func NewMessage(e *parse.Envelope) *Message {
+	m := &Message{
+		From:       e.From.Address,
+		To:         e.Rcpt,
+		Subject:    e.Subject,
+		Body:       e.Body,
+		Attachment: e.Attachment,
+		ID:         e.ID,
+		Client:     e.Client,
+		User:       e.User,
+		MessageID:  e.MessageID}
+	if e.To != nil {
+		m.UserToken = e.To.UserToken
+		m.Device = e.To.Device
+		m.Priority = e.To.Priority
+		m.RetrySec = e.To.RetrySec
+		m.ExpireSec = e.To.ExpireSec
+		m.Sound = e.To.Sound
+	}
+	return m
+}
+
+// apply copies the fields a filter may change back into an Envelope.
+func (m *Message) apply(e *parse.Envelope) {
+	e.Subject = m.Subject
+	e.Body = m.Body
+	if e.To != nil {
+		e.To.Device = m.Device
+		e.To.Priority = m.Priority
+		e.To.RetrySec = m.RetrySec
+		e.To.ExpireSec = m.ExpireSec
+		e.To.Sound = m.Sound
+	}
+}
+
+// run starts a plugin, feeds it a Message, and returns its standard output and
+// exit status. The error describes any failure other than a nonzero status.
+func run(path string, m *Message) (out []byte, status int, err error) {
+	in, err := json.Marshal(m)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		status = exitErr.ExitCode()
+		err = nil
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		return stdout.Bytes(), status, err
+	} else if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, -1, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	return stdout.Bytes(), 0, nil
+}
+
+// Notify delivers an Envelope with a notifier plugin. In the event of an error
+// condition, retryable indicates whether or not the Envelope can be resent.
+func Notify(path string, e *parse.Envelope) (retryable bool, err error) {
+	_, status, err := run(path, NewMessage(e))
+	switch {
+	case status < 0:
+		return true, err
+	case status == 0:
+		return false, nil
+	case err == nil:
+		err = fmt.Errorf("plugin %s exited with status %d", path, status)
+	default:
+		err = fmt.Errorf("plugin %s: %v", path, err)
+	}
+	return status == ExitTempFail, err
+}
+
+// Check reports whether a plugin can be run.
+func Check(path string) error {
+	_, err := exec.LookPath(path)
+	return err
+}
+
+// Filter runs a filter plugin on an Envelope, applying any changes it makes. It
+// reports whether the Envelope should still be sent. If the filter fails, the
+// Envelope is kept unchanged and the error is returned.
+func Filter(path string, e *parse.Envelope) (keep bool, err error) {
+	m := NewMessage(e)
+	out, status, err := run(path, m)
+	switch {
+	case status == ExitDrop:
+		return false, nil
+	case status < 0:
+		return true, err
+	case status != 0 && err == nil:
+		return true, fmt.Errorf("plugin %s exited with status %d", path, status)
+	case status != 0:
+		return true, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return true, nil
+	}
+	// Fields the filter leaves out keep their values.
+	if err := json.Unmarshal(out, m); err != nil {
+		return true, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	m.apply(e)
+	return true, nil
+}
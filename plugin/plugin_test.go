@@ -0,0 +1,113 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// writePlugin writes a shell script plugin and returns its path.
+func writePlugin(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testEnvelope() *parse.Envelope {
+	return &parse.Envelope{
+		From:    &parse.Sender{Address: "nas@example.com"},
+		To:      &parse.Recipient{UserToken: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG"},
+		Subject: "Backup finished",
+		Body:    "All done."}
+}
+
+func TestNotify(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	out := filepath.Join(t.TempDir(), "message.json")
+	for _, tt := range []struct {
+		script    string
+		retryable bool
+		err       string
+	}{
+		{"cat >" + out, false, ""},
+		{"exit 75", true, "exited with status 75"},
+		{"echo 'no such user' >&2; exit 1", false, "no such user"},
+		{"exit 99", false, "exited with status 99"},
+	} {
+		retryable, err := Notify(writePlugin(t, tt.script), testEnvelope())
+		if retryable != tt.retryable || tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("Notify() with %q = %v, %v, want %v, %q", tt.script, retryable, err, tt.retryable, tt.err)
+		}
+	}
+	in, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"from":"nas@example.com"`, `"subject":"Backup finished"`, `"user_token":"uQiRzpo4DXghDmr9QzzfQu27cmVRsG"`} {
+		if !strings.Contains(string(in), want) {
+			t.Errorf("plugin read %s, want %s in it", in, want)
+		}
+	}
+	if retryable, err := Notify(filepath.Join(t.TempDir(), "missing"), testEnvelope()); !retryable || err == nil {
+		t.Errorf("Notify() with a missing plugin = %v, %v, want a retryable error", retryable, err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	for _, tt := range []struct {
+		script      string
+		keep        bool
+		failed      bool
+		wantSubject string
+	}{
+		{"exit 0", true, false, "Backup finished"},
+		{`echo '{"subject":"Rewritten","priority":1}'`, true, false, "Rewritten"},
+		{"exit 99", false, false, "Backup finished"},
+		// Broken filters let the notification through unchanged.
+		{"echo 'not json'", true, true, "Backup finished"},
+		{"echo '{\"subject\":\"x\"}'; exit 3", true, true, "Backup finished"},
+	} {
+		e := testEnvelope()
+		keep, err := Filter(writePlugin(t, tt.script), e)
+		if keep != tt.keep || (err != nil) != tt.failed || e.Subject != tt.wantSubject {
+			t.Errorf("Filter() with %q = %v, %v, subject %q, want %v, failed %v, subject %q",
+				tt.script, keep, err, e.Subject, tt.keep, tt.failed, tt.wantSubject)
+		}
+		if tt.wantSubject == "Rewritten" && e.To.Priority != 1 {
+			t.Errorf("Filter() with %q left priority %d", tt.script, e.To.Priority)
+		}
+	}
+}
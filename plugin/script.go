@@ -0,0 +1,146 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// scriptFields are the fields a Script may assign, and the types of their
+// expressions. Assigning true to drop discards the notification.
+var scriptFields = map[string]expr.Option{
+	"drop":     expr.AsBool(),
+	"subject":  expr.AsKind(reflect.String),
+	"body":     expr.AsKind(reflect.String),
+	"device":   expr.AsKind(reflect.String),
+	"priority": expr.AsInt(),
+	"retry":    expr.AsInt(),
+	"expire":   expr.AsInt(),
+	"sound":    expr.AsKind(reflect.String)}
+
+// A Script rewrites or drops notifications according to a file of assignments
+// in the form of field = expression, which are evaluated in order. Expressions
+// are written in the expr language (https://expr-lang.org) and can read every
+// field of a Message by its JSON name, including any earlier assignments. Lines
+// beginning with # are ignored. For example:
+//
+//	drop = subject contains "backup succeeded"
+//	priority = from endsWith "@nas.local" && subject contains "failed" ? 1 : priority
+type Script struct {
+	Path string
+
+	steps []scriptStep
+}
+
+type scriptStep struct {
+	line  int
+	field string
+	prog  *vm.Program
+}
+
+// LoadScript reads and compiles a Script.
+func LoadScript(path string) (*Script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &Script{Path: path}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		field := strings.TrimSpace(split[0])
+		typ, ok := scriptFields[field]
+		if len(split) != 2 || !ok {
+			return nil, fmt.Errorf("%s: line %d: expected field = expression, where field is one of drop, subject, body, device, priority, retry, expire, or sound", path, n)
+		}
+		prog, err := expr.Compile(split[1], expr.Env(scriptEnv(&Message{})), typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+		s.steps = append(s.steps, scriptStep{line: n, field: field, prog: prog})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// scriptEnv exposes a Message to expressions.
+func scriptEnv(m *Message) map[string]interface{} {
+	return map[string]interface{}{
+		"from":       m.From,
+		"to":         m.To,
+		"subject":    m.Subject,
+		"body":       m.Body,
+		"user_token": m.UserToken,
+		"device":     m.Device,
+		"priority":   m.Priority,
+		"retry":      m.RetrySec,
+		"expire":     m.ExpireSec,
+		"sound":      m.Sound,
+		"id":         m.ID,
+		"client":     m.Client,
+		"user":       m.User,
+		"message_id": m.MessageID,
+		"drop":       false}
+}
+
+// Run runs the Script on an Envelope, applying its assignments. It reports
+// whether the Envelope should still be sent. If an expression fails, the
+// Envelope is kept unchanged and the error is returned.
+func (s *Script) Run(e *parse.Envelope) (keep bool, err error) {
+	m := NewMessage(e)
+	env := scriptEnv(m)
+	for _, step := range s.steps {
+		out, err := expr.Run(step.prog, env)
+		if err != nil {
+			return true, fmt.Errorf("%s: line %d: %v", s.Path, step.line, err)
+		}
+		if step.field == "drop" && out.(bool) {
+			return false, nil
+		}
+		env[step.field] = out
+	}
+	m.Subject = env["subject"].(string)
+	m.Body = env["body"].(string)
+	m.Device = env["device"].(string)
+	m.Priority = env["priority"].(int)
+	m.RetrySec = env["retry"].(int)
+	m.ExpireSec = env["expire"].(int)
+	m.Sound = env["sound"].(string)
+	m.apply(e)
+	return true, nil
+}
@@ -0,0 +1,691 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// A Sieve is a set of filtering rules in a subset of the Sieve language (RFC
+// 5228), run on each recipient of a message before it is routed. It supports
+// if, elsif, and else; the tests header, address, envelope, exists, body,
+// size, allof, anyof, not, true, and false, with the match types :is,
+// :contains, :matches, and :regex; and the actions keep, discard, redirect,
+// and stop, plus priority and subject, which set the notification's priority
+// and subject. All comparisons ignore case. For example:
+//
+//	if address :domain "from" "nas.local" {
+//	    if header :contains "subject" "patrol read" { discard; stop; }
+//	    subject "[NAS] ${subject}";
+//	    priority 1;
+//	}
+type Sieve struct {
+	cmds []sieveCmd
+}
+
+// A SieveResult is what a Sieve decided for one recipient of a message.
+type SieveResult struct {
+	// Keep is set if the message should still go to the recipient.
+	Keep bool
+	// Redirect lists the addresses to send the message to as well.
+	Redirect []string
+	// If SetPriority is set, Priority replaces the notification's priority.
+	Priority    int
+	SetPriority bool
+	// If SetSubject is set, Subject replaces the message's subject.
+	Subject    string
+	SetSubject bool
+}
+
+// A SieveMessage is what a Sieve examines: the message's headers and text,
+// and its envelope sender and recipient.
+type SieveMessage struct {
+	Header  mail.Header
+	Subject string
+	Body    string
+	Size    int
+	From    string
+	To      string
+}
+
+type sieveCmd struct {
+	name  string
+	arg   string // redirect's address or subject's text
+	num   int    // priority's value
+	tests []sieveTest
+	then  [][]sieveCmd // for if, the block for each test, then an else block
+}
+
+type sieveTest struct {
+	name  string
+	not   bool
+	match string // :is, :contains, :matches, or :regex
+	part  string // :all, :localpart, or :domain
+	over  bool   // for size
+	num   int
+	names []string
+	keys  []string
+	res   []*regexp.Regexp
+	sub   []sieveTest
+}
+
+// errSieveStop ends a Sieve early.
+var errSieveStop = errors.New("stop")
+
+// ParseSieve compiles a Sieve from its source.
+func ParseSieve(src string) (*Sieve, error) {
+	toks, err := sieveTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &sieveParser{toks: toks}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return &Sieve{cmds: cmds}, nil
+}
+
+// Run runs the Sieve on a message for one of its recipients.
+func (s *Sieve) Run(m *SieveMessage) *SieveResult {
+	st := &sieveState{msg: m, implicitKeep: true}
+	st.run(s.cmds)
+	st.res.Keep = st.res.Keep || st.implicitKeep
+	return &st.res
+}
+
+type sieveState struct {
+	msg          *SieveMessage
+	res          SieveResult
+	implicitKeep bool
+}
+
+func (st *sieveState) run(cmds []sieveCmd) error {
+	for _, c := range cmds {
+		switch c.name {
+		case "if":
+			// The block after the last test, if any, is the else.
+			i := 0
+			for i < len(c.tests) && !st.test(c.tests[i]) {
+				i++
+			}
+			if i < len(c.then) {
+				if err := st.run(c.then[i]); err != nil {
+					return err
+				}
+			}
+		case "keep":
+			st.res.Keep = true
+		case "discard":
+			st.implicitKeep = false
+		case "redirect":
+			st.implicitKeep = false
+			st.res.Redirect = append(st.res.Redirect, c.arg)
+		case "priority":
+			st.res.Priority, st.res.SetPriority = c.num, true
+		case "subject":
+			st.res.Subject, st.res.SetSubject = st.expand(c.arg), true
+		case "stop":
+			return errSieveStop
+		}
+	}
+	return nil
+}
+
+// expand replaces ${subject}, ${from}, and ${to} in s.
+func (st *sieveState) expand(s string) string {
+	subject := st.msg.Subject
+	if st.res.SetSubject {
+		subject = st.res.Subject
+	}
+	return strings.NewReplacer(
+		"${subject}", subject,
+		"${from}", st.msg.From,
+		"${to}", st.msg.To).Replace(s)
+}
+
+func (st *sieveState) test(t sieveTest) bool {
+	return st.eval(t) != t.not
+}
+
+func (st *sieveState) eval(t sieveTest) bool {
+	switch t.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "allof":
+		for _, sub := range t.sub {
+			if !st.test(sub) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, sub := range t.sub {
+			if st.test(sub) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range t.names {
+			if len(st.header(name)) == 0 {
+				return false
+			}
+		}
+		return true
+	case "size":
+		if t.over {
+			return st.msg.Size > t.num
+		}
+		return st.msg.Size < t.num
+	case "body":
+		return t.matchAny([]string{st.msg.Body})
+	case "header":
+		for _, name := range t.names {
+			if t.matchAny(st.header(name)) {
+				return true
+			}
+		}
+		return false
+	case "address":
+		for _, name := range t.names {
+			list, _ := mail.ParseAddressList(strings.Join(st.header(name), ","))
+			for _, addr := range list {
+				if t.matchAny([]string{addressPart(addr.Address, t.part)}) {
+					return true
+				}
+			}
+		}
+		return false
+	case "envelope":
+		for _, name := range t.names {
+			var addr string
+			switch strings.ToLower(name) {
+			case "from":
+				addr = st.msg.From
+			case "to":
+				addr = st.msg.To
+			default:
+				continue
+			}
+			if t.matchAny([]string{addressPart(addr, t.part)}) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// header returns the values of a header, decoded. Messages without headers,
+// such as those from the HTTP API, still have a subject.
+func (st *sieveState) header(name string) []string {
+	if strings.EqualFold(name, "subject") && st.res.SetSubject {
+		return []string{st.res.Subject}
+	}
+	values := st.msg.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	if len(values) == 0 && strings.EqualFold(name, "subject") && st.msg.Subject != "" {
+		return []string{st.msg.Subject}
+	}
+	dec := new(mime.WordDecoder)
+	decoded := make([]string, len(values))
+	for i, v := range values {
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		decoded[i] = v
+	}
+	return decoded
+}
+
+// addressPart returns part of an address: :localpart, :domain, or :all.
+func addressPart(addr, part string) string {
+	at := strings.LastIndex(addr, "@")
+	switch {
+	case part == ":localpart" && at >= 0:
+		return addr[:at]
+	case part == ":domain":
+		return addr[at+1:]
+	}
+	return addr
+}
+
+func (t *sieveTest) matchAny(values []string) bool {
+	for _, v := range values {
+		for i, key := range t.keys {
+			if t.matchOne(v, key, i) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *sieveTest) matchOne(value, key string, i int) bool {
+	switch t.match {
+	case ":contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(key))
+	case ":matches", ":regex":
+		return t.res[i].MatchString(value)
+	}
+	return strings.EqualFold(value, key)
+}
+
+// Parsing.
+
+type sieveToken struct {
+	kind byte // 'i' identifier, 't' tag, 's' string, 'n' number, or punctuation
+	text string
+	num  int
+	line int
+}
+
+func sieveTokens(src string) ([]sieveToken, error) {
+	var toks []sieveToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			var b strings.Builder
+			start := line
+			for i++; ; i++ {
+				if i >= len(src) {
+					return nil, fmt.Errorf("line %d: unterminated string", start)
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				if src[i] == '\n' {
+					line++
+				}
+				b.WriteByte(src[i])
+			}
+			toks = append(toks, sieveToken{kind: 's', text: b.String(), line: start})
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(src[i:j])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad number %q", line, src[i:j])
+			}
+			if j < len(src) {
+				switch src[j] {
+				case 'K', 'k':
+					n, j = n<<10, j+1
+				case 'M', 'm':
+					n, j = n<<20, j+1
+				case 'G', 'g':
+					n, j = n<<30, j+1
+				}
+			}
+			toks = append(toks, sieveToken{kind: 'n', text: src[i:j], num: n, line: line})
+			i = j
+		case c == ':' || c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			kind := byte('i')
+			if c == ':' {
+				kind = 't'
+			}
+			toks = append(toks, sieveToken{kind: kind, text: strings.ToLower(src[i:j]), line: line})
+			i = j
+		case strings.IndexByte("[](),;{}", c) >= 0:
+			toks = append(toks, sieveToken{kind: c, text: string(c), line: line})
+			i++
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", line, c)
+		}
+	}
+	return toks, nil
+}
+
+type sieveParser struct {
+	toks []sieveToken
+	pos  int
+}
+
+func (p *sieveParser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *sieveParser) peek() sieveToken {
+	if p.done() {
+		return sieveToken{text: "end of rules"}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *sieveParser) next() sieveToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *sieveParser) errorf(format string, a ...interface{}) error {
+	line := 0
+	if p.pos < len(p.toks) {
+		line = p.toks[p.pos].line
+	} else if len(p.toks) > 0 {
+		line = p.toks[len(p.toks)-1].line
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, a...))
+}
+
+func (p *sieveParser) expect(kind byte) (sieveToken, error) {
+	if p.peek().kind != kind {
+		want := map[byte]string{'s': "a string", 'n': "a number", 'i': "a name"}[kind]
+		if want == "" {
+			want = fmt.Sprintf("%q", kind)
+		}
+		return sieveToken{}, p.errorf("expected %s, found %q", want, p.peek().text)
+	}
+	return p.next(), nil
+}
+
+// commands parses commands up to the end of the rules or a closing brace.
+func (p *sieveParser) commands() ([]sieveCmd, error) {
+	var cmds []sieveCmd
+	for !p.done() && p.peek().kind != '}' {
+		name, err := p.expect('i')
+		if err != nil {
+			return nil, err
+		}
+		c := sieveCmd{name: name.text}
+		switch c.name {
+		case "require":
+			// Extensions are either built in or unsupported, and the
+			// latter are caught where they are used.
+			if _, err := p.strings(); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(';'); err != nil {
+				return nil, err
+			}
+			continue
+		case "if":
+			for {
+				t, err := p.test()
+				if err != nil {
+					return nil, err
+				}
+				block, err := p.block()
+				if err != nil {
+					return nil, err
+				}
+				c.tests, c.then = append(c.tests, t), append(c.then, block)
+				if p.peek().text != "elsif" {
+					break
+				}
+				p.next()
+			}
+			if p.peek().text == "else" {
+				p.next()
+				block, err := p.block()
+				if err != nil {
+					return nil, err
+				}
+				c.then = append(c.then, block)
+			}
+			cmds = append(cmds, c)
+			continue
+		case "keep", "discard", "stop":
+		case "redirect", "subject":
+			s, err := p.expect('s')
+			if err != nil {
+				return nil, err
+			}
+			c.arg = s.text
+		case "priority":
+			n, err := p.expect('n')
+			if err != nil {
+				return nil, err
+			}
+			if n.num < -2 || n.num > 2 {
+				return nil, p.errorf("priority must be from -2 to 2")
+			}
+			c.num = n.num
+		case "elsif", "else":
+			return nil, p.errorf("%s without if", c.name)
+		default:
+			return nil, p.errorf("unknown command %q", c.name)
+		}
+		if _, err := p.expect(';'); err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, c)
+	}
+	return cmds, nil
+}
+
+func (p *sieveParser) block() ([]sieveCmd, error) {
+	if _, err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect('}'); err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
+
+// strings parses a string or a bracketed list of strings.
+func (p *sieveParser) strings() ([]string, error) {
+	if p.peek().kind == 's' {
+		return []string{p.next().text}, nil
+	}
+	if _, err := p.expect('['); err != nil {
+		return nil, p.errorf("expected a string or list of strings, found %q", p.peek().text)
+	}
+	var list []string
+	for {
+		s, err := p.expect('s')
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s.text)
+		if p.peek().kind != ',' {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(']'); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (p *sieveParser) test() (sieveTest, error) {
+	name, err := p.expect('i')
+	if err != nil {
+		return sieveTest{}, err
+	}
+	t := sieveTest{name: name.text, match: ":is", part: ":all"}
+	switch t.name {
+	case "true", "false":
+	case "not":
+		sub, err := p.test()
+		sub.not = !sub.not
+		return sub, err
+	case "allof", "anyof":
+		if _, err := p.expect('('); err != nil {
+			return t, err
+		}
+		for {
+			sub, err := p.test()
+			if err != nil {
+				return t, err
+			}
+			t.sub = append(t.sub, sub)
+			if p.peek().kind != ',' {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(')'); err != nil {
+			return t, err
+		}
+	case "exists":
+		if t.names, err = p.strings(); err != nil {
+			return t, err
+		}
+	case "size":
+		tag, err := p.expect('t')
+		if err != nil || tag.text != ":over" && tag.text != ":under" {
+			return t, p.errorf("size takes :over or :under")
+		}
+		n, err := p.expect('n')
+		if err != nil {
+			return t, err
+		}
+		t.over, t.num = tag.text == ":over", n.num
+	case "header", "address", "envelope", "body":
+		for p.peek().kind == 't' {
+			tag := p.next().text
+			switch tag {
+			case ":is", ":contains", ":matches", ":regex":
+				t.match = tag
+			case ":all", ":localpart", ":domain":
+				if t.name != "address" && t.name != "envelope" {
+					return t, p.errorf("%s does not apply to %s", tag, t.name)
+				}
+				t.part = tag
+			case ":comparator":
+				// Every comparison ignores case, as with the
+				// default i;ascii-casemap.
+				if _, err := p.expect('s'); err != nil {
+					return t, err
+				}
+			default:
+				return t, p.errorf("unknown tag %s", tag)
+			}
+		}
+		if t.name != "body" {
+			if t.names, err = p.strings(); err != nil {
+				return t, err
+			}
+		}
+		if t.keys, err = p.strings(); err != nil {
+			return t, err
+		}
+		for _, key := range t.keys {
+			var re *regexp.Regexp
+			switch t.match {
+			case ":matches":
+				re, err = sieveWildcard(key)
+			case ":regex":
+				re, err = regexp.Compile("(?i)" + key)
+			default:
+				continue
+			}
+			if err != nil {
+				return t, p.errorf("%v", err)
+			}
+			t.res = append(t.res, re)
+		}
+	default:
+		return t, p.errorf("unknown test %q", t.name)
+	}
+	return t, nil
+}
+
+// sieveWildcard compiles a :matches pattern, in which "*" stands for any
+// sequence of characters, "?" for any one character, and a backslash makes the
+// character after it stand for itself, into an anchored regular expression.
+func sieveWildcard(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i++; i == len(pattern) {
+				return nil, fmt.Errorf("pattern %q ends with a backslash", pattern)
+			}
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// NewSieveMessage describes an Envelope and its parsed headers to a Sieve.
+func NewSieveMessage(e *parse.Envelope, header mail.Header, rcpt string) *SieveMessage {
+	m := &SieveMessage{
+		Header:  header,
+		Subject: e.Subject,
+		Body:    e.Body,
+		Size:    len(e.Data),
+		To:      rcpt}
+	if e.From != nil {
+		m.From = e.From.Address
+	}
+	return m
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package plugin
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSieveErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src, err string
+	}{
+		{`keep`, "line 1: expected ';'"},
+		{`frobnicate;`, `line 1: unknown command "frobnicate"`},
+		{`if true { keep; }` + "\n" + `else { discard; } else { keep; }`, "line 2: else without if"},
+		{`elsif true { keep; }`, "elsif without if"},
+		{`if bogus "x" { keep; }`, `unknown test "bogus"`},
+		{`if header :over "subject" "x" { keep; }`, "unknown tag :over"},
+		{`if header :domain "subject" "x" { keep; }`, ":domain does not apply to header"},
+		{`if size 10 { keep; }`, "size takes :over or :under"},
+		{`priority 3;`, "priority must be from -2 to 2"},
+		{`redirect;`, "expected a string"},
+		{`if true { keep;`, "expected '}'"},
+		{`keep; }`, `unexpected "}"`},
+		{`subject "unterminated;`, "line 1: unterminated string"},
+		{"/* open\n\n", "line 1: unterminated comment"},
+		{`keep; @`, "unexpected '@'"},
+		{`if header :regex "subject" "(" { keep; }`, "missing closing )"},
+		{`if header :matches "subject" "a\\" { keep; }`, "ends with a backslash"},
+	} {
+		_, err := ParseSieve(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseSieve(%q) = %v, want error containing %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+// sieveTestMessage is the message the Sieves in the tests below run on.
+var sieveTestMessage = &SieveMessage{
+	Header: mail.Header{
+		"From":    {"Backup Server <backup@nas.local>"},
+		"Subject": {"nightly backup 1/2 done"},
+		"X-Tag":   {"=?utf-8?q?caf=C3=A9?="},
+	},
+	Subject: "nightly backup 1/2 done",
+	Body:    "All volumes copied.\nSee *.log for details.",
+	Size:    2048,
+	From:    "backup@nas.local",
+	To:      "uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net",
+}
+
+func TestSieveMatchTypes(t *testing.T) {
+	for _, tt := range []struct {
+		test string
+		want bool
+	}{
+		{`header :is "subject" "NIGHTLY backup 1/2 done"`, true},
+		{`header :is "subject" "nightly backup"`, false},
+		{`header "subject" "nightly backup 1/2 done"`, true},
+		{`header :contains "subject" "BACKUP"`, true},
+		{`header :contains "subject" "restore"`, false},
+		{`header :contains ["x-missing", "subject"] ["restore", "1/2"]`, true},
+		{`header :is "x-tag" "café"`, true},
+		{`header :matches "subject" "*backup*"`, true},
+		{`header :matches "subject" "*BACKUP*"`, true},
+		{`header :matches "subject" "nightly*"`, true},
+		{`header :matches "subject" "backup*"`, false},
+		{`header :matches "subject" "nightly backup ?/? done"`, true},
+		{`header :matches "subject" "nightly backup ? done"`, false},
+		{`header :matches "subject" "*.*"`, false},
+		{`header :matches "x-tag" "caf?"`, true},
+		{`body :matches "*\\*.log*"`, true},
+		{`body :matches "*\\*.txt*"`, false},
+		{`body :matches "all*details."`, true},
+		{`header :regex "subject" "^nightly backup [0-9]/[0-9]"`, true},
+		{`header :regex "subject" "^backup"`, false},
+		{`address :domain "from" "NAS.local"`, true},
+		{`address :localpart "from" "backup"`, true},
+		{`address :all :matches "from" "*@nas.*"`, true},
+		{`address :localpart "from" "nas.local"`, false},
+		{`envelope :domain "to" "api.pushover.net"`, true},
+		{`envelope :localpart :contains "from" "back"`, true},
+		{`envelope "bcc" "backup@nas.local"`, false},
+		{`exists ["from", "subject"]`, true},
+		{`exists ["from", "x-missing"]`, false},
+		{`size :over 1K`, true},
+		{`size :under 1K`, false},
+		{`body :contains "volumes"`, true},
+		{`not body :contains "volumes"`, false},
+		{`allof(true, header :contains "subject" "backup")`, true},
+		{`allof(true, false)`, false},
+		{`anyof(false, not false)`, true},
+		{`anyof(false, false)`, false},
+		{`header :comparator "i;ascii-casemap" :is "subject" "NIGHTLY BACKUP 1/2 DONE"`, true},
+	} {
+		s, err := ParseSieve(`if ` + tt.test + ` { priority 1; }`)
+		if err != nil {
+			t.Errorf("%s: %v", tt.test, err)
+			continue
+		}
+		if got := s.Run(sieveTestMessage).SetPriority; got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.test, got, tt.want)
+		}
+	}
+}
+
+func TestSieveRun(t *testing.T) {
+	for _, tt := range []struct {
+		name, src string
+		want      SieveResult
+	}{
+		{"implicit keep", ``, SieveResult{Keep: true}},
+		{"discard cancels implicit keep", `discard;`, SieveResult{}},
+		{"keep after discard", `discard; keep;`, SieveResult{Keep: true}},
+		{"redirect cancels implicit keep", `redirect "ops@pushover.net";`,
+			SieveResult{Redirect: []string{"ops@pushover.net"}}},
+		{"redirect and keep", `redirect "ops@pushover.net"; keep;`,
+			SieveResult{Keep: true, Redirect: []string{"ops@pushover.net"}}},
+		{"stop", `discard; stop; keep;`, SieveResult{}},
+		{"stop in a block", `if true { priority 2; stop; } priority -1;`,
+			SieveResult{Keep: true, Priority: 2, SetPriority: true}},
+		{"if", `if header :contains "subject" "backup" { priority 1; }`,
+			SieveResult{Keep: true, Priority: 1, SetPriority: true}},
+		{"elsif", `if false { priority 1; } elsif true { priority 2; } else { priority -2; }`,
+			SieveResult{Keep: true, Priority: 2, SetPriority: true}},
+		{"else", `if false { priority 1; } elsif false { priority 2; } else { priority -2; }`,
+			SieveResult{Keep: true, Priority: -2, SetPriority: true}},
+		{"no branch taken", `if false { discard; } elsif false { discard; }`, SieveResult{Keep: true}},
+		{"first true branch only", `if true { priority 1; } elsif true { priority 2; }`,
+			SieveResult{Keep: true, Priority: 1, SetPriority: true}},
+		{"subject", `subject "[NAS] ${subject} for ${to}";`,
+			SieveResult{Keep: true, SetSubject: true, Subject: "[NAS] nightly backup 1/2 done for uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net"}},
+		{"subject seen by later tests", `subject "done"; if header :is "subject" "done" { discard; }`,
+			SieveResult{SetSubject: true, Subject: "done"}},
+		{"comments and require", "require [\"fileinto\"]; # a comment\n/* a\nblock */ discard;", SieveResult{}},
+	} {
+		s, err := ParseSieve(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := s.Run(sieveTestMessage); !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package queue
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A LeaderLock elects one of the instances sharing a file to deliver
+// notifications while the rest stand by. The leader writes its identity and the
+// time its lease expires to the file, and must keep renewing it; once the
+// lease has expired, the first standby to notice becomes the leader. Each
+// instance reads and writes the file only while it holds an exclusive lock on
+// a second file beside it, named with ".lock" appended, so that no two can
+// take the lease at once.
+//
+// The identity is the instance name, the process ID, and a random nonce, so
+// that two processes of the same instance, such as the old and new process
+// during a restart, never mistake each other's lease for their own.
+type LeaderLock struct {
+	path  string
+	id    string
+	lease time.Duration
+
+	mu      sync.Mutex
+	expires time.Time
+	holder  string
+}
+
+// NewLeaderLock prepares a LeaderLock in the file at path for an instance. If
+// lease is zero, DefaultLease is used.
+func NewLeaderLock(path, name string, lease time.Duration) *LeaderLock {
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	id := fmt.Sprintf("%s/%d/%s", name, os.Getpid(), rand.Text())
+	return &LeaderLock{path: path, id: id, lease: lease}
+}
+
+// Lease returns how long the lock lasts once renewed.
+func (l *LeaderLock) Lease() time.Duration {
+	return l.lease
+}
+
+// read returns who holds the lock and until when.
+func (l *LeaderLock) read() (holder string, expires time.Time, err error) {
+	b, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, nil
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+	holder, stamp, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	if expires, err = time.Parse(time.RFC3339Nano, stamp); err != nil {
+		return "", time.Time{}, fmt.Errorf("%s: not a leader lock", l.path)
+	}
+	return holder, expires, nil
+}
+
+// Renew takes or extends the lock if it is free or already held by this
+// instance, and reports whether this instance is the leader. If the lock
+// cannot be read or written, this instance remains the leader only for as long
+// as it is sure that no other can have taken over.
+func (l *LeaderLock) Renew() (bool, error) {
+	guard, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return l.Held(), err
+	}
+	defer guard.Close()
+	holder, expires, err := l.read()
+	if err == nil && holder != l.id && time.Now().Before(expires) {
+		l.set(time.Time{}, holder)
+		return false, nil
+	}
+	if err == nil {
+		expires = time.Now().Add(l.lease)
+		err = writeFile(l.path, []byte(l.id+"\n"+expires.Format(time.RFC3339Nano)+"\n"))
+	}
+	if err != nil {
+		return l.Held(), err
+	}
+	l.set(expires, l.id)
+	return true, nil
+}
+
+func (l *LeaderLock) set(expires time.Time, holder string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expires, l.holder = expires, holder
+}
+
+// Held reports whether this instance is the leader. A third of the lease is
+// kept in hand, so that nothing is sent just as another instance takes over.
+func (l *LeaderLock) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Until(l.expires) >= l.lease/3
+}
+
+// Holder returns the identity of the leader as of the last renewal.
+func (l *LeaderLock) Holder() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder
+}
+
+// Release gives up the lock, if this instance holds it, so that a standby may
+// take over at once.
+func (l *LeaderLock) Release() error {
+	l.mu.Lock()
+	held := time.Now().Before(l.expires)
+	l.expires, l.holder = time.Time{}, ""
+	l.mu.Unlock()
+	if !held {
+		return nil
+	}
+	guard, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer guard.Close()
+	// Leave the file alone if another instance has taken over after all.
+	if holder, _, err := l.read(); err != nil || holder != l.id {
+		return err
+	}
+	return writeFile(l.path, []byte(l.id+"\n"+time.Time{}.Format(time.RFC3339Nano)+"\n"))
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package queue
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaderLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader")
+	// Two processes of the same instance, as during a restart.
+	old := NewLeaderLock(path, "relay-a", time.Hour)
+	successor := NewLeaderLock(path, "relay-a", time.Hour)
+
+	if ok, err := old.Renew(); !ok || err != nil {
+		t.Fatalf("old.Renew() = %v, %v, want leader", ok, err)
+	}
+	if ok, err := successor.Renew(); ok || err != nil {
+		t.Fatalf("successor.Renew() = %v, %v, want standby", ok, err)
+	}
+	if successor.Held() || successor.Holder() != old.id {
+		t.Fatalf("successor sees holder %q, want %q", successor.Holder(), old.id)
+	}
+	if ok, _ := old.Renew(); !ok {
+		t.Fatal("old lost the lock on renewal")
+	}
+
+	if err := old.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if old.Held() {
+		t.Fatal("old still holds the lock after releasing it")
+	}
+	if ok, err := successor.Renew(); !ok || err != nil {
+		t.Fatalf("successor.Renew() after release = %v, %v, want leader", ok, err)
+	}
+	if ok, _ := old.Renew(); ok {
+		t.Fatal("old took the lock back from its successor")
+	}
+}
+
+func TestLeaderLockReleaseAfterTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader")
+	old := NewLeaderLock(path, "relay-a", time.Hour)
+	successor := NewLeaderLock(path, "relay-a", time.Hour)
+	if ok, _ := old.Renew(); !ok {
+		t.Fatal("old could not take the lock")
+	}
+	// The successor takes over once the old lease has run out, while the
+	// old process still believes it holds the lock.
+	if err := writeFile(path, []byte(old.id+"\n"+time.Now().Add(-time.Second).Format(time.RFC3339Nano)+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := successor.Renew(); !ok {
+		t.Fatal("successor could not take over an expired lock")
+	}
+	if err := old.Release(); err != nil {
+		t.Fatal(err)
+	}
+	holder, expires, err := successor.read()
+	if err != nil || holder != successor.id || !time.Now().Before(expires) {
+		t.Fatalf("after the old process released, the lock is held by %q until %v (%v), want %q", holder, expires, err, successor.id)
+	}
+}
@@ -0,0 +1,669 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package queue holds notifications until they are delivered, retrying those
+// that fail for reasons that may pass.
+package queue
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+)
+
+// Outcomes reported by a Queue.
+const (
+	Deferred  = "deferred"
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// RetryInterval is how long a Queue waits before resending a Delivery.
+const RetryInterval = 10 * time.Second
+
+// MaxDead is how many failed Items a Queue keeps as dead letters.
+const MaxDead = 100
+
+// Errors returned when managing Items.
+var (
+	ErrNotFound = errors.New("queue: no such item")
+	ErrSending  = errors.New("queue: item is being sent")
+	ErrClosed   = errors.New("queue: closed")
+)
+
+// An Item is a Delivery in a Queue, either waiting to be sent or, if it failed,
+// kept as a dead letter.
+type Item struct {
+	// Seq identifies the Item within its Queue.
+	Seq      uint64
+	Delivery *notify.Delivery
+	Queued   time.Time
+	Attempts int
+	// NextAttempt is when a deferred Item is due to be resent.
+	NextAttempt time.Time
+	LastError   string
+	// Key identifies the Item in a Store, across instances.
+	Key string `json:",omitempty"`
+
+	started time.Time
+	sending bool
+	done    func()
+}
+
+// A Queue sends Deliveries in the order they were pushed, except that those
+// for the recipients of one message may be sent at the same time. Delivery can
+// be paused, and Items can be inspected, retried, and deleted while it runs.
+type Queue struct {
+	logger *slog.Logger
+	size   int
+	report func(d *notify.Delivery, outcome string, err error)
+
+	mu       sync.Mutex
+	pending  []*Item
+	dead     []*Item
+	seq      uint64
+	paused   bool
+	closed   bool
+	parallel int
+	store    Store
+	restore  func(d *notify.Delivery)
+	leader   *LeaderLock
+	standby  bool
+	// changed is closed and replaced whenever the state changes.
+	changed chan struct{}
+}
+
+// New prepares a Queue that holds up to size Deliveries before Push blocks. It
+// takes a logger and a function, which may be nil, that is
+// told the first time each Delivery is deferred and what finally became of it.
+func New(size int, logger *slog.Logger, report func(d *notify.Delivery, outcome string, err error)) *Queue {
+	if report == nil {
+		report = func(*notify.Delivery, string, error) {}
+	}
+	return &Queue{
+		logger:   logger.With("component", "queue"),
+		size:     size,
+		report:   report,
+		parallel: 1,
+		changed:  make(chan struct{})}
+}
+
+// SetParallel sets how many requests for Deliveries of the same message may be
+// made at once, each of which may send a batch of them to Pushover. The default
+// is 1.
+func (q *Queue) SetParallel(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.parallel = max(n, 1)
+	q.notify()
+}
+
+// SetStore keeps the pending Items in s, and adds those it recovers or takes
+// over from other instances to the Queue. restore, which may be nil, is called
+// on each of their Deliveries to fill in what a Store does not keep, such as
+// DKIM keys. SetStore must be called before Run, and after SetLeader.
+func (q *Queue) SetStore(s Store, restore func(d *notify.Delivery)) error {
+	if restore == nil {
+		restore = func(*notify.Delivery) {}
+	}
+	q.mu.Lock()
+	q.store, q.restore = s, restore
+	standby := q.standby
+	q.mu.Unlock()
+	if standby {
+		return nil
+	}
+	items, err := s.Renew()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.adopt(items)
+	return err
+}
+
+// SetLeader makes the Queue send nothing unless it holds l, standing by while
+// another instance does. A standby does not renew its Store's lease either, so
+// that the leader takes over what it queues. SetLeader must be called before
+// Run.
+func (q *Queue) SetLeader(l *LeaderLock) error {
+	leader, err := l.Renew()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.leader = l
+	q.setStandby(!leader)
+	return err
+}
+
+// setStandby records whether the Queue is standing by. q.mu must be held.
+func (q *Queue) setStandby(standby bool) {
+	if standby == q.standby {
+		return
+	}
+	q.standby = standby
+	if standby {
+		q.logger.Info("standing by", "leader", q.leader.Holder())
+	} else {
+		q.logger.Info("became the leader")
+	}
+	q.notify()
+}
+
+// Standby reports whether the Queue is standing by for another instance.
+func (q *Queue) Standby() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.standby
+}
+
+// standingBy reports whether the Queue must hold off sending for now, and if
+// so, for how long it should wait before checking again. A Queue that is
+// closed delivers what it holds unless a Store keeps it for the leader.
+// q.mu must be held.
+func (q *Queue) standingBy() (time.Duration, bool) {
+	switch {
+	case q.leader == nil || (q.closed && q.store == nil):
+		return 0, false
+	case q.standby:
+		return 0, true
+	case !q.leader.Held():
+		return q.leader.Lease() / 3, true
+	}
+	return 0, false
+}
+
+// adopt adds Items from the Store to the end of the Queue. q.mu must be held.
+func (q *Queue) adopt(items []*Item) {
+	for _, it := range items {
+		q.restore(it.Delivery)
+		q.seq++
+		it.Seq = q.seq
+		q.pending = append(q.pending, it)
+		q.logger.Info("took over queued notification", "id", it.Delivery.ID, "message_id", it.Delivery.MessageID, "to", it.Delivery.Rcpt, "key", it.Key)
+	}
+	if len(items) > 0 {
+		q.notify()
+	}
+}
+
+// maintain renews the leader lock and the Store's lease, taking over the Items
+// of other instances, until stop is closed, then releases them both.
+func (q *Queue) maintain(stop chan struct{}) {
+	lease := DefaultLease
+	if q.store != nil {
+		lease = q.store.Lease()
+	}
+	if q.leader != nil {
+		lease = min(lease, q.leader.Lease())
+	}
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if q.store != nil {
+				if err := q.store.Release(); err != nil {
+					q.logger.Error("could not release the queue store lease", "err", err)
+				}
+			}
+			if q.leader != nil {
+				if err := q.leader.Release(); err != nil {
+					q.logger.Error("could not release the leader lock", "err", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+		q.renew()
+	}
+}
+
+// renew renews the leader lock, and unless the Queue is standing by, the
+// Store's lease, adding any Items it takes over.
+func (q *Queue) renew() {
+	standby := false
+	if q.leader != nil {
+		leader, err := q.leader.Renew()
+		if err != nil {
+			q.logger.Error("could not renew the leader lock", "err", err)
+		}
+		standby = !leader
+		q.mu.Lock()
+		q.setStandby(standby)
+		q.mu.Unlock()
+	}
+	if q.store == nil || standby {
+		return
+	}
+	items, err := q.store.Renew()
+	if err != nil {
+		q.logger.Error("could not renew the queue store lease", "err", err)
+	}
+	q.mu.Lock()
+	q.adopt(items)
+	q.mu.Unlock()
+}
+
+// save records an Item in the Store, if there is one. q.mu must be held.
+func (q *Queue) save(it *Item) {
+	if q.store == nil {
+		return
+	}
+	if err := q.store.Save(it); err != nil {
+		q.logger.Error("could not save to the queue store", "id", it.Delivery.ID, "to", it.Delivery.Rcpt, "err", err)
+	}
+}
+
+// remove forgets an Item in the Store, if there is one. q.mu must be held.
+func (q *Queue) remove(it *Item) {
+	if q.store == nil {
+		return
+	}
+	if err := q.store.Remove(it); err != nil {
+		q.logger.Error("could not remove from the queue store", "id", it.Delivery.ID, "to", it.Delivery.Rcpt, "err", err)
+	}
+}
+
+// claim returns the Items of a batch that this instance may send, dropping
+// those another instance has taken over and putting off those whose ownership
+// cannot be checked. q.mu must be held.
+func (q *Queue) claim(batch []*Item) []*Item {
+	if q.store == nil {
+		return batch
+	}
+	var claimed []*Item
+	for _, it := range batch {
+		d := it.Delivery
+		ok, err := q.store.Claim(it)
+		switch {
+		case err != nil:
+			q.logger.Warn("could not claim queued notification, retrying", "id", d.ID, "to", d.Rcpt, "err", err, "retry_in", RetryInterval)
+			it.NextAttempt = time.Now().Add(RetryInterval)
+			it.LastError = err.Error()
+		case !ok:
+			q.logger.Info("queued notification was taken over by another instance", "id", d.ID, "to", d.Rcpt, "key", it.Key)
+			if i := find(q.pending, it.Seq); i >= 0 {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			}
+			q.notify()
+		default:
+			claimed = append(claimed, it)
+		}
+	}
+	return claimed
+}
+
+// notify wakes everything waiting for the state to change. q.mu must be held.
+func (q *Queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// wait releases q.mu until the state changes or, if d is positive, d passes.
+func (q *Queue) wait(d time.Duration) {
+	changed := q.changed
+	q.mu.Unlock()
+	if d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	} else {
+		<-changed
+	}
+	q.mu.Lock()
+}
+
+// Push adds a Delivery to the Queue, waiting while it is full. It fails with
+// ErrClosed once the Queue is closed.
+func (q *Queue) Push(d *notify.Delivery) error {
+	return q.PushFunc(d, nil)
+}
+
+// PushFunc is Push, but done, if it is not nil, is called once the Queue is
+// finished with the Delivery: once it has been sent, has failed for good, or
+// has been deleted. It is not called if the Queue is closed first.
+func (q *Queue) PushFunc(d *notify.Delivery, done func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) >= q.size && !q.closed {
+		q.wait(0)
+	}
+	if q.closed {
+		return ErrClosed
+	}
+	q.seq++
+	it := &Item{Seq: q.seq, Delivery: d, Queued: time.Now(), done: done}
+	q.save(it)
+	q.pending = append(q.pending, it)
+	q.notify()
+	return nil
+}
+
+// Close stops the Queue from taking new Deliveries, and ends any pause. Run
+// returns once it has sent those that are already queued.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notify()
+}
+
+// Pause stops the Queue from sending until Resume is called.
+func (q *Queue) Pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+	q.notify()
+}
+
+// Resume undoes Pause.
+func (q *Queue) Resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	q.notify()
+}
+
+// Paused reports whether the Queue is paused.
+func (q *Queue) Paused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused
+}
+
+// Len returns the number of Deliveries waiting to be sent, not counting those
+// being sent.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, it := range q.pending {
+		if !it.sending {
+			n++
+		}
+	}
+	return n
+}
+
+// Pending returns copies of the Items waiting to be sent, in order.
+func (q *Queue) Pending() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return copyItems(q.pending)
+}
+
+// Dead returns copies of the most recent Items that failed, oldest first.
+func (q *Queue) Dead() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return copyItems(q.dead)
+}
+
+// Get returns a copy of an Item, whether it is waiting or dead.
+func (q *Queue) Get(seq uint64) (Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, items := range [][]*Item{q.pending, q.dead} {
+		if i := find(items, seq); i >= 0 {
+			return *items[i], nil
+		}
+	}
+	return Item{}, ErrNotFound
+}
+
+func copyItems(items []*Item) []Item {
+	c := make([]Item, len(items))
+	for i, it := range items {
+		c[i] = *it
+	}
+	return c
+}
+
+// Retry resends an Item: a dead letter goes back to the end of the Queue, and a
+// deferred Item is resent without waiting for its next attempt.
+func (q *Queue) Retry(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := find(q.dead, seq); i >= 0 {
+		it := q.dead[i]
+		q.dead = append(q.dead[:i], q.dead[i+1:]...)
+		it.NextAttempt, it.started, it.Key = time.Time{}, time.Time{}, ""
+		q.save(it)
+		q.pending = append(q.pending, it)
+		q.notify()
+		return nil
+	}
+	if i := find(q.pending, seq); i >= 0 {
+		q.pending[i].NextAttempt = time.Time{}
+		q.save(q.pending[i])
+		q.notify()
+		return nil
+	}
+	return ErrNotFound
+}
+
+// Delete removes an Item, whether it is waiting or dead. An Item cannot be
+// deleted while it is being sent.
+func (q *Queue) Delete(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := find(q.dead, seq); i >= 0 {
+		q.dead = append(q.dead[:i], q.dead[i+1:]...)
+		return nil
+	}
+	if i := find(q.pending, seq); i >= 0 {
+		if q.pending[i].sending {
+			return ErrSending
+		}
+		it := q.pending[i]
+		q.remove(it)
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.notify()
+		q.finished(it)
+		return nil
+	}
+	return ErrNotFound
+}
+
+func find(items []*Item, seq uint64) int {
+	for i, it := range items {
+		if it.Seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+// Busy returns how long the Queue has been trying to send the current
+// Delivery, including any retries, or zero if it is idle.
+func (q *Queue) Busy() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 || q.pending[0].started.IsZero() {
+		return 0
+	}
+	return time.Since(q.pending[0].started)
+}
+
+// Run sends queued Deliveries until the Queue is closed and empty.
+func (q *Queue) Run() {
+	q.mu.Lock()
+	maintained := q.store != nil || q.leader != nil
+	q.mu.Unlock()
+	if maintained {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			q.maintain(stop)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if len(q.pending) == 0 && q.closed {
+			return
+		} else if len(q.pending) == 0 || (q.paused && !q.closed) {
+			q.wait(0)
+			continue
+		} else if wait, ok := q.standingBy(); ok {
+			q.wait(wait)
+			continue
+		}
+		head := q.pending[0]
+		if wait := time.Until(head.NextAttempt); wait > 0 {
+			q.wait(wait)
+			continue
+		}
+		// Send the head along with any other recipients of the same message
+		// that follow it and are due, up to q.parallel requests at once.
+		batch := []*Item{head}
+		for _, it := range q.pending[1:] {
+			if len(batch) >= q.parallel*notify.MaxBatchUsers || it.Delivery.ID == "" || it.Delivery.ID != head.Delivery.ID {
+				break
+			}
+			if time.Until(it.NextAttempt) <= 0 {
+				batch = append(batch, it)
+			}
+		}
+		groups := batchItems(batch)
+		batch = nil
+		for _, g := range groups[:min(len(groups), q.parallel)] {
+			batch = append(batch, g...)
+		}
+		if batch = q.claim(batch); len(batch) == 0 {
+			continue
+		}
+		groups = batchItems(batch)
+		for _, it := range batch {
+			if it.started.IsZero() {
+				it.started = time.Now()
+			}
+			it.sending = true
+			it.Attempts++
+		}
+		results := make([][]error, len(groups))
+		retries := make([][]bool, len(groups))
+		q.unlocked(func() {
+			var wg sync.WaitGroup
+			for i, g := range groups {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ds := make([]*notify.Delivery, len(g))
+					for j, it := range g {
+						ds[j] = it.Delivery
+						q.logger.Debug("sending", "id", ds[j].ID, "message_id", ds[j].MessageID, "to", ds[j].Rcpt, "batch", len(g))
+					}
+					retries[i], results[i] = notify.SendBatch(ds)
+				}()
+			}
+			wg.Wait()
+		})
+		for i, g := range groups {
+			for j, it := range g {
+				q.finish(it, retries[i][j], results[i][j])
+			}
+		}
+	}
+}
+
+// batchItems groups Items whose Deliveries can be sent with one request, as
+// notify.Batch does.
+func batchItems(items []*Item) [][]*Item {
+	ds := make([]*notify.Delivery, len(items))
+	byDelivery := make(map[*notify.Delivery]*Item, len(items))
+	for i, it := range items {
+		ds[i] = it.Delivery
+		byDelivery[it.Delivery] = it
+	}
+	var groups [][]*Item
+	for _, dg := range notify.Batch(ds) {
+		g := make([]*Item, len(dg))
+		for i, d := range dg {
+			g[i] = byDelivery[d]
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// finish handles the outcome of sending an Item. q.mu must be held.
+func (q *Queue) finish(it *Item, retry bool, err error) {
+	d := it.Delivery
+	it.sending = false
+	if err != nil && retry {
+		q.logger.Warn("delivery failed, retrying", "id", d.ID, "message_id", d.MessageID, "to", d.Rcpt, "err", err, "retry_in", RetryInterval)
+		it.NextAttempt = time.Now().Add(RetryInterval)
+		it.LastError = err.Error()
+		q.save(it)
+		if it.Attempts == 1 {
+			q.unlocked(func() { q.report(d, Deferred, err) })
+		}
+		return
+	}
+	if i := find(q.pending, it.Seq); i >= 0 {
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	}
+	q.remove(it)
+	q.finished(it)
+	q.notify()
+	if err != nil {
+		q.logger.Error("delivery failed, not recoverable", "id", d.ID, "message_id", d.MessageID, "to", d.Rcpt, "err", err)
+		it.LastError = err.Error()
+		it.NextAttempt = time.Time{}
+		q.dead = append(q.dead, it)
+		if len(q.dead) > MaxDead {
+			q.dead = q.dead[len(q.dead)-MaxDead:]
+		}
+		q.unlocked(func() { q.report(d, Failed, err) })
+	} else {
+		args := []any{"id", d.ID, "message_id", d.MessageID, "to", d.Rcpt}
+		if d.Receipt != "" {
+			args = append(args, "receipt", d.Receipt)
+		}
+		q.logger.Info("delivered", args...)
+		q.unlocked(func() { q.report(d, Delivered, nil) })
+	}
+}
+
+// finished calls an Item's done function, if it has one. q.mu must be held.
+func (q *Queue) finished(it *Item) {
+	if it.done != nil {
+		done := it.done
+		it.done = nil
+		q.unlocked(done)
+	}
+}
+
+// unlocked calls f without holding q.mu, which must be held.
+func (q *Queue) unlocked(f func()) {
+	q.mu.Unlock()
+	defer q.mu.Lock()
+	f()
+}
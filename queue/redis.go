@@ -0,0 +1,246 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrefix begins the name of every key a RedisStore uses.
+const redisPrefix = "smtp-translator:"
+
+// redisTimeout bounds each command sent to Redis.
+const redisTimeout = 10 * time.Second
+
+// A RedisStore is a Store in Redis. Each process keeps its Items in a hash
+// named after its instance and process ID, and its lease in a key that Redis
+// expires when the lease does. A set lists the processes, so that others can
+// find those whose leases have expired and take over their Items by moving
+// them one at a time into their own hashes; deleting an Item from the old
+// hash succeeds for only one of them.
+type RedisStore struct {
+	client *redis.Client
+	name   string
+	lease  time.Duration
+
+	state     sync.Mutex
+	expires   time.Time
+	recovered bool
+	seq       uint64
+}
+
+// OpenRedisStore connects to the Redis server at a redis:// or rediss:// URL,
+// such as redis://:password@localhost:6379/0, and prepares a RedisStore in it
+// for this process of an instance. If lease is zero, DefaultLease is used.
+func OpenRedisStore(rawURL, instance string, lease time.Duration) (*RedisStore, error) {
+	if err := CheckInstance(instance); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("queue: %s: not a redis:// or rediss:// URL", u.Redacted())
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("queue: %s: %v", u.Redacted(), err)
+	}
+	opts.DialTimeout = redisTimeout
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	s := &RedisStore{
+		client: redis.NewClient(opts),
+		name:   fmt.Sprintf("%s.%d", instance, os.Getpid()),
+		lease:  lease}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.client.Close()
+		return nil, fmt.Errorf("queue: %s: %v", u.Redacted(), err)
+	}
+	return s, nil
+}
+
+// Lease implements Store.
+func (s *RedisStore) Lease() time.Duration {
+	return s.lease
+}
+
+func (s *RedisStore) itemsKey(name string) string {
+	return redisPrefix + "items:" + name
+}
+
+func (s *RedisStore) leaseKey(name string) string {
+	return redisPrefix + "lease:" + name
+}
+
+// redisInstances is the set of processes that keep Items in a RedisStore.
+const redisInstances = redisPrefix + "instances"
+
+// Save implements Store.
+func (s *RedisStore) Save(it *Item) error {
+	ctx := context.Background()
+	if it.Key == "" {
+		s.state.Lock()
+		s.seq++
+		it.Key = newKey(it, s.name, s.seq)
+		s.state.Unlock()
+	} else if ok, err := s.client.HExists(ctx, s.itemsKey(s.name), it.Key).Result(); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, s.itemsKey(s.name), it.Key, b).Err()
+}
+
+// Remove implements Store.
+func (s *RedisStore) Remove(it *Item) error {
+	if it.Key == "" {
+		return nil
+	}
+	return s.client.HDel(context.Background(), s.itemsKey(s.name), it.Key).Err()
+}
+
+// Claim implements Store. A third of the lease is kept in hand, so that an
+// Item is not sent just as another instance takes it over.
+func (s *RedisStore) Claim(it *Item) (bool, error) {
+	s.state.Lock()
+	expires := s.expires
+	s.state.Unlock()
+	if time.Until(expires) < s.lease/3 {
+		return false, errLeaseExpired
+	}
+	if it.Key == "" {
+		return true, nil
+	}
+	return s.client.HExists(context.Background(), s.itemsKey(s.name), it.Key).Result()
+}
+
+// Renew implements Store.
+func (s *RedisStore) Renew() ([]*Item, error) {
+	ctx := context.Background()
+	expires := time.Now().Add(s.lease)
+	if err := s.client.Set(ctx, s.leaseKey(s.name), expires.Format(time.RFC3339Nano), s.lease).Err(); err != nil {
+		return nil, err
+	}
+	if err := s.client.SAdd(ctx, redisInstances, s.name).Err(); err != nil {
+		return nil, err
+	}
+	s.state.Lock()
+	s.expires = expires
+	recovered := s.recovered
+	s.recovered = true
+	s.state.Unlock()
+
+	var items []*Item
+	var errs []error
+	if !recovered {
+		own, err := s.load(ctx, s.name, false)
+		items = append(items, own...)
+		errs = append(errs, err)
+	}
+	names, err := s.client.SMembers(ctx, redisInstances).Result()
+	if err != nil {
+		return items, err
+	}
+	for _, name := range names {
+		if name == s.name {
+			continue
+		}
+		if n, err := s.client.Exists(ctx, s.leaseKey(name)).Result(); err != nil {
+			errs = append(errs, err)
+		} else if n == 0 {
+			adopted, err := s.load(ctx, name, true)
+			items = append(items, adopted...)
+			errs = append(errs, err)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items, errors.Join(errs...)
+}
+
+// load reads the Items of a process, first moving them into this process's
+// hash if take is set, and then forgetting the other process if it is left
+// with none. Each Item is copied before it is deleted from the other hash, and
+// the copy is deleted again if another process deleted it first.
+func (s *RedisStore) load(ctx context.Context, name string, take bool) ([]*Item, error) {
+	from := s.itemsKey(name)
+	fields, err := s.client.HGetAll(ctx, from).Result()
+	if err != nil {
+		return nil, err
+	}
+	var items []*Item
+	var errs []error
+	for key, b := range fields {
+		if take {
+			if err := s.client.HSet(ctx, s.itemsKey(s.name), key, b).Err(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if n, err := s.client.HDel(ctx, from, key).Result(); err != nil || n == 0 {
+				s.client.HDel(ctx, s.itemsKey(s.name), key)
+				errs = append(errs, err)
+				continue
+			}
+		}
+		it, err := decodeItem(key, []byte(b))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %v", from, key, err))
+			continue
+		}
+		items = append(items, it)
+	}
+	if take && len(errs) == 0 {
+		if n, err := s.client.HLen(ctx, from).Result(); err == nil && n == 0 {
+			s.client.SRem(ctx, redisInstances, name)
+		}
+	}
+	return items, errors.Join(errs...)
+}
+
+// Release implements Store.
+func (s *RedisStore) Release() error {
+	s.state.Lock()
+	s.expires = time.Time{}
+	s.state.Unlock()
+	return s.client.Del(context.Background(), s.leaseKey(s.name)).Err()
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Store keeps the pending Items of a Queue somewhere that outlives the
+// process and that other instances can share, so that if one instance dies,
+// another delivers what it left behind. Each instance holds a lease on its own
+// Items and must renew it; once an instance's lease expires, the first to
+// notice takes its Items over.
+type Store interface {
+	// Save records a new Item, giving it a Key, or records changes to one
+	// that this instance still owns.
+	Save(it *Item) error
+	// Remove forgets an Item.
+	Remove(it *Item) error
+	// Claim reports whether this instance still owns an Item and holds its
+	// lease, so that it may send it. It returns an error if that cannot be
+	// known.
+	Claim(it *Item) (bool, error)
+	// Renew extends this instance's lease and returns, oldest first, the
+	// Items it has taken over: those of instances whose leases have expired
+	// and, the first time it is called, its own from before a restart.
+	Renew() ([]*Item, error)
+	// Release gives up the lease so that others may take over whatever is left
+	// at once.
+	Release() error
+	// Lease returns how long a lease lasts once renewed.
+	Lease() time.Duration
+}
+
+// DefaultLease is how long a DirStore lease lasts if no other duration is given.
+const DefaultLease = 30 * time.Second
+
+// leaseFile is the name of the file that holds an instance's lease.
+const leaseFile = ".lease"
+
+// A DirStore is a Store in a directory, which instances on different hosts can
+// share over a network filesystem. Each process keeps its Items as JSON files
+// in a subdirectory named after its instance and process ID, along with a file
+// that says when its lease expires, so that a process that replaces another
+// during an upgrade takes over what is left like any other. Items are taken
+// over by renaming them into another subdirectory, which only one process can
+// do. The hosts' clocks must agree.
+type DirStore struct {
+	dir   string
+	name  string
+	lease time.Duration
+
+	mu        sync.Mutex
+	expires   time.Time
+	recovered bool
+	seq       uint64
+}
+
+// OpenDirStore prepares a DirStore in dir for this process of an instance,
+// whose name identifies it among those sharing dir. If lease is zero,
+// DefaultLease is used.
+func OpenDirStore(dir, instance string, lease time.Duration) (*DirStore, error) {
+	if err := CheckInstance(instance); err != nil {
+		return nil, err
+	}
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	s := &DirStore{dir: dir, name: fmt.Sprintf("%s.%d", instance, os.Getpid()), lease: lease}
+	if err := os.MkdirAll(filepath.Join(dir, s.name), 0o700); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CheckInstance reports whether an instance name can be used with a DirStore.
+func CheckInstance(instance string) error {
+	if instance == "" || instance != filepath.Base(instance) || strings.HasPrefix(instance, ".") {
+		return fmt.Errorf("queue: invalid instance name %q", instance)
+	}
+	return nil
+}
+
+// Lease implements Store.
+func (s *DirStore) Lease() time.Duration {
+	return s.lease
+}
+
+// path returns where an Item of a process is kept.
+func (s *DirStore) path(name, key string) string {
+	return filepath.Join(s.dir, name, key+".json")
+}
+
+// Save implements Store.
+func (s *DirStore) Save(it *Item) error {
+	path := s.path(s.name, it.Key)
+	if it.Key == "" {
+		s.mu.Lock()
+		s.seq++
+		it.Key = newKey(it, s.name, s.seq)
+		s.mu.Unlock()
+		path = s.path(s.name, it.Key)
+	} else if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+// newKey makes a Key for the seqth Item saved by a process. Keys sort in the
+// order the Items were queued.
+func newKey(it *Item, name string, seq uint64) string {
+	return fmt.Sprintf("%020d.%s.%d", it.Queued.UnixNano(), name, seq)
+}
+
+// errNotItem is returned for stored Items that cannot be read.
+var errNotItem = errors.New("not a queued notification")
+
+// decodeItem reads an Item saved with its Key.
+func decodeItem(key string, b []byte) (*Item, error) {
+	it := new(Item)
+	if err := json.Unmarshal(b, it); err != nil || it.Delivery == nil {
+		return nil, errNotItem
+	}
+	it.Key = key
+	return it, nil
+}
+
+// writeFile replaces the file at path with data in one step, so that readers
+// never see it half written.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Remove implements Store.
+func (s *DirStore) Remove(it *Item) error {
+	if it.Key == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(s.name, it.Key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// errLeaseExpired is returned by Claim while the lease cannot be renewed.
+var errLeaseExpired = errors.New("queue: lease expired")
+
+// Claim implements Store. A third of the lease is kept in hand, so that an
+// Item is not sent just as another instance takes it over.
+func (s *DirStore) Claim(it *Item) (bool, error) {
+	s.mu.Lock()
+	expires := s.expires
+	s.mu.Unlock()
+	if time.Until(expires) < s.lease/3 {
+		return false, errLeaseExpired
+	}
+	if it.Key == "" {
+		return true, nil
+	}
+	if _, err := os.Stat(s.path(s.name, it.Key)); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Renew implements Store.
+func (s *DirStore) Renew() ([]*Item, error) {
+	// Another process may have removed the subdirectory after the lease
+	// expired.
+	own := filepath.Join(s.dir, s.name)
+	if err := os.MkdirAll(own, 0o700); err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(s.lease)
+	if err := writeFile(filepath.Join(own, leaseFile), []byte(expires.Format(time.RFC3339Nano))); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.expires = expires
+	recovered := s.recovered
+	s.recovered = true
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var items []*Item
+	var errs []error
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if name == s.name {
+			if !recovered {
+				adopted, err := s.load(name, false)
+				items = append(items, adopted...)
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if s.expired(name) {
+			adopted, err := s.load(name, true)
+			items = append(items, adopted...)
+			errs = append(errs, err)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items, errors.Join(errs...)
+}
+
+// expired reports whether the lease of a process has run out. A process makes
+// its subdirectory before it first writes its lease, so one without a lease may
+// be just starting; it is taken for gone only once its subdirectory has gone
+// unchanged for as long as a lease.
+func (s *DirStore) expired(name string) bool {
+	dir := filepath.Join(s.dir, name)
+	b, err := os.ReadFile(filepath.Join(dir, leaseFile))
+	if errors.Is(err, os.ErrNotExist) {
+		fi, err := os.Stat(dir)
+		return err == nil && time.Since(fi.ModTime()) > s.lease
+	} else if err != nil {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	return err == nil && time.Now().After(expires)
+}
+
+// load reads the Items of a process, first moving them into this process's
+// subdirectory if take is set, and then removing the other subdirectory if it
+// is left empty and its lease is still expired. Items that another process
+// moves first are skipped.
+func (s *DirStore) load(name string, take bool) ([]*Item, error) {
+	dir := filepath.Join(s.dir, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var items []*Item
+	var errs []error
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || strings.HasPrefix(key, ".") {
+			continue
+		}
+		path := s.path(s.name, key)
+		if take {
+			if err := os.Rename(s.path(name, key), path); errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		it, err := decodeItem(key, b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		items = append(items, it)
+	}
+	// The lease may have been renewed in the meantime, by a process that was
+	// only slow.
+	if take && len(errs) == 0 && s.expired(name) {
+		os.Remove(filepath.Join(dir, leaseFile))
+		os.Remove(dir)
+	}
+	return items, errors.Join(errs...)
+}
+
+// Release implements Store.
+func (s *DirStore) Release() error {
+	s.mu.Lock()
+	s.expires = time.Time{}
+	s.mu.Unlock()
+	return writeFile(filepath.Join(s.dir, s.name, leaseFile), []byte(time.Time{}.Format(time.RFC3339Nano)))
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+func testItem() *Item {
+	return &Item{
+		Delivery: &notify.Delivery{Envelope: &parse.Envelope{Subject: "test"}},
+		Queued:   time.Now()}
+}
+
+func openTestStore(t *testing.T, dir, instance string) *DirStore {
+	t.Helper()
+	s, err := OpenDirStore(dir, instance, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDirStoreTakeover(t *testing.T) {
+	dir := t.TempDir()
+	a, b := openTestStore(t, dir, "relay-a"), openTestStore(t, dir, "relay-b")
+	if _, err := a.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	it := testItem()
+	if err := a.Save(it); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := b.Renew(); len(items) != 0 || err != nil {
+		t.Fatalf("b.Renew() = %v, %v, took over a live lease", items, err)
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	items, err := b.Renew()
+	if err != nil || len(items) != 1 || items[0].Key != it.Key {
+		t.Fatalf("b.Renew() = %v, %v, want the released Item", items, err)
+	}
+	if ok, _ := a.Claim(it); ok {
+		t.Error("a still claims an Item that was taken over")
+	}
+	if _, err := os.Stat(filepath.Join(dir, a.name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a's subdirectory was left behind: %v", err)
+	}
+}
+
+func TestDirStoreMissingLease(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestStore(t, dir, "relay-b")
+	// A process that has made its subdirectory and saved an Item, but not yet
+	// written its lease.
+	starting := openTestStore(t, dir, "relay-a")
+	it := testItem()
+	if err := starting.Save(it); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := b.Renew(); len(items) != 0 || err != nil {
+		t.Fatalf("b.Renew() = %v, %v, took over a process that is starting", items, err)
+	}
+
+	// Once the subdirectory has gone unchanged for a lease, the process is
+	// gone.
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, starting.name), old, old); err != nil {
+		t.Fatal(err)
+	}
+	items, err := b.Renew()
+	if err != nil || len(items) != 1 || items[0].Key != it.Key {
+		t.Fatalf("b.Renew() = %v, %v, want the abandoned Item", items, err)
+	}
+}
+
+func TestDirStoreRenewedDuringTakeover(t *testing.T) {
+	dir := t.TempDir()
+	a, b := openTestStore(t, dir, "relay-a"), openTestStore(t, dir, "relay-b")
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	// a renews its lease after b found it expired, but before b cleans up.
+	if _, err := a.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.load(a.name, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, a.name, leaseFile)); err != nil {
+		t.Errorf("a's renewed lease was removed: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	netsmtp "net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+)
+
+// sendTimeout bounds a submission by the send subcommand.
+const sendTimeout = 30 * time.Second
+
+// A sendMessage is what the send subcommand submits.
+type sendMessage struct {
+	to                []string
+	from, title, body string
+	priority          *int
+	sound, device     string
+	user, password    string
+}
+
+// sendCommand submits a notification to a running instance, over SMTP or its
+// HTTP API, for use from the command line and scripts. Like healthcheck, it
+// does not load the configuration, although -addr may be set with
+// $SMTP_TRANSLATOR_ADDR.
+func sendCommand(args []string) int {
+	var m sendMessage
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fs.Func("to", "send to this `address`, or a bare user token (may be repeated)", func(s string) error {
+		m.to = append(m.to, s)
+		return nil
+	})
+	fs.StringVar(&m.from, "from", "", "send from this `address`")
+	fs.StringVar(&m.title, "title", "", "the notification's title")
+	fs.StringVar(&m.body, "body", "", "the notification's text (read from standard input if not given)")
+	fs.Func("priority", "the notification's priority, from -2 to 2", func(s string) error {
+		n, err := strconv.Atoi(s)
+		m.priority = &n
+		return err
+	})
+	fs.StringVar(&m.sound, "sound", "", "the notification's sound")
+	fs.StringVar(&m.device, "device", "", "send to this device only")
+	addr := fs.String("addr", "localhost:25", "submit over SMTP to the server at this address:port")
+	useTLS := fs.Bool("tls", false, "connect with TLS, for servers that don't use STARTTLS")
+	insecure := fs.Bool("insecure", false, "don't verify the server's TLS certificate")
+	apiURL := fs.String("url", "", "submit to the HTTP API at this `URL`, such as http://localhost:8080, instead of SMTP")
+	fs.StringVar(&m.user, "user", "", "log in as this user, with the password in $SMTP_TRANSLATOR_PASSWORD")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator send [flags] -to recipient")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if env, ok := os.LookupEnv("SMTP_TRANSLATOR_ADDR"); ok && !given["addr"] {
+		*addr = env
+	}
+	if len(m.to) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	for i, to := range m.to {
+		if !strings.Contains(to, "@") {
+			m.to[i] = to + "@pushover.net"
+		}
+	}
+	if !given["body"] {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		m.body = string(b)
+	}
+	m.password = os.Getenv("SMTP_TRANSLATOR_PASSWORD")
+
+	var id string
+	var err error
+	if *apiURL != "" {
+		id, err = sendAPI(*apiURL, &m)
+	} else {
+		err = sendSMTP(*addr, *useTLS, *insecure, &m)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if id != "" {
+		fmt.Println("queued", id)
+	} else {
+		fmt.Println("queued")
+	}
+	return 0
+}
+
+// sendAPI posts a message to the HTTP API and returns its ID.
+func sendAPI(base string, m *sendMessage) (string, error) {
+	req := smtp.APIMessage{
+		To:       m.to,
+		From:     m.from,
+		Title:    m.title,
+		Body:     m.body,
+		Priority: m.priority,
+		Device:   m.device,
+		Sound:    m.sound}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	r, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+"/api/v1/messages", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if m.user != "" {
+		r.SetBasicAuth(m.user, m.password)
+	}
+	resp, err := (&http.Client{Timeout: sendTimeout}).Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("%s: %v", resp.Status, err)
+	} else if resp.StatusCode != http.StatusAccepted {
+		return "", errors.New(result.Error)
+	}
+	return result.ID, nil
+}
+
+// sendSMTP submits a message over SMTP. The flags that the HTTP API takes as
+// fields are written into each recipient address instead, so they only apply
+// to Pushover addresses.
+func sendSMTP(addr string, useTLS, insecure bool, m *sendMessage) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), sendTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: insecure}
+	if useTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok && !useTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.user != "" {
+		if err := client.Auth(netsmtp.PlainAuth("", m.user, m.password, host)); err != nil {
+			return err
+		}
+	}
+
+	from := m.from
+	if from == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		from = "smtp-translator@" + hostname
+	}
+	var flags string
+	if m.device != "" {
+		flags += ">" + m.device
+	}
+	if m.priority != nil {
+		flags += "#" + strconv.Itoa(*m.priority)
+	}
+	if m.sound != "" {
+		flags += "!" + m.sound
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	rcpts := make([]string, len(m.to))
+	for i, to := range m.to {
+		at := strings.LastIndex(to, "@")
+		rcpts[i] = to[:at] + flags + to[at:]
+		if err := client.Rcpt(rcpts[i]); err != nil {
+			return fmt.Errorf("%s: %v", rcpts[i], err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\n", from)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(rcpts, ", "))
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.title))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	fmt.Fprint(w, strings.ReplaceAll(strings.ReplaceAll(m.body, "\r\n", "\n"), "\n", "\r\n"))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
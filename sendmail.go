@@ -0,0 +1,210 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+)
+
+// Exit statuses from sysexits.h, which programs that call sendmail expect.
+const (
+	exUsage    = 64
+	exDataErr  = 65
+	exNoUser   = 67
+	exTempFail = 75
+	exConfig   = 78
+)
+
+// sendmailConfig is read in sendmail mode if $SMTP_TRANSLATOR_CONFIG does not
+// name another file.
+const sendmailConfig = "/etc/smtp-translator/smtp-translator.yaml"
+
+// sendmailTimeout is how long sendmail mode keeps trying to deliver before it
+// gives up and reports a temporary failure.
+const sendmailTimeout = time.Minute
+
+// sendmailValueOpts are the sendmail options that take a value, which may be
+// attached (-fsender) or the next argument (-f sender).
+const sendmailValueOpts = "BFLNORVXfhpr"
+
+// sendmailCommand reads a message from standard input and delivers it the way
+// the server would, taking the command line of sendmail(8), so that cron, PHP's
+// mail(), and other programs that expect a local sendmail can send
+// notifications without an SMTP hop. It runs when the binary is invoked as
+// sendmail, or as the sendmail subcommand.
+func sendmailCommand(args []string) int {
+	var (
+		from, name       string
+		rcpts            []string
+		readRcpts, noDot bool
+	)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rcpts = append(rcpts, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			rcpts = append(rcpts, arg)
+			continue
+		}
+		opt, value := arg[1], arg[2:]
+		if strings.IndexByte(sendmailValueOpts, opt) >= 0 && value == "" {
+			if i++; i == len(args) {
+				fmt.Fprintf(os.Stderr, "error: option -%c requires a value\n", opt)
+				return exUsage
+			}
+			value = args[i]
+		}
+		switch {
+		case opt == 'f' || opt == 'r':
+			from = value
+		case opt == 'F':
+			name = value
+		case arg == "-t":
+			readRcpts = true
+		case arg == "-i" || arg == "-oi":
+			noDot = true
+		case arg == "-bm", arg == "-v", opt == 'o', strings.IndexByte(sendmailValueOpts, opt) >= 0:
+			// Delivery modes, DSN options, and the like have no
+			// meaning here.
+		default:
+			fmt.Fprintf(os.Stderr, "error: unsupported option %s\n", arg)
+			return exUsage
+		}
+	}
+
+	data, err := readSendmailMessage(os.Stdin, noDot)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exDataErr
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exDataErr
+	}
+	if readRcpts {
+		var more []string
+		if more, data, err = smtp.HeaderRecipients(data); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return exDataErr
+		}
+		rcpts = append(rcpts, more...)
+	}
+	if len(rcpts) == 0 {
+		fmt.Fprintln(os.Stderr, "error: no recipients")
+		return exUsage
+	}
+
+	args = nil
+	if path, ok := os.LookupEnv("SMTP_TRANSLATOR_CONFIG"); ok {
+		args = []string{"-config", path}
+	} else if _, err := os.Stat(sendmailConfig); err == nil {
+		args = []string{"-config", sendmailConfig}
+	}
+	c, err := smtp.LoadConfig(flag.NewFlagSet("sendmail", flag.ContinueOnError), args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exConfig
+	}
+	if from == "" {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			from = addr.Address
+		} else {
+			from = localUser() + "@" + c.Hostname
+		}
+	}
+	if msg.Header.Get("From") == "" {
+		addr := mail.Address{Name: name, Address: from}
+		data = append([]byte("From: "+addr.String()+"\r\n"), data...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendmailTimeout)
+	defer cancel()
+	// Anything written to standard error could be mailed back by cron,
+	// through sendmail again, so say only what went wrong.
+	logger := newLogger(os.Stderr, c.LogFormat, max(c.LogLevel, slog.LevelWarn), false)
+	refused, failed, err := smtp.NewTranslator(c, logger).Sendmail(ctx, from, rcpts, data)
+	for _, rcpt := range refused {
+		fmt.Fprintf(os.Stderr, "error: %s: no such recipient\n", rcpt)
+	}
+	switch {
+	case err == context.DeadlineExceeded:
+		fmt.Fprintln(os.Stderr, "error: gave up after", sendmailTimeout)
+		return exTempFail
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exDataErr
+	case failed > 0:
+		fmt.Fprintln(os.Stderr, "error:", failed, "failed")
+		return exTempFail
+	case len(refused) > 0:
+		return exNoUser
+	}
+	return 0
+}
+
+// readSendmailMessage reads a message from r. Unless noDot is set, a line with
+// only a period ends the message, as it does for sendmail.
+func readSendmailMessage(r io.Reader, noDot bool) ([]byte, error) {
+	if noDot {
+		return io.ReadAll(r)
+	}
+	var buf bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if string(bytes.TrimRight(line, "\r\n")) == "." && len(line) > 1 {
+			return buf.Bytes(), nil
+		}
+		buf.Write(line)
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// localUser returns the name of the user running the process, for a sender
+// address when there is none.
+func localUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return "root"
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadSendmailMessage(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		noDot bool
+		want  string
+	}{
+		{"Subject: hi\n\nbody\n.\nnot read\n", false, "Subject: hi\n\nbody\n"},
+		{"Subject: hi\r\n\r\nbody\r\n.\r\nnot read\r\n", false, "Subject: hi\r\n\r\nbody\r\n"},
+		{"Subject: hi\n\n..\n.x\n", false, "Subject: hi\n\n..\n.x\n"},
+		{"Subject: hi\n\nno end", false, "Subject: hi\n\nno end"},
+		// A period without a newline is the last of the data, not an end.
+		{"Subject: hi\n\nbody\n.", false, "Subject: hi\n\nbody\n."},
+		{"Subject: hi\n\nbody\n.\nread anyway\n", true, "Subject: hi\n\nbody\n.\nread anyway\n"},
+		{"", false, ""},
+	} {
+		got, err := readSendmailMessage(strings.NewReader(tt.in), tt.noDot)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("readSendmailMessage(%q, %v) = %q, %v, want %q", tt.in, tt.noDot, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name SMTP Translator registers with the service control
+// manager and the event log.
+const serviceName = "smtp-translator"
+
+func init() {
+	commands["service"] = serviceCommand
+}
+
+// runService runs SMTP Translator under the service control manager, if that is
+// how it was started, and reports whether it did.
+func runService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return true
+	}
+	defer elog.Close()
+	logger := newLogger(eventLogWriter{elog}, "plain", slog.LevelInfo, false)
+	if err := svc.Run(serviceName, &windowsService{logger: logger}); err != nil {
+		logger.Error("service failed", "err", err)
+	}
+	return true
+}
+
+// An eventLogWriter lets a logger write to the Windows event log.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var err error
+	if strings.Contains(msg, "error") {
+		err = w.elog.Error(1, msg)
+	} else {
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// A windowsService answers requests from the service control manager. A
+// parameter change request rereads the configuration, like SIGHUP elsewhere.
+type windowsService struct {
+	logger *slog.Logger
+}
+
+func (s *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	c, err := smtp.LoadConfig(flag.NewFlagSet(serviceName, flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		s.logger.Error("error starting", "err", err)
+		return true, 1
+	}
+	t := smtp.NewTranslator(c, s.logger)
+	t.ReloadConfig = func() error {
+		c, err := smtp.LoadConfig(flag.NewFlagSet(serviceName, flag.ContinueOnError), os.Args[1:])
+		if err != nil {
+			s.logger.Error("error reloading configuration", "err", err)
+			return err
+		}
+		t.Reload(c)
+		s.logger.Info("reloaded configuration")
+		return nil
+	}
+	go smtp.WatchKeyPairs(t.Config, s.logger)
+	go smtp.WatchConfig(t.Config, t.ReloadConfig, s.logger)
+	if c.SecretRefresh > 0 {
+		go smtp.RefreshSecrets(t.Config, c.SecretRefresh, s.logger)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Run(ctx)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	for {
+		select {
+		case err := <-done:
+			s.logger.Error("error serving", "err", err)
+			return true, 1
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.ParamChange:
+				t.ReloadConfig()
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				stop()
+				if err := <-done; err != nil {
+					s.logger.Error("error stopping", "err", err)
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// serviceCommand installs, uninstalls, starts, and stops the Windows service.
+// Flags given after install are saved as the service's arguments.
+func serviceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: smtp-translator service install [flags] | uninstall | start | stop")
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = controlService(func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	default:
+		err = errors.New("unknown service command: " + args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("service " + serviceName + " is already installed")
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "SMTP Translator",
+		Description: "Converts emails into Pushover notifications.",
+		StartType:   mgr.StartAutomatic}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("service " + serviceName + " is not installed")
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+func controlService(control func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("service " + serviceName + " is not installed")
+	}
+	defer s.Close()
+	return control(s)
+}
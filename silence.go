@@ -0,0 +1,139 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/smtp"
+)
+
+// silenceTimeout bounds a request by the silence subcommand.
+const silenceTimeout = 30 * time.Second
+
+// silenceCommand lists, starts, and ends Silences on a running instance
+// through its admin API.
+func silenceCommand(args []string) int {
+	var s smtp.Silence
+	fs := flag.NewFlagSet("silence", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8080", "the `URL` of the instance's HTTP server")
+	fs.StringVar(&s.From, "from", "", "silence notifications from this address, local part (user@), or domain (@example.com)")
+	fs.StringVar(&s.To, "to", "", "silence notifications to this address, local part, or domain")
+	fs.StringVar(&s.Route, "route", "", "silence notifications along routes of this kind or domain")
+	fs.BoolVar(&s.Hold, "hold", false, "hold notifications until the silence ends instead of dropping them")
+	fs.StringVar(&s.Comment, "comment", "", "say why, for whoever lists the silences")
+	duration := fs.Duration("for", time.Hour, "end the silence after this long")
+	list := fs.Bool("list", false, "list the silences instead of starting one")
+	end := fs.String("end", "", "end the silence with this `ID` early, releasing what it holds")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: smtp-translator silence [flags]")
+		fmt.Fprintln(fs.Output(), "The admin token is read from $SMTP_TRANSLATOR_ADMIN_TOKEN.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	token := os.Getenv("SMTP_TRANSLATOR_ADMIN_TOKEN")
+
+	var err error
+	switch {
+	case *list:
+		err = listSilences(*base, token)
+	case *end != "":
+		var resp *http.Response
+		resp, err = adminRequest(http.MethodDelete, *base, "/admin/silences/"+url.PathEscape(*end), token, nil, silenceTimeout)
+		if err == nil {
+			resp.Body.Close()
+		}
+	default:
+		err = startSilence(*base, token, s, *duration)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// startSilence creates a Silence and prints its ID.
+func startSilence(base, token string, s smtp.Silence, d time.Duration) error {
+	b, err := json.Marshal(struct {
+		smtp.Silence
+		Duration string `json:"duration"`
+	}{s, d.String()})
+	if err != nil {
+		return err
+	}
+	resp, err := adminRequest(http.MethodPost, base, "/admin/silences", token, bytes.NewReader(b), silenceTimeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return err
+	}
+	fmt.Printf("silenced until %s: %s\n", s.Ends.Local().Format(time.DateTime), s.ID)
+	return nil
+}
+
+// listSilences prints the Silences in a table.
+func listSilences(base, token string) error {
+	resp, err := adminRequest(http.MethodGet, base, "/admin/silences", token, nil, silenceTimeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var list []smtp.Silence
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFROM\tTO\tROUTE\tACTION\tSTARTS\tENDS\tCOMMENT")
+	for _, s := range list {
+		action := "drop"
+		if s.Hold {
+			action = fmt.Sprintf("hold (%d)", s.Held)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, orDash(s.From), orDash(s.To), orDash(s.Route), action,
+			s.Starts.Local().Format(time.DateTime), s.Ends.Local().Format(time.DateTime), s.Comment)
+	}
+	return w.Flush()
+}
+
+// orDash stands in for an empty table cell.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
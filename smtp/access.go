@@ -0,0 +1,91 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"time"
+)
+
+// Results recorded in the access log.
+const (
+	AccessAccepted  = "accepted"
+	AccessSpam      = "spam"
+	AccessMalformed = "malformed"
+)
+
+// An AccessRecord describes one SMTP transaction: a message that a client
+// submitted with DATA.
+type AccessRecord struct {
+	Time   time.Time `json:"time"`
+	Conn   uint64    `json:"conn"`
+	Client string    `json:"client"`
+	Helo   string    `json:"helo"`
+	User   string    `json:"user,omitempty"`
+	TLS    bool      `json:"tls"`
+	From   string    `json:"from"`
+	Rcpts  int       `json:"rcpts"`
+	Size   int       `json:"size"`
+	ID     string    `json:"id"`
+	Result string    `json:"result"`
+}
+
+// An AccessLog appends an AccessRecord for every SMTP transaction to a file as
+// lines of JSON, like a web server's access log. It is safe for concurrent
+// use, and a nil AccessLog discards everything.
+type AccessLog struct {
+	jsonLog
+}
+
+// OpenAccessLog opens an access log for appending, creating it if necessary.
+func OpenAccessLog(path string) (*AccessLog, error) {
+	a := &AccessLog{jsonLog{Path: path}}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Record writes a record, filling in the time if it is not set.
+func (a *AccessLog) Record(r AccessRecord) error {
+	if a == nil {
+		return nil
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	return a.write(r)
+}
+
+// heloOf returns the name a client gave in HELO or EHLO, which smtpd records
+// in the Received header it adds to the top of each message.
+func heloOf(data []byte) string {
+	line, _ := bufio.NewReader(bytes.NewReader(data)).ReadString('\n')
+	line = strings.TrimPrefix(line, "Received: from ")
+	if end := strings.LastIndex(line, " ("); end >= 0 {
+		return line[:end]
+	}
+	return ""
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/queue"
+)
+
+// maxRecent is how many outcomes the admin API remembers.
+const maxRecent = 50
+
+// defaultHistoryLimit is how many history records a search returns unless told
+// otherwise.
+const defaultHistoryLimit = 100
+
+// An adminItem is the JSON form of a queue.Item.
+type adminItem struct {
+	Seq         uint64    `json:"seq"`
+	ID          string    `json:"id"`
+	MessageID   string    `json:"message_id,omitempty"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Route       string    `json:"route"`
+	Subject     string    `json:"subject"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func newAdminItems(items []queue.Item) []adminItem {
+	ais := make([]adminItem, len(items))
+	for i, it := range items {
+		d := it.Delivery
+		ais[i] = adminItem{
+			Seq:         it.Seq,
+			ID:          d.ID,
+			MessageID:   d.MessageID,
+			From:        d.From.Address,
+			To:          d.Rcpt,
+			Route:       d.Route.Kind,
+			Subject:     d.Subject,
+			Queued:      it.Queued,
+			Attempts:    it.Attempts,
+			NextAttempt: it.NextAttempt,
+			LastError:   it.LastError}
+	}
+	return ais
+}
+
+// A recentOutcome is what became of a Delivery.
+type recentOutcome struct {
+	Time    time.Time `json:"time"`
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Route   string    `json:"route"`
+	Subject string    `json:"subject"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// recentOutcomes remembers the latest outcomes, newest first.
+type recentOutcomes struct {
+	mu       sync.Mutex
+	outcomes []recentOutcome
+}
+
+func (r *recentOutcomes) add(d *notify.Delivery, outcome string, err error) {
+	o := recentOutcome{
+		Time:    time.Now(),
+		ID:      d.ID,
+		From:    d.From.Address,
+		To:      d.Rcpt,
+		Route:   d.Route.Kind,
+		Subject: d.Subject,
+		Outcome: outcome}
+	if err != nil {
+		o.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes = append([]recentOutcome{o}, r.outcomes...)
+	if len(r.outcomes) > maxRecent {
+		r.outcomes = r.outcomes[:maxRecent]
+	}
+}
+
+func (r *recentOutcomes) list() []recentOutcome {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]recentOutcome{}, r.outcomes...)
+}
+
+// An adminQuota is how much of its monthly allowance a Pushover app has used.
+type adminQuota struct {
+	App       string    `json:"app"`
+	Token     string    `json:"token"`
+	Limit     int       `json:"limit,omitempty"`
+	Remaining int       `json:"remaining,omitempty"`
+	Reset     time.Time `json:"reset,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// quotas looks up the allowance of every app token in the configuration.
+func quotas(c *Config) []adminQuota {
+	apps := make(map[string][]string)
+	if token := c.AppToken.Value(); token != "" {
+		apps[token] = append(apps[token], "default")
+	}
+	for key, token := range c.AppTokens {
+		apps[token] = append(apps[token], key)
+	}
+	for _, tn := range c.Tenants.All() {
+		if tn.AppToken != "" {
+			apps[tn.AppToken] = append(apps[tn.AppToken], "tenant:"+tn.Name)
+		}
+	}
+	var qs []adminQuota
+	for token, keys := range apps {
+		sort.Strings(keys)
+		q := adminQuota{App: strings.Join(keys, ","), Token: token[:4] + "..."}
+		if limits, err := notify.AppLimits(token); err != nil {
+			q.Error = err.Error()
+		} else {
+			q.Limit, q.Remaining, q.Reset = limits.Total, limits.Remaining, limits.NextReset
+		}
+		qs = append(qs, q)
+	}
+	sort.Slice(qs, func(i, j int) bool { return qs[i].App < qs[j].App })
+	return qs
+}
+
+// handleAdmin adds the admin API to mux. Each request must carry the
+// configured admin token as a bearer token; without one, the API is disabled.
+func (t *Translator) handleAdmin(mux *http.ServeMux) {
+	mux.Handle("GET /admin/queue", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"paused":  t.queue.Paused(),
+			"pending": newAdminItems(t.queue.Pending()),
+			"dead":    newAdminItems(t.queue.Dead())})
+	}))
+	mux.Handle("POST /admin/queue/pause", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		t.queue.Pause()
+		t.logger.Info("paused delivery")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.Handle("POST /admin/queue/resume", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		t.queue.Resume()
+		t.logger.Info("resumed delivery")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.Handle("POST /admin/queue/{seq}/retry", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		t.manageItem(w, r, t.queue.Retry)
+	}))
+	mux.Handle("DELETE /admin/queue/{seq}", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		t.manageItem(w, r, t.queue.Delete)
+	}))
+	mux.Handle("GET /admin/queue/{seq}/message", t.ifAdmin(t.serveItemMessage))
+	mux.Handle("GET /admin/queue/export", t.ifAdmin(t.serveExport))
+	mux.Handle("GET /admin/silences", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, t.silences.all())
+	}))
+	mux.Handle("POST /admin/silences", t.ifAdmin(t.createSilence))
+	mux.Handle("DELETE /admin/silences/{id}", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if !t.silences.remove(r.PathValue("id")) {
+			writeJSON(w, http.StatusNotFound, apiError{Error: "no such silence: " + r.PathValue("id")})
+			return
+		}
+		t.logger.Info("ended silence", "silence", r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.Handle("GET /admin/recent", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, t.recent.list())
+	}))
+	mux.Handle("GET /admin/quota", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, quotas(t.Config()))
+	}))
+	mux.Handle("GET /admin/history", t.ifAdmin(t.serveHistory))
+	mux.Handle("POST /admin/test", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var m APIMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize)).Decode(&m); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		status, v := t.submit(t.Config(), net.ParseIP(host), "", &m)
+		writeJSON(w, status, v)
+	}))
+	mux.Handle("GET /admin/{$}", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/admin/ui", http.StatusFound)
+	}))
+	mux.Handle("GET /admin/ui", t.ifAdmin(t.serveUI))
+	mux.Handle("GET /admin/config", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, t.Config().Effective)
+	}))
+	mux.Handle("POST /admin/reload", t.ifAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if t.ReloadConfig == nil {
+			writeJSON(w, http.StatusNotImplemented, apiError{Error: "reloading is not supported"})
+			return
+		}
+		if err := t.ReloadConfig(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// serveHistory searches the history with the query parameters q, from, to,
+// since, until, and limit.
+func (t *Translator) serveHistory(w http.ResponseWriter, r *http.Request) {
+	h := t.Config().History
+	if h == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "history is not enabled"})
+		return
+	}
+	v := r.URL.Query()
+	q := HistoryQuery{Text: v.Get("q"), From: v.Get("from"), To: v.Get("to"), Limit: defaultHistoryLimit}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(name); s != "" {
+			tm, err := parseHistoryTime(s)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid " + name + ": " + s})
+				return
+			}
+			*dst = tm
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid limit: " + s})
+			return
+		}
+		q.Limit = n
+	}
+	found, err := h.Search(q)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if found == nil {
+		found = []HistoryRecord{}
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// parseHistoryTime accepts an RFC 3339 time or a date, in local time.
+func parseHistoryTime(s string) (time.Time, error) {
+	if tm, err := time.Parse(time.RFC3339, s); err == nil {
+		return tm, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+// manageItem applies f to the queue Item named in the request path.
+func (t *Translator) manageItem(w http.ResponseWriter, r *http.Request, f func(uint64) error) {
+	seq, err := strconv.ParseUint(r.PathValue("seq"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid item: " + r.PathValue("seq")})
+		return
+	}
+	switch err := f(seq); {
+	case errors.Is(err, queue.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, apiError{Error: err.Error()})
+	case errors.Is(err, queue.ErrSending):
+		writeJSON(w, http.StatusConflict, apiError{Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+	default:
+		t.logger.Info("managed queue item", "action", r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveItemMessage responds with the original email of a queued or dead
+// notification, so that it can be fed back in or relayed as is.
+func (t *Translator) serveItemMessage(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.PathValue("seq"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid item: " + r.PathValue("seq")})
+		return
+	}
+	it, err := t.queue.Get(seq)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: err.Error()})
+		return
+	}
+	if len(it.Delivery.Data) == 0 {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "notification did not arrive by email"})
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+it.Delivery.ID+`.eml"`)
+	w.Write(it.Delivery.Data)
+}
+
+// A silenceRequest creates a Silence. It may give a duration instead of an end
+// time, and starts now unless told otherwise.
+type silenceRequest struct {
+	Silence
+	Duration string `json:"duration"`
+}
+
+// createSilence starts a Silence and responds with it.
+func (t *Translator) createSilence(w http.ResponseWriter, r *http.Request) {
+	var req silenceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	s := req.Silence
+	if s.Starts.IsZero() {
+		s.Starts = time.Now()
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid duration: " + req.Duration})
+			return
+		}
+		s.Ends = s.Starts.Add(d)
+	}
+	s, err := t.silences.add(s)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	t.logger.Info("started silence", "silence", s.ID, "from", s.From, "to", s.To, "route", s.Route, "hold", s.Hold, "until", s.Ends)
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// serveExport responds with the pending and dead notifications as an mbox,
+// or only those named by the state query parameter.
+func (t *Translator) serveExport(w http.ResponseWriter, r *http.Request) {
+	var items []queue.Item
+	switch state := r.URL.Query().Get("state"); state {
+	case "":
+		items = append(t.queue.Pending(), t.queue.Dead()...)
+	case "pending":
+		items = t.queue.Pending()
+	case "dead":
+		items = t.queue.Dead()
+	default:
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid state: " + state})
+		return
+	}
+	w.Header().Set("Content-Type", "application/mbox")
+	w.Header().Set("Content-Disposition", `attachment; filename="smtp-translator.mbox"`)
+	for _, it := range items {
+		if err := writeMboxItem(w, it); err != nil {
+			return
+		}
+	}
+}
+
+// ifAdmin serves h only to requests with the admin token, given either as a
+// bearer token or as the password for HTTP basic authentication.
+func (t *Translator) ifAdmin(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.Config().AdminToken.Value() == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !t.isAdmin(r) {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="SMTP Translator"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="SMTP Translator"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "admin token required"})
+			return
+		}
+		h(w, r)
+	})
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/queue"
+)
+
+// alertTimeout bounds each request to the alert webhook.
+const alertTimeout = 10 * time.Second
+
+// An Alert is posted to the alert webhook as JSON. Event is "failing" when
+// deliveries start to fail, repeated while they keep failing, and "recovered"
+// once one succeeds again.
+type Alert struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Failures int       `json:"failures"`
+
+	// The most recent failure.
+	ID      string `json:"id,omitempty"`
+	Route   string `json:"route,omitempty"`
+	To      string `json:"to,omitempty"`
+	Outcome string `json:"outcome,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// An alerter watches the outcomes of deliveries and raises Alerts when they
+// fail, no more often than once per interval while the failures continue.
+type alerter struct {
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	failures int
+	last     time.Time
+}
+
+// report takes the outcome of a Delivery under the configuration c.
+func (a *alerter) report(c *Config, d *notify.Delivery, outcome string, err error) {
+	if c.AlertWebhook == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if outcome == queue.Delivered {
+		if a.failures > 0 {
+			go a.post(c.AlertWebhook, &Alert{Event: "recovered", Time: now, Host: c.Hostname, Failures: a.failures})
+		}
+		a.failures = 0
+		return
+	}
+	a.failures++
+	if a.failures > 1 && now.Sub(a.last) < c.AlertInterval {
+		return
+	}
+	a.last = now
+	alert := &Alert{
+		Event:    "failing",
+		Time:     now,
+		Host:     c.Hostname,
+		Failures: a.failures,
+		ID:       d.ID,
+		Route:    d.Route.Kind,
+		To:       d.Rcpt,
+		Outcome:  outcome}
+	if err != nil {
+		alert.Error = err.Error()
+	}
+	go a.post(c.AlertWebhook, alert)
+}
+
+// post sends an Alert to the webhook.
+func (a *alerter) post(url string, alert *Alert) {
+	body, err := json.Marshal(alert)
+	if err == nil {
+		client := &http.Client{Timeout: alertTimeout}
+		var resp *http.Response
+		if resp, err = client.Post(url, "application/json", bytes.NewReader(body)); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = errors.New(resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		a.logger.Error("error posting alert", "event", alert.Event, "err", err)
+	}
+}
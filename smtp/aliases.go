@@ -0,0 +1,153 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// An Aliases maps friendly recipient addresses to Pushover recipients, so that
+// clients need not know anybody's user token. Each line of the file is in the
+// form of address: recipient recipient ..., where address is a full email
+// address or a bare name that matches in every domain, and each recipient is a
+// user token followed by the same options an email address may carry, such as
+// uQiRzpo4DXghDmr9QzzfQu27cmVRsG>iphone#1. An alias with several recipients
+// notifies each of them separately. Lines beginning with # are ignored.
+type Aliases struct {
+	Path string
+	// Tokens recognizes user tokens. If it is nil, parse.DefaultTokens is
+	// used.
+	Tokens *parse.Tokens
+
+	mu      sync.RWMutex
+	aliases map[string][]*parse.Recipient
+}
+
+// LoadAliases reads an aliases file from disk.
+func LoadAliases(path string) (*Aliases, error) {
+	a := &Aliases{Path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload rereads the aliases file. If the file cannot be read or contains a
+// malformed line, the previously loaded aliases remain in effect.
+func (a *Aliases) Reload() error {
+	b, err := ioutil.ReadFile(a.Path)
+	if err != nil {
+		return err
+	}
+	tokens := a.Tokens
+	if tokens == nil {
+		tokens = parse.DefaultTokens
+	}
+	aliases, err := readAliases(strings.NewReader(string(b)), tokens)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.Path, err)
+	}
+	a.mu.Lock()
+	a.aliases = aliases
+	a.mu.Unlock()
+	return nil
+}
+
+// Lookup returns copies of the recipients an address is an alias for, trying
+// the full address before its local part.
+func (a *Aliases) Lookup(addr string) ([]*parse.Recipient, bool) {
+	if a == nil {
+		return nil, false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	addr = strings.ToLower(addr)
+	rcpts, ok := a.aliases[addr]
+	if at := strings.LastIndex(addr, "@"); !ok && at >= 0 {
+		rcpts, ok = a.aliases[addr[:at]]
+	}
+	if !ok {
+		return nil, false
+	}
+	copies := make([]*parse.Recipient, len(rcpts))
+	for i, r := range rcpts {
+		rcpt := *r
+		copies[i] = &rcpt
+	}
+	return copies, true
+}
+
+func readAliases(r io.Reader, tokens *parse.Tokens) (map[string][]*parse.Recipient, error) {
+	aliases := make(map[string][]*parse.Recipient)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("line %d: expected address: recipient", n)
+		}
+		addr := strings.ToLower(strings.TrimSpace(split[0]))
+		// Device lists are separated by commas, so recipients are separated by
+		// whitespace instead.
+		targets := strings.Fields(split[1])
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("line %d: no recipients for %s", n, addr)
+		}
+		for _, target := range targets {
+			rcpt := tokens.ParseRecipient(target + "@")
+			if rcpt.UserToken == "" {
+				return nil, fmt.Errorf("line %d: not a Pushover recipient: %s", n, target)
+			}
+			aliases[addr] = append(aliases[addr], rcpt)
+		}
+	}
+	return aliases, scanner.Err()
+}
+
+// Recipients parses a recipient address, first expanding it if it is an alias.
+// It returns nil if the address is not a valid recipient or selects a profile
+// that doesn't exist.
+func (c *Config) Recipients(addr string) []*parse.Recipient {
+	rcpts, ok := c.Aliases.Lookup(addr)
+	if !ok {
+		if r := c.tokens().ParseRecipient(addr); r.UserToken != "" {
+			rcpts = []*parse.Recipient{r}
+		}
+	}
+	for _, r := range rcpts {
+		if r.Profile != "" && c.Profiles[r.Profile] == nil {
+			return nil
+		}
+	}
+	return rcpts
+}
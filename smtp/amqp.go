@@ -0,0 +1,170 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpTimeout bounds connecting to the AMQP server.
+const amqpTimeout = 10 * time.Second
+
+// amqpRetryInterval is how long the consumer waits after an error before
+// connecting again.
+const amqpRetryInterval = 5 * time.Second
+
+// amqpPrefetch is how many unacknowledged messages the server may send at
+// once.
+const amqpPrefetch = 16
+
+// amqpHeartbeat is the interval between heartbeats the consumer asks for.
+const amqpHeartbeat = 30 * time.Second
+
+// errAMQPClosed reports that the connection was closed because the Translator
+// is shutting down or standing by.
+var errAMQPClosed = errors.New("amqp: connection closed")
+
+// parseAMQPURL checks an -amqp URL, and returns the queue it names.
+func parseAMQPURL(rawURL string) (queue string, err error) {
+	if _, err := amqp.ParseURI(rawURL); err != nil {
+		return "", err
+	}
+	u, _ := url.Parse(rawURL)
+	if u.Hostname() == "" {
+		return "", errors.New("no server")
+	}
+	if queue = u.Query().Get("queue"); queue == "" {
+		return "", errors.New("no queue")
+	}
+	return queue, nil
+}
+
+// consumeAMQP consumes notifications from the AMQP queue at an -amqp URL until
+// the Translator shuts down. Each message is an APIMessage, which is routed,
+// filtered, and queued like one submitted to the HTTP API. A standby instance
+// consumes nothing.
+func (t *Translator) consumeAMQP(rawURL string) {
+	for {
+		if !t.queue.Standby() {
+			if err := t.serveAMQP(rawURL); err != errAMQPClosed {
+				t.logger.Error("error consuming from AMQP", "err", err)
+			}
+		}
+		select {
+		case <-time.After(amqpRetryInterval):
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// serveAMQP connects to the AMQP server and handles the messages it delivers
+// until the connection fails, the Translator shuts down, or it becomes a
+// standby. Messages that have not been acknowledged by then are delivered
+// again, here or to another consumer.
+func (t *Translator) serveAMQP(rawURL string) error {
+	queue, err := parseAMQPURL(rawURL)
+	if err != nil {
+		return err
+	}
+	conn, err := amqp.DialConfig(rawURL, amqp.Config{
+		Heartbeat:  amqpHeartbeat,
+		Properties: amqp.Table{"product": "smtp-translator"},
+		Dial:       amqp.DefaultDial(amqpTimeout)})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Qos(amqpPrefetch, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	defer t.closeWhenPausing(conn)()
+	for d := range deliveries {
+		ok, err := t.amqpMessage(d)
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = d.Ack(false)
+		} else {
+			err = d.Reject(false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if t.pausing() {
+		return errAMQPClosed
+	}
+	if err := <-closed; err != nil {
+		return err
+	}
+	return errors.New("amqp: consumer cancelled")
+}
+
+// amqpMessage queues the notification in a message consumed from AMQP, and
+// reports whether to acknowledge it. Malformed and undeliverable messages are
+// logged and rejected. It returns an error if the message should be delivered
+// again later, because the Translator is shutting down or could not queue it.
+func (t *Translator) amqpMessage(d amqp.Delivery) (bool, error) {
+	if !t.tryStartHandling() {
+		return false, errAMQPClosed
+	}
+	defer t.doneHandling()
+
+	logger := t.logger.With("tag", d.DeliveryTag, "redelivered", d.Redelivered)
+	if len(d.Body) > maxAPIRequestSize {
+		logger.Warn("rejected AMQP message", "err", "too large")
+		return false, nil
+	}
+	var msg APIMessage
+	if err := json.Unmarshal(d.Body, &msg); err != nil {
+		logger.Warn("malformed AMQP message", "err", err)
+		return false, nil
+	}
+	status, v := t.submit(t.Config(), nil, "", &msg)
+	switch {
+	case status == http.StatusServiceUnavailable:
+		return false, fmt.Errorf("could not queue message: %s", v.(apiError).Error)
+	case status >= http.StatusBadRequest:
+		logger.Warn("rejected AMQP message", "err", v.(apiError).Error)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// maxAPIRequestSize bounds the JSON body of a submission.
+const maxAPIRequestSize = 1 << 20
+
+// An APIMessage is a notification submitted to the HTTP API. To holds one or
+// more recipient addresses, which are routed just like those given in RCPT TO.
+// The optional fields override any set by the address or a profile.
+type APIMessage struct {
+	To       []string `json:"to"`
+	From     string   `json:"from,omitempty"`
+	Title    string   `json:"title"`
+	Body     string   `json:"body"`
+	HTML     *bool    `json:"html,omitempty"`
+	Priority *int     `json:"priority,omitempty"`
+	Retry    int      `json:"retry,omitempty"`
+	Expire   int      `json:"expire,omitempty"`
+	Device   string   `json:"device,omitempty"`
+	Sound    string   `json:"sound,omitempty"`
+}
+
+// UnmarshalJSON lets To be a single address as well as a list.
+func (m *APIMessage) UnmarshalJSON(data []byte) error {
+	type plain APIMessage
+	var raw struct {
+		plain
+		To json.RawMessage `json:"to"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = APIMessage(raw.plain)
+	var one string
+	if err := json.Unmarshal(raw.To, &one); err == nil {
+		m.To = []string{one}
+		return nil
+	}
+	return json.Unmarshal(raw.To, &m.To)
+}
+
+// An apiResponse answers a successful submission.
+type apiResponse struct {
+	ID     string `json:"id"`
+	Queued int    `json:"queued"`
+}
+
+// An apiError answers a failed one.
+type apiError struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// An apiBatchResult answers one message in a batch.
+type apiBatchResult struct {
+	Status int `json:"status"`
+	Result any `json:"result"`
+}
+
+// serveAPI accepts a POSTed APIMessage.
+func (t *Translator) serveAPI(w http.ResponseWriter, r *http.Request) {
+	c, ip, user, ok := t.apiClient(w, r)
+	if !ok {
+		return
+	}
+	var m APIMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize)).Decode(&m); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	status, v := t.submit(c, ip, user, &m)
+	writeJSON(w, status, v)
+}
+
+// apiClient checks that a request may use the API. If the request may not
+// proceed, apiClient answers it and returns false; otherwise it returns the
+// configuration to use, the client's address, and the user it logged in as, if
+// any.
+func (t *Translator) apiClient(w http.ResponseWriter, r *http.Request) (c *Config, ip net.IP, user string, ok bool) {
+	c = t.Config()
+	if !c.API {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use POST"})
+		return
+	}
+	ip, user, ok = t.apiAuth(w, r, c, "")
+	return
+}
+
+// apiAuth holds a request to the same network restrictions as SMTP clients.
+// If token is set, the request must carry it; otherwise, if the configuration
+// has passwords, the client must log in with HTTP basic authentication unless
+// it is on a trusted network. If the request may not proceed, apiAuth answers
+// it and returns false.
+func (t *Translator) apiAuth(w http.ResponseWriter, r *http.Request, c *Config, token string) (ip net.IP, user string, ok bool) {
+	ip, user, status, msg := t.authorize(r, c, token)
+	if status != 0 {
+		if status == http.StatusUnauthorized && token == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="SMTP Translator"`)
+		}
+		writeJSON(w, status, apiError{Error: msg})
+		return
+	}
+	return ip, user, true
+}
+
+// authorize applies apiAuth's rules to a request without answering it. If the
+// request may not proceed, it returns the status and error message to refuse
+// it with; otherwise status is 0.
+func (t *Translator) authorize(r *http.Request, c *Config, token string) (ip net.IP, user string, status int, msg string) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip = net.ParseIP(host)
+	if c.DenyNets.Contains(ip) || (len(c.AllowNets) > 0 && !c.AllowNets.Contains(ip)) {
+		return ip, "", http.StatusForbidden, "client not allowed"
+	}
+	if token != "" {
+		if !hasToken(r, token) {
+			return ip, "", http.StatusUnauthorized, "token required"
+		}
+		return ip, "", 0, ""
+	}
+	user, pw, hasAuth := r.BasicAuth()
+	if passwordAuth := c.AuthDb != nil || len(c.AuthBackends) > 0; passwordAuth && (hasAuth || !c.UnauthNets.Contains(ip)) {
+		t.mu.Lock()
+		lockout := t.lockout
+		t.mu.Unlock()
+		if lockout != nil && lockout.Locked(ip) {
+			return ip, "", http.StatusTooManyRequests, "too many failed logins"
+		}
+		authed, err := authPlaintext(c, user, pw)
+		switch {
+		case err != nil:
+			t.logger.Error("error authenticating", "client", ip, "user", user, "err", err)
+			return ip, "", http.StatusServiceUnavailable, "authentication unavailable"
+		case !authed:
+			if lockout != nil {
+				lockout.Fail(ip)
+			}
+			return ip, "", http.StatusUnauthorized, "authentication required"
+		}
+		if lockout != nil {
+			lockout.Succeed(ip)
+		}
+	} else {
+		user = ""
+	}
+	return ip, user, 0, ""
+}
+
+// submit routes, filters, and queues an APIMessage, and returns the status and
+// response to answer it with. ip is nil for messages that did not come over
+// the network.
+func (t *Translator) submit(c *Config, ip net.IP, user string, m *APIMessage) (int, any) {
+	if len(m.To) == 0 {
+		return http.StatusBadRequest, apiError{Error: "no recipients"}
+	} else if m.Body == "" {
+		return http.StatusBadRequest, apiError{Error: "no body"}
+	}
+	if m.From == "" {
+		m.From = "api@" + c.Hostname
+	}
+	if user != "" && c.AuthDb != nil && !c.AuthDb.SenderAllowed(user, m.From) {
+		return http.StatusForbidden, apiError{Error: "sender not allowed"}
+	}
+	tenant := c.Tenants.Lookup(user, m.From)
+
+	var client string
+	if ip != nil {
+		client = ip.String()
+	}
+	env := &parse.Envelope{
+		From:      c.Sender(user, m.From),
+		Subject:   m.Title,
+		Body:      m.Body,
+		Plaintext: c.Plaintext,
+		Client:    client,
+		User:      user,
+		ID:        newID()}
+	if m.HTML != nil {
+		env.Plaintext = !*m.HTML
+	}
+	var ds []*notify.Delivery
+	for _, rcpt := range m.To {
+		rds := c.Deliveries(env, rcpt)
+		if len(rds) == 0 {
+			return http.StatusUnprocessableEntity, apiError{Error: "cannot deliver to " + rcpt}
+		}
+		for _, d := range rds {
+			if user != "" && c.AuthDb != nil && d.To.UserToken != "" && !c.AuthDb.RecipientAllowed(user, d.To.UserToken) {
+				return http.StatusForbidden, apiError{Error: "recipient not allowed: " + rcpt}
+			}
+			if !tenant.RecipientAllowed(d.To.UserToken) {
+				return http.StatusForbidden, apiError{Error: "recipient not allowed: " + rcpt}
+			}
+			to := *d.To
+			if m.Priority != nil {
+				to.Priority = *m.Priority
+			}
+			if m.Retry != 0 {
+				to.RetrySec = m.Retry
+			}
+			if m.Expire != 0 {
+				to.ExpireSec = m.Expire
+			}
+			if m.Device != "" {
+				to.Device = m.Device
+			}
+			if m.Sound != "" {
+				to.Sound = m.Sound
+			}
+			d.To = &to
+		}
+		ds = append(ds, rds...)
+	}
+
+	if tenant != nil {
+		t.mu.Lock()
+		limiters := t.tenantLimiters[tenant.Name]
+		t.mu.Unlock()
+		for range m.To {
+			if !reserveAll(limiters, tenant.Name) {
+				t.logger.Info("tenant over its rate limit", "client", client, "user", user, "tenant", tenant.Name)
+				return http.StatusTooManyRequests, apiError{Error: "too many messages, try again later"}
+			}
+		}
+	}
+	t.count(c.Stats.Accept())
+	t.vars.Add("accepted", 1)
+	t.summary.accept(m.From)
+	t.logger.Debug("received message", "client", env.Client, "id", env.ID, "from", m.From, "to", strings.Join(m.To, ","))
+	var queued []*notify.Delivery
+	for _, d := range ds {
+		disposition, by := AuditDropped, t.filter(c, d.Envelope)
+		if by == "" {
+			disposition, by = t.silenced(d)
+		}
+		if by != "" {
+			t.audit(AuditRecord{
+				ID:          env.ID,
+				Client:      env.Client,
+				User:        user,
+				From:        m.From,
+				To:          d.Rcpt,
+				Disposition: disposition,
+				Result:      by})
+			continue
+		}
+		queued = append(queued, d)
+	}
+	if err := t.enqueue(queued); err != nil {
+		return http.StatusServiceUnavailable, apiError{ID: env.ID, Error: err.Error()}
+	}
+	return http.StatusAccepted, apiResponse{ID: env.ID, Queued: len(queued)}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// AppTokens maps senders to Pushover app tokens, so that in multiple app token
+// mode, the tokens need not appear in From: addresses. Keys are usernames,
+// From: addresses, or @domains.
+type AppTokens map[string]string
+
+// parseAppTokens parses a comma-separated list in the form of key=apptoken.
+func parseAppTokens(list string, patterns *parse.Tokens) (AppTokens, error) {
+	tokens := make(AppTokens)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		split := strings.SplitN(s, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return nil, errors.New("invalid app token mapping (expected sender=apptoken): " + s)
+		}
+		key, token := split[0], strings.TrimSpace(split[1])
+		if !patterns.IsAppToken(token) {
+			return nil, errors.New("invalid app token for " + key + ": " + token)
+		}
+		// Addresses are case-insensitive, but usernames are not.
+		if strings.Contains(key, "@") {
+			key = strings.ToLower(key)
+		}
+		tokens[key] = token
+	}
+	return tokens, nil
+}
+
+// Lookup returns the app token for an authenticated user and a From: address,
+// preferring the user, then the full address, and then its domain. It returns
+// an empty string if there is no match.
+func (t AppTokens) Lookup(user, from string) string {
+	if token, ok := t[user]; ok && user != "" {
+		return token
+	}
+	from = strings.ToLower(from)
+	if token, ok := t[from]; ok && from != "" {
+		return token
+	}
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		return t[from[at:]]
+	}
+	return ""
+}
+
+// sender works out which app token to send a message with, given the user who
+// submitted it (if any) and its MAIL FROM address. The user's own token in the
+// auth file takes precedence, followed by -app-tokens, the token in the From:
+// address in multiple app token mode, and finally the server's token. A
+// Tenant's token comes before all but the user's own.
+func (c *Config) Sender(user, from string) *parse.Sender {
+	sndr := c.tokens().ParseSender(from)
+	if !c.MultiToken {
+		sndr.AppToken = c.AppToken.Value()
+		sndr.ShowAddress = true
+	}
+	if token := c.AppTokens.Lookup(user, from); token != "" {
+		sndr.AppToken = token
+		sndr.ShowAddress = true
+	}
+	if tn := c.Tenants.Lookup(user, from); tn != nil && tn.AppToken != "" {
+		sndr.AppToken = tn.AppToken
+		sndr.ShowAddress = true
+	}
+	if user != "" && c.AuthDb != nil {
+		if token := c.AuthDb.AppToken(user); token != "" {
+			sndr.AppToken = token
+			sndr.ShowAddress = true
+		}
+	}
+	return sndr
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Dispositions recorded in the audit log.
+const (
+	AuditRejected  = "rejected"
+	AuditDeferred  = "deferred"
+	AuditDelivered = "delivered"
+	AuditFailed    = "failed"
+	AuditDropped   = "dropped"
+)
+
+// An AuditRecord describes what became of one recipient of one message.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	ID          string    `json:"id,omitempty"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	MessageID   string    `json:"message_id,omitempty"`
+	Disposition string    `json:"disposition"`
+	Result      string    `json:"result,omitempty"`
+}
+
+// An AuditLog appends AuditRecords to a file as lines of JSON. It is safe for
+// concurrent use, and a nil AuditLog discards everything.
+type AuditLog struct {
+	jsonLog
+}
+
+// OpenAuditLog opens an audit log for appending, creating it if necessary.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{jsonLog{Path: path}}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Record writes a record, filling in the time if it is not set.
+func (a *AuditLog) Record(r AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	return a.write(r)
+}
+
+// A jsonLog is a file that values are appended to as lines of JSON.
+type jsonLog struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Reopen closes and reopens the file, so that it can be rotated.
+func (l *jsonLog) Reopen() error {
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Close closes the file. Values written afterwards are discarded with an
+// error.
+func (l *jsonLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *jsonLog) write(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return errors.New(l.Path + " is closed")
+	}
+	_, err = l.f.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// An AuthDb holds the logins read from an auth file. Each line of the file is
+// in the form of username:password, optionally followed by :apptoken to bind
+// the user's messages to a particular Pushover app, by :sender,sender,... to
+// restrict the MAIL FROM addresses the user may use, and then by
+// :usertoken,usertoken,... to restrict the Pushover users the user may notify.
+// It is safe for concurrent use and can be reloaded while the server runs.
+type AuthDb struct {
+	Path string
+
+	mu    sync.RWMutex
+	users map[string]authEntry
+}
+
+type authEntry struct {
+	password   string
+	appToken   string
+	senders    []string
+	recipients []string
+}
+
+// LoadAuthDb reads an auth file from disk.
+func LoadAuthDb(path string) (*AuthDb, error) {
+	db := &AuthDb{Path: path}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload rereads the auth file, which may also be stored in a secret manager.
+// If the file cannot be read, the previously loaded credentials remain in
+// effect.
+func (db *AuthDb) Reload() error {
+	data, err := readSecret(db.Path)
+	if err != nil {
+		return err
+	}
+	users, err := readAuth(strings.NewReader(data))
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.users = users
+	db.mu.Unlock()
+	return nil
+}
+
+// Password returns the stored password (or password hash) for a user, or an
+// empty string if there is no such user.
+func (db *AuthDb) Password(user string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.users[user].password
+}
+
+// AppToken returns the Pushover app token bound to a user, or an empty string
+// if the user may send with any app token.
+func (db *AuthDb) AppToken(user string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.users[user].appToken
+}
+
+// SenderAllowed reports whether a user may submit messages from a MAIL FROM
+// address. Users without a list of senders may use any address. A sender that
+// begins with @ matches every address in that domain.
+func (db *AuthDb) SenderAllowed(user, from string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	senders := db.users[user].senders
+	if len(senders) == 0 {
+		return true
+	}
+	from = strings.ToLower(from)
+	for _, sender := range senders {
+		if from == sender || (strings.HasPrefix(sender, "@") && strings.HasSuffix(from, sender)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecipientAllowed reports whether a user may send notifications to a Pushover
+// user token. Users without a list of recipients may notify anybody.
+func (db *AuthDb) RecipientAllowed(user, userToken string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	recipients := db.users[user].recipients
+	if len(recipients) == 0 {
+		return true
+	}
+	for _, r := range recipients {
+		if userToken == r {
+			return true
+		}
+	}
+	return false
+}
+
+// An AuthBackend verifies plaintext credentials against an external account
+// database, such as a directory server.
+type AuthBackend interface {
+	Authenticate(user, pw string) (bool, error)
+}
+
+// SupportedAuthMechs lists the SMTP authentication mechanisms SMTP Translator
+// can accept.
+var SupportedAuthMechs = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+
+// authMechs converts a list of enabled mechanisms into the overrides smtpd
+// expects. The overrides only ever disable mechanisms, so smtpd still withholds
+// PLAIN and LOGIN from unencrypted connections. A nil list enables everything.
+// If tlsOnly is set, CRAM-MD5, which smtpd would offer without encryption, is
+// disabled too.
+func authMechs(enabled []string, tlsOnly bool) map[string]bool {
+	mechs := make(map[string]bool)
+	if enabled != nil {
+		for _, m := range SupportedAuthMechs {
+			mechs[m] = false
+		}
+		for _, m := range enabled {
+			delete(mechs, m)
+		}
+	}
+	if tlsOnly {
+		mechs["CRAM-MD5"] = false
+	}
+	return mechs
+}
+
+// parseAuthMechs validates a comma-separated list of mechanism names.
+func parseAuthMechs(list string) ([]string, error) {
+	var mechs []string
+	for _, m := range strings.Split(list, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" {
+			continue
+		}
+		supported := false
+		for _, sm := range SupportedAuthMechs {
+			supported = supported || m == sm
+		}
+		if !supported {
+			return nil, errors.New("unsupported auth mechanism: " + m)
+		}
+		mechs = append(mechs, m)
+	}
+	if len(mechs) == 0 {
+		return nil, errors.New("must enable at least one auth mechanism")
+	}
+	return mechs, nil
+}
+
+// errAuthMechanism is reported to clients that somehow attempt a mechanism
+// SMTP Translator does not support.
+var errAuthMechanism = errors.New("504 5.5.4 Unrecognized authentication type")
+
+// errAuthEncryption is reported to clients that attempt to log in over an
+// unencrypted connection when that is forbidden.
+var errAuthEncryption = errors.New("538 5.7.11 Encryption required for requested authentication mechanism")
+
+// errAuthUnavailable is reported to clients when an AuthBackend fails. Its text
+// is sent verbatim as the SMTP response.
+var errAuthUnavailable = errors.New("454 4.7.0 Temporary authentication failure")
+
+// errAuthLocked is reported to clients that log in from a locked out address.
+var errAuthLocked = errors.New("454 4.7.0 Too many failed logins, try again later")
+
+// authPlaintext checks a username and password against the auth file and then
+// against each of the configured AuthBackends.
+func authPlaintext(c *Config, user, pw string) (ok bool, err error) {
+	if c.AuthDb != nil {
+		if stored := c.AuthDb.Password(user); stored != "" && checkPassword(stored, pw) {
+			return true, nil
+		}
+	}
+	for _, b := range c.AuthBackends {
+		bok, berr := b.Authenticate(user, pw)
+		if bok {
+			return true, nil
+		} else if berr != nil {
+			err = berr
+		}
+	}
+	return false, err
+}
+
+// authCramMd5 implements the CRAM-MD5 SMTP authentication method, which compares
+// a user-submitted HMAC with an expected HMAC that is derived from a shared
+// secret (in SMTP Translator's case, the plaintext password). Users whose
+// passwords are stored as htpasswd hashes cannot log in this way.
+func authCramMd5(db *AuthDb, user string, mac, chal []byte) (bool, error) {
+	stored := db.Password(user)
+	if stored == "" || isHashed(stored) {
+		return false, nil
+	}
+	// https://en.wikipedia.org/wiki/CRAM-MD5#Protocol
+	rec := make([]byte, hex.DecodedLen(len(mac)))
+	n, err := hex.Decode(rec, mac)
+	if err != nil {
+		return false, err
+	}
+	rec = rec[:n]
+	mymac := hmac.New(md5.New, []byte(stored))
+	mymac.Write(chal)
+	exp := mymac.Sum(nil)
+	return hmac.Equal(exp, rec), nil
+}
+
+func readAuth(r io.Reader) (db map[string]authEntry, err error) {
+	db = make(map[string]authEntry)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		split := strings.Split(scanner.Text(), ":")
+		if len(split) < 2 || len(split) > 5 {
+			continue
+		}
+		// Pad out the optional fields.
+		split = append(split, make([]string, 5-len(split))...)
+		db[split[0]] = authEntry{
+			password:   split[1],
+			appToken:   split[2],
+			senders:    parseList(split[3], true),
+			recipients: parseList(split[4], false)}
+	}
+	err = scanner.Err()
+	return
+}
+
+func parseList(list string, fold bool) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if fold {
+			item = strings.ToLower(item)
+		}
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("myPassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		stored, pw string
+		want       bool
+	}{
+		{"myPassword", "myPassword", true},
+		{"myPassword", "mypassword", false},
+		{"myPassword", "", false},
+		// From openssl passwd -apr1.
+		{"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword", true},
+		{"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword2", false},
+		{"$apr1$saltsalt$4YdsMdvaQmZ0TvJbACAEe0", "a much longer password than sixteen bytes", true},
+		{"$apr1$x$tMwYqBfQwi3FYAr0aJc8M/", "", true},
+		// The salt is at most 8 characters.
+		{"$apr1$saltsaltsalt$4YdsMdvaQmZ0TvJbACAEe0", "a much longer password than sixteen bytes", false},
+		{"{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=", "myPassword", true},
+		{"{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=", "myPassword ", false},
+		{string(hash), "myPassword", true},
+		{string(hash), "myPassword2", false},
+		{strings.Replace(string(hash), "$2a$", "$2y$", 1), "myPassword", true},
+	} {
+		if got := checkPassword(tt.stored, tt.pw); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.stored, tt.pw, got, tt.want)
+		}
+	}
+}
+
+func TestApr1(t *testing.T) {
+	if got, want := apr1("myPassword", "r31....."), "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"; got != want {
+		t.Errorf("apr1() = %q, want %q", got, want)
+	}
+	if got, want := apr1("a much longer password than sixteen bytes", "saltsaltsalt"), "$apr1$saltsalt$4YdsMdvaQmZ0TvJbACAEe0"; got != want {
+		t.Errorf("apr1() with a long salt = %q, want %q", got, want)
+	}
+}
+
+func TestIsHashed(t *testing.T) {
+	for stored, want := range map[string]bool{
+		"$2a$10$abc":     true,
+		"$2b$10$abc":     true,
+		"$2y$10$abc":     true,
+		"$apr1$salt$abc": true,
+		"{SHA}abc":       true,
+		"$1$salt$abc":    false,
+		"plaintext":      false,
+		"":               false,
+	} {
+		if got := isHashed(stored); got != want {
+			t.Errorf("isHashed(%q) = %v, want %v", stored, got, want)
+		}
+	}
+}
+
+func testAuthDb(t *testing.T, lines ...string) *AuthDb {
+	t.Helper()
+	users, err := readAuth(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AuthDb{users: users}
+}
+
+func TestAuthCramMd5(t *testing.T) {
+	db := testAuthDb(t,
+		"tim:tanstaaftanstaaf",
+		"hashed:{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=")
+	// The example from RFC 2195.
+	chal := []byte("<1896.697170952@postoffice.reston.mci.net>")
+	mac := []byte("b913a602c7eda7a495b4e6e7334d3890")
+	if ok, err := authCramMd5(db, "tim", mac, chal); !ok || err != nil {
+		t.Errorf("authCramMd5() = %v, %v, want success", ok, err)
+	}
+	if ok, err := authCramMd5(db, "tim", mac, []byte("<1@example.com>")); ok || err != nil {
+		t.Errorf("authCramMd5() with another challenge = %v, %v, want failure", ok, err)
+	}
+	if ok, err := authCramMd5(db, "nobody", mac, chal); ok || err != nil {
+		t.Errorf("authCramMd5() for an unknown user = %v, %v, want failure", ok, err)
+	}
+	if _, err := authCramMd5(db, "tim", []byte("not hex"), chal); err == nil {
+		t.Error("authCramMd5() accepted a MAC that is not hex")
+	}
+
+	// A hashed password cannot be the shared secret, even if the client
+	// knows the hash.
+	h := hmac.New(md5.New, []byte("{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE="))
+	h.Write(chal)
+	if ok, _ := authCramMd5(db, "hashed", []byte(hex.EncodeToString(h.Sum(nil))), chal); ok {
+		t.Error("authCramMd5() accepted a user with a hashed password")
+	}
+}
+
+func TestCramMd5Login(t *testing.T) {
+	auth := filepath.Join(t.TempDir(), "auth")
+	if err := os.WriteFile(auth, []byte("tim:tanstaaftanstaaf\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTranslator(t, "-auth", auth)
+	for _, tt := range []struct {
+		secret string
+		want   int
+	}{
+		{"tanstaaftanstaaf", 0},
+		{"wrong", 535},
+	} {
+		c, err := netsmtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Auth(netsmtp.CRAMMD5Auth("tim", tt.secret))
+		if code := replyCode(err); code != tt.want || tt.want == 0 && err != nil {
+			t.Errorf("AUTH CRAM-MD5 with secret %q = %v, want code %d", tt.secret, err, tt.want)
+		}
+		c.Close()
+	}
+}
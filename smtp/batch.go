@@ -0,0 +1,75 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Batch delivers APIMessages read from r, one JSON object per line, through the
+// same routing, filters, and queue as the server, and writes a line to w with
+// the status and response for each, as the HTTP API would. It returns once
+// every notification has been delivered or has failed for good, or ctx is
+// done, and reports how many messages could not be queued and how many
+// notifications failed. Batch is used instead of Serve, not alongside it.
+func (t *Translator) Batch(ctx context.Context, r io.Reader, w io.Writer) (failed int, err error) {
+	go func() {
+		t.queue.Run()
+		close(t.drained)
+	}()
+	enc := json.NewEncoder(w)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAPIRequestSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var res apiBatchResult
+		var m APIMessage
+		if err := json.Unmarshal(line, &m); err != nil {
+			res = apiBatchResult{http.StatusBadRequest, apiError{Error: err.Error()}}
+		} else {
+			res.Status, res.Result = t.submit(t.Config(), nil, "", &m)
+		}
+		if res.Status != http.StatusAccepted {
+			failed++
+		}
+		enc.Encode(res)
+	}
+	t.queue.Close()
+	if err := scanner.Err(); err != nil {
+		return failed, err
+	}
+	select {
+	case <-t.drained:
+		return failed + len(t.queue.Dead()), nil
+	case <-ctx.Done():
+		return failed, ctx.Err()
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// Check looks for mistakes that LoadConfig tolerates, such as malformed auth
+// file lines and unusable certificates.
+func (c *Config) Check() (problems []string) {
+	tokens := c.tokens()
+	if token := c.AppToken.Value(); token != "" && !tokens.IsAppToken(token) {
+		problems = append(problems, "the Pushover app token does not match -app-token-pattern (by default, it should begin with \"a\")")
+	}
+	if c.AuthDb != nil {
+		data, err := readSecret(c.AuthDb.Path)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, p := range checkAuth(data, tokens) {
+			problems = append(problems, c.AuthDb.Path+": "+p)
+		}
+	}
+	if len(c.TLSKeyPairs) > 0 {
+		problems = append(problems, checkKeyPairs(c.TLSKeyPairs, c.Hostname, time.Now())...)
+	}
+	if c.PickupDir != "" {
+		if fi, err := os.Stat(c.PickupDir); err != nil {
+			problems = append(problems, err.Error())
+		} else if !fi.IsDir() {
+			problems = append(problems, c.PickupDir+": not a directory")
+		}
+	}
+	if c.Maildir != "" {
+		for _, sub := range []string{"new", "cur"} {
+			dir := filepath.Join(c.Maildir, sub)
+			if fi, err := os.Stat(dir); err != nil {
+				problems = append(problems, err.Error())
+			} else if !fi.IsDir() {
+				problems = append(problems, dir+": not a directory")
+			}
+		}
+	}
+	return
+}
+
+// checkAuth reports the lines of an auth file that readAuth would skip or
+// misinterpret.
+func checkAuth(data string, tokens *parse.Tokens) (problems []string) {
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		problem := func(format string, a ...interface{}) {
+			problems = append(problems, fmt.Sprintf("line %d: ", n)+fmt.Sprintf(format, a...))
+		}
+		split := strings.Split(line, ":")
+		if len(split) < 2 || len(split) > 5 {
+			problem("expected user:password[:apptoken[:senders[:recipients]]], found %d fields", len(split))
+			continue
+		}
+		split = append(split, make([]string, 5-len(split))...)
+		user, password, appToken := split[0], split[1], split[2]
+		if seen[user] {
+			problem("user %q is listed more than once", user)
+		}
+		seen[user] = true
+		if password == "" {
+			problem("user %q has an empty password", user)
+		}
+		if appToken != "" && !tokens.IsAppToken(appToken) {
+			problem("app token %q does not match -app-token-pattern", appToken)
+		}
+		for _, sender := range parseList(split[3], true) {
+			if !strings.Contains(sender, "@") {
+				problem("sender %q should be an address or @domain", sender)
+			}
+		}
+		for _, rcpt := range parseList(split[4], false) {
+			if !tokens.IsUserToken(rcpt) {
+				problem("recipient %q is not a user token matching -user-token-pattern", rcpt)
+			}
+		}
+	}
+	return
+}
+
+// checkKeyPairs reports certificates that are expired or not yet valid, and
+// the absence of any certificate for the server's hostname.
+func checkKeyPairs(kps KeyPairs, hostname string, now time.Time) (problems []string) {
+	covered := false
+	for _, kp := range kps {
+		cert, _ := kp.GetCertificate(nil)
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				problems = append(problems, kp.CertPath+": "+err.Error())
+				continue
+			}
+		}
+		switch {
+		case now.After(leaf.NotAfter):
+			problems = append(problems, fmt.Sprintf("%s: certificate expired on %s", kp.CertPath, leaf.NotAfter.Format(time.RFC1123)))
+		case now.Before(leaf.NotBefore):
+			problems = append(problems, fmt.Sprintf("%s: certificate is not valid until %s", kp.CertPath, leaf.NotBefore.Format(time.RFC1123)))
+		}
+		covered = covered || leaf.VerifyHostname(hostname) == nil
+	}
+	if !covered {
+		problems = append(problems, fmt.Sprintf("no TLS certificate covers the hostname %q (set -hostname)", hostname))
+	}
+	return
+}
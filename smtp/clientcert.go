@@ -0,0 +1,77 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Certificate fields that can supply the username of a client authenticated
+// by its TLS certificate.
+const (
+	CertUserNone  = "none"
+	CertUserCN    = "cn"
+	CertUserEmail = "email"
+	CertUserDNS   = "dns"
+)
+
+// loadClientCAs reads the PEM-encoded certificate authorities that client
+// certificates must be signed by.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+func certUser(cert *x509.Certificate, field string) string {
+	switch field {
+	case CertUserCN:
+		return cert.Subject.CommonName
+	case CertUserEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertUserDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	}
+	return ""
+}
+
+// authenticateCert authenticates a Session whose client presented a valid
+// certificate as the user named in the certificate's field.
+func authenticateCert(s *Session, cs tls.ConnectionState, field string) {
+	if len(cs.VerifiedChains) > 0 {
+		s.setUser(certUser(cs.VerifiedChains[0][0], field))
+	}
+}
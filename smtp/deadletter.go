@@ -0,0 +1,81 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/plugin"
+)
+
+// A deadLetter records a notification that failed for good, in the form that
+// plugins receive, with what went wrong.
+type deadLetter struct {
+	Time  time.Time `json:"time"`
+	Route string    `json:"route"`
+	Error string    `json:"error"`
+	*plugin.Message
+}
+
+// saveDeadLetter writes a notification that failed for good to dir: the
+// original email as id.eml, which can be relayed as is, and a line of JSON describing the notification and its error
+// to id.json. A message with several recipients that failed shares the .eml.
+func saveDeadLetter(dir string, d *notify.Delivery, failure error) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	if len(d.Data) > 0 {
+		f, err := os.OpenFile(filepath.Join(dir, d.ID+".eml"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_, err = f.Write(d.Data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	dl := deadLetter{Time: time.Now(), Route: d.Route.Kind, Message: plugin.NewMessage(d.Envelope)}
+	if failure != nil {
+		dl.Error = failure.Error()
+	}
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, d.ID+".json"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
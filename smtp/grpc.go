@@ -0,0 +1,167 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+//go:generate protoc --go_out=.. --go_opt=module=github.com/YoRyan/smtp-translator --go-grpc_out=.. --go-grpc_opt=module=github.com/YoRyan/smtp-translator submission.proto
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/YoRyan/smtp-translator/smtp/submissionpb"
+)
+
+// grpcService is the path prefix of the methods of the gRPC submission
+// service, which submission.proto describes.
+const grpcService = "/smtptranslator.v1.Submission/"
+
+// grpcCode translates an HTTP API status into a gRPC status code.
+func grpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusOK, http.StatusAccepted:
+		return codes.OK
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// grpcRequestKey is the context key under which each call carries the HTTP
+// request it arrived in.
+type grpcRequestKey struct{}
+
+// grpcHandler serves the gRPC submission service, which takes the same
+// messages and credentials as the HTTP API. gRPC clients connect over HTTP/2
+// without TLS, and present passwords as HTTP basic authentication in their
+// "authorization" metadata.
+func (t *Translator) grpcHandler() http.Handler {
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(maxAPIRequestSize))
+	submissionpb.RegisterSubmissionServer(s, &submissionServer{t: t})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.Config().API {
+			http.NotFound(w, r)
+			return
+		}
+		s.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grpcRequestKey{}, r)))
+	})
+}
+
+// A submissionServer implements the gRPC submission service by handing each
+// message to the Translator as the HTTP API does.
+type submissionServer struct {
+	submissionpb.UnimplementedSubmissionServer
+	t *Translator
+}
+
+// authorize checks the credentials of a call, and returns the configuration to
+// submit its messages under, along with the client's address and user.
+func (s *submissionServer) authorize(ctx context.Context) (c *Config, ip net.IP, user string, err error) {
+	r := ctx.Value(grpcRequestKey{}).(*http.Request)
+	c = s.t.Config()
+	ip, user, code, msg := s.t.authorize(r, c, "")
+	if code != 0 {
+		return nil, nil, "", status.Error(grpcCode(code), msg)
+	}
+	return c, ip, user, nil
+}
+
+// Send implements submissionpb.SubmissionServer.
+func (s *submissionServer) Send(ctx context.Context, m *submissionpb.Message) (*submissionpb.Receipt, error) {
+	c, ip, user, err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	code, v := s.t.submit(c, ip, user, apiMessage(m))
+	res, ok := v.(apiResponse)
+	if !ok {
+		return nil, status.Error(grpcCode(code), v.(apiError).Error)
+	}
+	return receipt(res), nil
+}
+
+// SendBatch implements submissionpb.SubmissionServer.
+func (s *submissionServer) SendBatch(stream submissionpb.Submission_SendBatchServer) error {
+	c, ip, user, err := s.authorize(stream.Context())
+	if err != nil {
+		return err
+	}
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		code, v := s.t.submit(c, ip, user, apiMessage(m))
+		result := new(submissionpb.BatchResult)
+		if res, ok := v.(apiResponse); ok {
+			result.Receipt = receipt(res)
+		} else {
+			result.Code = int32(grpcCode(code))
+			result.Message = v.(apiError).Error
+		}
+		if err := stream.Send(result); err != nil {
+			return err
+		}
+	}
+}
+
+// apiMessage converts a Message of the gRPC service into the form the HTTP API
+// takes.
+func apiMessage(m *submissionpb.Message) *APIMessage {
+	am := &APIMessage{
+		To:     m.GetTo(),
+		From:   m.GetFrom(),
+		Title:  m.GetTitle(),
+		Body:   m.GetBody(),
+		HTML:   m.Html,
+		Retry:  int(m.GetRetry()),
+		Expire: int(m.GetExpire()),
+		Device: m.GetDevice(),
+		Sound:  m.GetSound()}
+	if m.Priority != nil {
+		priority := int(*m.Priority)
+		am.Priority = &priority
+	}
+	return am
+}
+
+// receipt converts the HTTP API's response into a Receipt.
+func receipt(res apiResponse) *submissionpb.Receipt {
+	return &submissionpb.Receipt{Id: res.ID, Queued: int32(res.Queued)}
+}
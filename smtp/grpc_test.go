@@ -0,0 +1,146 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/YoRyan/smtp-translator/smtp/submissionpb"
+)
+
+// submissionClient serves a Translator's HTTP interface over HTTP/2 without
+// TLS and returns a client for its gRPC submission service.
+func submissionClient(t *testing.T, args ...string) submissionpb.SubmissionClient {
+	t.Helper()
+	t.Setenv("PUSHOVER_TOKEN", "azGDORePK8gMaC0QOYAMyEEuzJnyUi")
+	c, err := LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTranslator(c, slog.New(slog.DiscardHandler))
+	srv := httptest.NewUnstartedServer(tr.Handler())
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	conn, err := grpc.NewClient(srv.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return submissionpb.NewSubmissionClient(conn)
+}
+
+const testRecipient = "uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net"
+
+func TestGRPCSend(t *testing.T) {
+	client := submissionClient(t, "-api")
+	for _, tt := range []struct {
+		name string
+		msg  *submissionpb.Message
+		code codes.Code
+	}{
+		{"queued", &submissionpb.Message{To: []string{testRecipient}, Body: "hi"}, codes.OK},
+		{"no body", &submissionpb.Message{To: []string{testRecipient}}, codes.InvalidArgument},
+		{"no recipients", &submissionpb.Message{Body: "hi"}, codes.InvalidArgument},
+		{"undeliverable", &submissionpb.Message{To: []string{"ops@example.com"}, Body: "hi"}, codes.InvalidArgument},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.Send(context.Background(), tt.msg)
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("Send() = %v, want code %v", err, tt.code)
+			}
+			if err == nil && (res.GetId() == "" || res.GetQueued() != 1) {
+				t.Errorf("Send() = %v, want one queued", res)
+			}
+		})
+	}
+}
+
+func TestGRPCSendBatch(t *testing.T) {
+	client := submissionClient(t, "-api")
+	stream, err := client.SendBatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []*submissionpb.Message{
+		{To: []string{testRecipient}, Body: "one"},
+		{To: []string{testRecipient}},
+		{To: []string{testRecipient, testRecipient}, Body: "three"},
+	}
+	for _, m := range msgs {
+		if err := stream.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.CloseSend()
+	var results []*submissionpb.BatchResult
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+	if len(results) != len(msgs) {
+		t.Fatalf("got %d results, want %d", len(results), len(msgs))
+	}
+	if r := results[0]; r.GetCode() != 0 || r.GetReceipt().GetQueued() != 1 {
+		t.Errorf("result 0 = %v, want one queued", r)
+	}
+	if r := results[1]; codes.Code(r.GetCode()) != codes.InvalidArgument || r.GetMessage() != "no body" || r.GetReceipt() != nil {
+		t.Errorf("result 1 = %v, want InvalidArgument", r)
+	}
+	if r := results[2]; r.GetCode() != 0 || r.GetReceipt().GetQueued() != 2 {
+		t.Errorf("result 2 = %v, want two queued", r)
+	}
+}
+
+func TestGRPCDisabled(t *testing.T) {
+	client := submissionClient(t)
+	_, err := client.Send(context.Background(), &submissionpb.Message{To: []string{testRecipient}, Body: "hi"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Send() = %v, want Unimplemented", err)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	client := submissionClient(t, "-api", "-deny", "127.0.0.0/8,::1/128")
+	_, err := client.Send(context.Background(), &submissionpb.Message{To: []string{testRecipient}, Body: "hi"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Send() = %v, want PermissionDenied", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/mattn/go-sqlite3"
+)
+
+// A HistoryRecord describes a notification that was delivered, or that failed.
+type HistoryRecord struct {
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	User      string    `json:"user,omitempty"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Route     string    `json:"route"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// A HistoryQuery selects HistoryRecords. Text is matched case-insensitively
+// against the sender, recipient, subject, and body; From and To against the
+// addresses alone. Zero fields match everything.
+type HistoryQuery struct {
+	Text     string
+	From, To string
+	Since    time.Time
+	Until    time.Time
+	// Limit is the most records to return, newest first.
+	Limit int
+}
+
+// historyDriver is the SQLite driver for histories. It adds the function
+// contains_fold(s, substr), which unlike LIKE folds case beyond ASCII.
+const historyDriver = "sqlite3_history"
+
+func init() {
+	sql.Register(historyDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("contains_fold", containsFold, true)
+		}})
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// historySchema creates the table of records, indexed by when they were made.
+// Times are in nanoseconds since the Unix epoch.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS history (
+	time       INTEGER NOT NULL,
+	id         TEXT NOT NULL DEFAULT '',
+	message_id TEXT NOT NULL DEFAULT '',
+	client     TEXT NOT NULL DEFAULT '',
+	user       TEXT NOT NULL DEFAULT '',
+	sender     TEXT NOT NULL DEFAULT '',
+	recipient  TEXT NOT NULL DEFAULT '',
+	route      TEXT NOT NULL DEFAULT '',
+	subject    TEXT NOT NULL DEFAULT '',
+	body       TEXT NOT NULL DEFAULT '',
+	outcome    TEXT NOT NULL DEFAULT '',
+	error      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS history_time ON history (time);
+`
+
+// historyCompactInterval is how often a History with a Retention drops the
+// records that have outlived it.
+const historyCompactInterval = time.Hour
+
+// A History keeps a searchable record of notifications in a SQLite database.
+// It is safe for concurrent use, and a nil History keeps nothing.
+type History struct {
+	Path string
+	// Bodies is whether the text of each notification is kept as well.
+	Bodies bool
+	// Retention, if positive, is how long records are kept. Older ones are
+	// dropped when the database is opened and hourly after that.
+	Retention time.Duration
+
+	db *sql.DB
+	mu sync.Mutex
+	// compacted is when records were last dropped.
+	compacted time.Time
+}
+
+// OpenHistory opens a history database, creating it if necessary, and drops
+// the records that have outlived the retention.
+func OpenHistory(path string, bodies bool, retention time.Duration) (*History, error) {
+	// Write-ahead logging lets searches run while records are added.
+	db, err := sql.Open(historyDriver, "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	h := &History{Path: path, Bodies: bodies, Retention: retention, db: db}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.compact(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Close closes the database. Records made afterwards are discarded with an
+// error.
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+// Record keeps what became of a Delivery.
+func (h *History) Record(d *notify.Delivery, outcome string, err error) error {
+	if h == nil {
+		return nil
+	}
+	now := time.Now()
+	var body, errText string
+	if h.Bodies {
+		body = d.Body
+	}
+	if err != nil {
+		errText = err.Error()
+	}
+	if _, err := h.db.Exec(`INSERT INTO history
+		(time, id, message_id, client, user, sender, recipient, route, subject, body, outcome, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		now.UnixNano(), d.ID, d.MessageID, d.Client, d.User, d.From.Address, d.Rcpt,
+		d.Route.Kind, d.Subject, body, outcome, errText); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.compacted) >= historyCompactInterval {
+		return h.compact(now)
+	}
+	return nil
+}
+
+// compact deletes the records that are older than the Retention. h.mu must be
+// held.
+func (h *History) compact(now time.Time) error {
+	h.compacted = now
+	if h.Retention <= 0 {
+		return nil
+	}
+	_, err := h.db.Exec("DELETE FROM history WHERE time < ?", now.Add(-h.Retention).UnixNano())
+	return err
+}
+
+// Search returns the records that match q, newest first.
+func (h *History) Search(q HistoryQuery) ([]HistoryRecord, error) {
+	if h == nil {
+		return nil, nil
+	}
+	var (
+		where []string
+		args  []any
+	)
+	if !q.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.From != "" {
+		where = append(where, "contains_fold(sender, ?)")
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		where = append(where, "contains_fold(recipient, ?)")
+		args = append(args, q.To)
+	}
+	if q.Text != "" {
+		where = append(where, "(contains_fold(sender, ?) OR contains_fold(recipient, ?) OR contains_fold(subject, ?) OR contains_fold(body, ?))")
+		args = append(args, q.Text, q.Text, q.Text, q.Text)
+	}
+	query := `SELECT time, id, message_id, client, user, sender, recipient, route, subject, body, outcome, error
+		FROM history`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// Records made in the same nanosecond come back in the order they were
+	// added.
+	query += " ORDER BY time DESC, rowid DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []HistoryRecord
+	for rows.Next() {
+		var (
+			r  HistoryRecord
+			ns int64
+		)
+		if err := rows.Scan(&ns, &r.ID, &r.MessageID, &r.Client, &r.User, &r.From, &r.To,
+			&r.Route, &r.Subject, &r.Body, &r.Outcome, &r.Error); err != nil {
+			return found, err
+		}
+		r.Time = time.Unix(0, ns)
+		found = append(found, r)
+	}
+	return found, rows.Err()
+}
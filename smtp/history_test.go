@@ -0,0 +1,165 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+func historyDelivery(from, rcpt, subject, body string) *notify.Delivery {
+	return &notify.Delivery{
+		Envelope: &parse.Envelope{
+			From:    &parse.Sender{Address: from},
+			To:      &parse.Recipient{},
+			Rcpt:    rcpt,
+			Subject: subject,
+			Body:    body},
+		Route: &notify.Route{Domain: "*", Kind: notify.RoutePushover}}
+}
+
+// subjects returns the subjects of records, in order.
+func subjects(rs []HistoryRecord) []string {
+	var s []string
+	for _, r := range rs {
+		s = append(s, r.Subject)
+	}
+	return s
+}
+
+func TestHistorySearch(t *testing.T) {
+	h, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	start := time.Now()
+	for _, d := range []*notify.Delivery{
+		historyDelivery("backups@home.lan", "ops@pushover.net", "Backup finished", "All done."),
+		historyDelivery("ups@home.lan", "ops@pushover.net", "On battery", "Power failed at ÉTAGE 2."),
+		historyDelivery("backups@home.lan", "me@pushover.net", "Backup failed", "Disk full."),
+	} {
+		if err := h.Record(d, "delivered", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Record(historyDelivery("cron@home.lan", "me@pushover.net", "Job", ""), "failed", errors.New("user is disabled")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		q    HistoryQuery
+		want []string
+	}{
+		{HistoryQuery{}, []string{"Job", "Backup failed", "On battery", "Backup finished"}},
+		{HistoryQuery{Limit: 2}, []string{"Job", "Backup failed"}},
+		{HistoryQuery{Text: "BACKUP"}, []string{"Backup failed", "Backup finished"}},
+		{HistoryQuery{Text: "étage"}, []string{"On battery"}},
+		{HistoryQuery{From: "backups", To: "ops"}, []string{"Backup finished"}},
+		{HistoryQuery{To: "%"}, nil},
+		{HistoryQuery{Since: start}, []string{"Job", "Backup failed", "On battery", "Backup finished"}},
+		{HistoryQuery{Until: start}, nil},
+	} {
+		found, err := h.Search(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := subjects(found); !slices.Equal(got, tt.want) {
+			t.Errorf("Search(%+v) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+
+	found, err := h.Search(HistoryQuery{From: "cron"})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Search() = %v, %v", found, err)
+	}
+	if r := found[0]; r.Outcome != "failed" || r.Error != "user is disabled" || r.Route != notify.RoutePushover || r.Time.Before(start) {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestHistoryBodies(t *testing.T) {
+	h, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Record(historyDelivery("ups@home.lan", "ops@pushover.net", "On battery", "Power failed."), "delivered", nil); err != nil {
+		t.Fatal(err)
+	}
+	found, err := h.Search(HistoryQuery{})
+	if err != nil || len(found) != 1 || found[0].Body != "" {
+		t.Errorf("Search() = %+v, %v, want one record without a body", found, err)
+	}
+	if found, _ := h.Search(HistoryQuery{Text: "power"}); len(found) != 0 {
+		t.Errorf("Search() matched a body that was not kept")
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := OpenHistory(path, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Record(historyDelivery("a@home.lan", "ops@pushover.net", "New", ""), "delivered", nil); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour).UnixNano()
+	if _, err := h.db.Exec("INSERT INTO history (time, subject) VALUES (?, 'Old')", old); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if err := h.Record(historyDelivery("a@home.lan", "ops@pushover.net", "Lost", ""), "delivered", nil); err == nil {
+		t.Error("Record() succeeded after Close()")
+	}
+
+	h, err = OpenHistory(path, false, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	found, err := h.Search(HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subjects(found), []string{"New"}; !slices.Equal(got, want) {
+		t.Errorf("after reopening, records = %q, want %q", got, want)
+	}
+}
+
+func TestNilHistory(t *testing.T) {
+	var h *History
+	if err := h.Record(historyDelivery("a@home.lan", "ops@pushover.net", "Job", ""), "delivered", nil); err != nil {
+		t.Error(err)
+	}
+	if found, err := h.Search(HistoryQuery{}); found != nil || err != nil {
+		t.Errorf("Search() = %v, %v", found, err)
+	}
+}
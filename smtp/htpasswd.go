@@ -0,0 +1,138 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash prefixes understood in htpasswd files, per
+// https://httpd.apache.org/docs/2.4/misc/password_encryptions.html
+const (
+	apr1Prefix = "$apr1$"
+	sha1Prefix = "{SHA}"
+)
+
+// isHashed reports whether an auth file password is one of the htpasswd hash
+// formats rather than a plaintext password.
+func isHashed(stored string) bool {
+	return isBcrypt(stored) ||
+		strings.HasPrefix(stored, apr1Prefix) ||
+		strings.HasPrefix(stored, sha1Prefix)
+}
+
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares a submitted password with a stored one, which may be
+// plaintext or any of the supported htpasswd hashes.
+func checkPassword(stored, pw string) bool {
+	switch {
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pw)) == nil
+	case strings.HasPrefix(stored, apr1Prefix):
+		salt := strings.SplitN(stored[len(apr1Prefix):], "$", 2)[0]
+		return constantTimeEqual(stored, apr1(pw, salt))
+	case strings.HasPrefix(stored, sha1Prefix):
+		sum := sha1.Sum([]byte(pw))
+		return constantTimeEqual(stored, sha1Prefix+base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return constantTimeEqual(stored, pw)
+	}
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// apr1 implements Apache's variant of the MD5-based crypt(3) algorithm, which
+// htpasswd uses by default for non-bcrypt passwords.
+func apr1(pw, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	h := md5.New()
+	h.Write([]byte(pw + apr1Prefix + salt))
+	alt := md5.Sum([]byte(pw + salt + pw))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte{pw[0]})
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 == 1 {
+			r.Write([]byte(pw))
+		} else {
+			r.Write(final)
+		}
+		if i%3 != 0 {
+			r.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			r.Write([]byte(pw))
+		}
+		if i&1 == 1 {
+			r.Write(final)
+		} else {
+			r.Write([]byte(pw))
+		}
+		final = r.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return apr1Prefix + salt + "$" + out.String()
+}
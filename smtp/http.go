@@ -0,0 +1,175 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// QueueStuckAfter is how long the queue can spend on a single notification,
+// retries included, before the Translator stops reporting itself ready.
+const QueueStuckAfter = 5 * time.Minute
+
+// Handler returns the Translator's HTTP interface, which serves health checks
+// for load balancers and orchestrators:
+//
+//	/healthz  the process is running
+//	/readyz   SMTP connections are being accepted, the servers that
+//	          notifications are delivered to can be reached, and the queue is
+//	          not stuck
+//
+// Each responds with 200 OK, or 503 Service Unavailable and the reasons.
+// /debug/vars serves the Translator's counters under "smtp_translator", in the
+// form of expvar's handler. If the configuration keeps Stats, /stats serves
+// them as JSON, and if it enables Pprof and has an AdminToken, net/http/pprof's
+// profiles are served under /debug/pprof/. If it enables the API,
+// notifications can be submitted to /api/v1/messages or to the gRPC service in
+// submission.proto, and if it has an AdminToken, the queue can be managed under
+// /admin/.
+func (t *Translator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if problems := t.ready(); len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/api/v1/messages", t.serveAPI)
+	mux.Handle("POST "+grpcService, t.grpcHandler())
+	mux.HandleFunc("POST /api/v1/webhooks/{name}", t.serveWebhook)
+	t.handleAdmin(mux)
+	mux.HandleFunc("/debug/vars", t.serveVars)
+	mux.HandleFunc("/debug/info", t.serveInfo)
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := t.Config().Stats
+		if stats == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.Counts())
+	})
+	mux.Handle("/debug/pprof/", t.ifPprof(pprof.Index))
+	mux.Handle("/debug/pprof/cmdline", t.ifPprof(pprof.Cmdline))
+	mux.Handle("/debug/pprof/profile", t.ifPprof(pprof.Profile))
+	mux.Handle("/debug/pprof/symbol", t.ifPprof(pprof.Symbol))
+	mux.Handle("/debug/pprof/trace", t.ifPprof(pprof.Trace))
+	return mux
+}
+
+// newVars creates the Translator's counters. They are not published with
+// expvar.Publish, which would keep more than one Translator from running in the
+// same process.
+func (t *Translator) newVars() *expvar.Map {
+	vars := new(expvar.Map)
+	for _, name := range []string{"accepted", AuditRejected, AuditDropped, AuditDeferred, AuditDelivered, AuditFailed} {
+		vars.Add(name, 0)
+	}
+	vars.Set("queue_length", expvar.Func(func() interface{} {
+		return t.queue.Len()
+	}))
+	vars.Set("connections", expvar.Func(func() interface{} {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return len(t.conns)
+	}))
+	return vars
+}
+
+// serveVars writes the Translator's counters in the same form as
+// expvar.Handler. The variables expvar publishes by default are left out,
+// because "cmdline" would reveal any secrets passed as flags.
+func (t *Translator) serveVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n%q: %s\n}\n", "smtp_translator", t.vars)
+}
+
+// ifPprof serves h only while the configuration enables Pprof, so that it can
+// be switched on and off by reloading, and only to requests that carry the
+// admin token, since profiles reveal the command line and are costly to take.
+func (t *Translator) ifPprof(h http.HandlerFunc) http.Handler {
+	admin := t.ifAdmin(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.Config().Pprof {
+			http.NotFound(w, r)
+			return
+		}
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// ready returns the reasons the Translator cannot do its job, if any.
+func (t *Translator) ready() (problems []string) {
+	t.mu.Lock()
+	listening := t.ln != nil && !t.closing
+	c := t.config
+	t.mu.Unlock()
+	if !listening {
+		problems = append(problems, "not accepting connections")
+	}
+	if t.queue.Standby() {
+		problems = append(problems, "standing by for another instance")
+	}
+	if err := c.Routes.Ping(); err != nil {
+		problems = append(problems, "cannot reach "+err.Error())
+	}
+	for _, tn := range c.Tenants.All() {
+		if tn.Routes == nil {
+			continue
+		}
+		if err := tn.Routes.Ping(); err != nil {
+			problems = append(problems, "cannot reach "+err.Error()+" for tenant "+tn.Name)
+		}
+	}
+	if busy := t.queue.Busy(); busy > QueueStuckAfter {
+		problems = append(problems, fmt.Sprintf("queue stuck on one notification for %v (%d waiting)",
+			busy.Round(time.Second), t.queue.Len()))
+	}
+	return
+}
+
+// serveHTTP serves the HTTP interface on ln, or if it is nil, on srv.Addr,
+// until srv is shut down.
+func (t *Translator) serveHTTP(srv *http.Server, ln net.Listener) {
+	var err error
+	if ln != nil {
+		err = srv.Serve(ln)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		t.logger.Error("error serving HTTP", "err", err)
+	}
+}
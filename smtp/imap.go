@@ -0,0 +1,342 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// imapTimeout bounds connecting to the IMAP server and each command.
+const imapTimeout = 30 * time.Second
+
+// imapPollInterval is how often the mailbox is checked for new messages if the
+// server does not support IDLE.
+const imapPollInterval = time.Minute
+
+// imapIdleTimeout is how long each IDLE command waits for new messages before
+// it is issued again. RFC 2177 asks clients to do so at least every 29
+// minutes.
+const imapIdleTimeout = 10 * time.Minute
+
+// imapRetryInterval is how long the poller waits after an error before
+// connecting again.
+const imapRetryInterval = time.Minute
+
+// imapMaxSize bounds the size of a message fetched from the server. Larger
+// ones are marked read without being delivered.
+const imapMaxSize = 64 << 20
+
+// errIMAPClosed reports that the connection was closed because the Translator
+// is shutting down or standing by.
+var errIMAPClosed = errors.New("imap: connection closed")
+
+// parseIMAPURL parses and checks an -imap URL, and returns it with the mailbox
+// it names and the recipients to deliver its messages to.
+func parseIMAPURL(rawURL string) (u *url.URL, mailbox string, to []string, err error) {
+	u, err = url.Parse(rawURL)
+	switch {
+	case err != nil:
+		return nil, "", nil, err
+	case u.Scheme != "imap" && u.Scheme != "imaps":
+		return nil, "", nil, errors.New("not an imap:// or imaps:// URL")
+	case u.Hostname() == "":
+		return nil, "", nil, errors.New("no server")
+	case u.User == nil:
+		return nil, "", nil, errors.New("no username")
+	}
+	if to = urlRecipients(u); len(to) == 0 {
+		return nil, "", nil, errors.New("no recipients")
+	}
+	mailbox = strings.TrimPrefix(u.Path, "/")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	return u, mailbox, to, nil
+}
+
+// urlRecipients returns the comma-separated addresses in the to parameter of
+// a mailbox URL.
+func urlRecipients(u *url.URL) []string {
+	var to []string
+	for _, rcpt := range strings.Split(u.Query().Get("to"), ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			to = append(to, rcpt)
+		}
+	}
+	return to
+}
+
+// dialIMAP connects and logs in to the server at an -imap URL, and selects
+// the mailbox it names. With imap://, the connection is upgraded with
+// STARTTLS if the server offers it. Closing the net.Conn returned interrupts
+// whatever the client is doing.
+func dialIMAP(u *url.URL, mailbox string, logger *slog.Logger) (*client.Client, net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "imaps" {
+			addr = net.JoinHostPort(u.Hostname(), "993")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "143")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, imapTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("imap: %v", err)
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname()}
+	if u.Scheme == "imaps" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	c, err := client.New(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("imap: %v", err)
+	}
+	c.Timeout = imapTimeout
+	c.ErrorLog = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	if err := openIMAP(c, u, mailbox, tlsConfig); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("imap: %v", err)
+	}
+	return c, conn, nil
+}
+
+// openIMAP logs in and selects mailbox.
+func openIMAP(c *client.Client, u *url.URL, mailbox string, tlsConfig *tls.Config) error {
+	if u.Scheme == "imap" {
+		if ok, err := c.SupportStartTLS(); err != nil {
+			return err
+		} else if ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if c.State() == imap.NotAuthenticatedState {
+		password, _ := u.User.Password()
+		if err := c.Login(u.User.Username(), password); err != nil {
+			return err
+		}
+	}
+	_, err := c.Select(mailbox, false)
+	return err
+}
+
+// pollIMAP delivers the unread messages in the mailbox at an -imap URL to the
+// recipients it names, and marks them read, until the Translator shuts down.
+// A standby instance polls nothing.
+func (t *Translator) pollIMAP(rawURL string) {
+	for {
+		if !t.queue.Standby() {
+			if err := t.serveIMAP(rawURL); err != errIMAPClosed {
+				t.logger.Error("error polling IMAP", "err", err)
+			}
+		}
+		select {
+		case <-time.After(imapRetryInterval):
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// serveIMAP connects to the IMAP server and delivers the unread messages in
+// the mailbox as they arrive, until the connection fails, the Translator shuts
+// down, or it becomes a standby.
+func (t *Translator) serveIMAP(rawURL string) error {
+	u, mailbox, to, err := parseIMAPURL(rawURL)
+	if err != nil {
+		return err
+	}
+	c, conn, err := dialIMAP(u, mailbox, t.logger)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer c.Logout()
+	// The client blocks until its updates are read, so read them all
+	// and keep only the news that messages have arrived.
+	updates := make(chan client.Update, 16)
+	arrived := make(chan struct{}, 1)
+	c.Updates = updates
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); !ok {
+					continue
+				}
+				select {
+				case arrived <- struct{}{}:
+				default:
+				}
+			case <-c.LoggedOut():
+				return
+			}
+		}
+	}()
+	defer t.closeWhenPausing(conn)()
+	for {
+		err := t.pollMailbox(c, to)
+		if err == nil {
+			err = waitIMAP(c, arrived, t.stopping)
+		}
+		if t.pausing() {
+			return errIMAPClosed
+		} else if err != nil {
+			return fmt.Errorf("imap: %v", err)
+		}
+	}
+}
+
+// waitIMAP waits with IDLE, or by polling if the server does not support it,
+// until new messages arrive or stop is closed.
+func waitIMAP(c *client.Client, arrived, stop <-chan struct{}) error {
+	stopIdle := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stopIdle, &client.IdleOptions{
+			LogoutTimeout: imapIdleTimeout,
+			PollInterval:  imapPollInterval})
+	}()
+	select {
+	case <-arrived:
+	case <-stop:
+	case err := <-done:
+		return err
+	}
+	close(stopIdle)
+	return <-done
+}
+
+// pollMailbox delivers the unread messages in the mailbox and marks them read.
+func (t *Translator) pollMailbox(c *client.Client, to []string) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+	unseen := new(imap.SeqSet)
+	unseen.AddNum(uids...)
+	sizes := make(map[uint32]uint32)
+	ch := make(chan *imap.Message, len(uids))
+	if err := c.UidFetch(unseen, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}, ch); err != nil {
+		return err
+	}
+	for msg := range ch {
+		sizes[msg.Uid] = msg.Size
+	}
+	for _, uid := range uids {
+		logger := t.logger.With("uid", uid)
+		if size, ok := sizes[uid]; !ok {
+			continue
+		} else if size > imapMaxSize {
+			logger.Warn("message too large", "size", size)
+		} else {
+			data, err := fetchIMAP(c, uid)
+			if err != nil {
+				return err
+			}
+			if !t.mailboxMessage(logger, data, to) {
+				return errIMAPClosed
+			}
+		}
+		seen := new(imap.SeqSet)
+		seen.AddNum(uid)
+		if err := c.UidStore(seen, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.SeenFlag}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchIMAP returns a message without marking it read.
+func fetchIMAP(c *client.Client, uid uint32) ([]byte, error) {
+	section := &imap.BodySectionName{Peek: true}
+	set := new(imap.SeqSet)
+	set.AddNum(uid)
+	ch := make(chan *imap.Message, 1)
+	if err := c.UidFetch(set, []imap.FetchItem{section.FetchItem()}, ch); err != nil {
+		return nil, err
+	}
+	msg := <-ch
+	if msg == nil {
+		return nil, fmt.Errorf("message %d is gone", uid)
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("no body for message %d", uid)
+	}
+	return io.ReadAll(body)
+}
+
+// mailboxMessage delivers a message from an IMAP or POP3 mailbox to the
+// recipients named by its URL, from the address in its From: header. It
+// returns false once the Translator is shutting down.
+func (t *Translator) mailboxMessage(logger *slog.Logger, data []byte, to []string) bool {
+	if !t.tryStartHandling() {
+		return false
+	}
+	defer t.doneHandling()
+
+	c := t.Config()
+	from := "smtp-translator@" + c.Hostname
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			from = addr.Address
+		}
+	}
+	var rcpts []string
+	for _, rcpt := range to {
+		if c.deliverable(from, rcpt) {
+			rcpts = append(rcpts, rcpt)
+		} else {
+			logger.Warn("bad address", "to", rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		logger.Warn("no deliverable recipients")
+		return true
+	}
+	s := &Session{Addr: localAddr, ID: nextSessionID.Add(1)}
+	if t.handleMessage(c, s, from, rcpts, data) == AccessMalformed {
+		logger.Warn("malformed message")
+	}
+	return true
+}
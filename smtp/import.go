@@ -0,0 +1,105 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"net/mail"
+)
+
+// An ImportedMessage is an email read back from an mbox or maildir, to be
+// delivered again.
+type ImportedMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// ParseImported reads the sender and recipients of an archived email. The
+// recipients are taken from its X-Original-To: headers, which the admin API's
+// export adds, and which are then removed; failing those, from its To:, Cc:,
+// and Bcc: headers. The sender is taken from its Return-Path: header, or its
+// From: header.
+func ParseImported(data []byte) (*ImportedMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	m := &ImportedMessage{Data: data}
+	for _, key := range []string{"Return-Path", "From"} {
+		if addr, err := mail.ParseAddress(msg.Header.Get(key)); err == nil {
+			m.From = addr.Address
+			break
+		}
+	}
+	if to := msg.Header["X-Original-To"]; len(to) > 0 {
+		for _, s := range to {
+			if addr, err := mail.ParseAddress(s); err == nil {
+				m.To = append(m.To, addr.Address)
+			}
+		}
+		m.Data = removeHeader(data, "X-Original-To")
+		return m, nil
+	}
+	m.To, m.Data, err = HeaderRecipients(data)
+	return m, err
+}
+
+// Import delivers each of msgs through the same routing, filters, and queue as
+// messages received over SMTP. It returns once every notification has been
+// delivered or has failed for good, or ctx is done, and reports the recipients
+// that have no route, how many messages could not be parsed, and how many
+// notifications failed. Like Batch, Import is used instead of Serve.
+func (t *Translator) Import(ctx context.Context, msgs iter.Seq[*ImportedMessage]) (refused []string, malformed, failed int, err error) {
+	go func() {
+		t.queue.Run()
+		close(t.drained)
+	}()
+	c := t.Config()
+	for m := range msgs {
+		var rcpts []string
+		for _, rcpt := range m.To {
+			if c.deliverable(m.From, rcpt) {
+				rcpts = append(rcpts, rcpt)
+			} else {
+				refused = append(refused, rcpt)
+			}
+		}
+		if len(rcpts) == 0 {
+			continue
+		}
+		s := &Session{Addr: localAddr, ID: nextSessionID.Add(1)}
+		if t.handleMessage(c, s, m.From, rcpts, m.Data) == AccessMalformed {
+			malformed++
+		}
+	}
+	t.queue.Close()
+	select {
+	case <-t.drained:
+		return refused, malformed, len(t.queue.Dead()), nil
+	case <-ctx.Done():
+		return refused, malformed, 0, ctx.Err()
+	}
+}
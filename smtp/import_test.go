@@ -0,0 +1,75 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseImported(t *testing.T) {
+	for _, tt := range []struct {
+		data     string
+		from     string
+		to       []string
+		stripped string
+	}{
+		{"Return-Path: <bounce@example.com>\r\nFrom: NAS <nas@example.com>\r\nX-Original-To: a@pushover.net\r\nX-Original-To: b@pushover.net\r\nTo: c@pushover.net\r\nSubject: hi\r\n\r\nbody\r\n",
+			"bounce@example.com", []string{"a@pushover.net", "b@pushover.net"}, "X-Original-To"},
+		{"From: NAS <nas@example.com>\r\nTo: a@pushover.net, B <b@pushover.net>\r\nBcc: c@pushover.net\r\n\r\nbody\r\n",
+			"nas@example.com", []string{"a@pushover.net", "b@pushover.net", "c@pushover.net"}, "Bcc"},
+		{"Subject: no addresses\r\n\r\nbody\r\n", "", nil, ""},
+	} {
+		m, err := ParseImported([]byte(tt.data))
+		if err != nil {
+			t.Errorf("ParseImported(%q): %v", tt.data, err)
+			continue
+		}
+		if m.From != tt.from || !slices.Equal(m.To, tt.to) {
+			t.Errorf("ParseImported(%q) = %q, %q, want %q, %q", tt.data, m.From, m.To, tt.from, tt.to)
+		}
+		if tt.stripped != "" && strings.Contains(string(m.Data), tt.stripped+":") {
+			t.Errorf("ParseImported(%q) kept the %s header:\n%s", tt.data, tt.stripped, m.Data)
+		}
+		if !strings.HasSuffix(string(m.Data), "\r\n\r\nbody\r\n") {
+			t.Errorf("ParseImported(%q) changed the body:\n%s", tt.data, m.Data)
+		}
+	}
+	if _, err := ParseImported([]byte("not a header\r\n")); err == nil {
+		t.Error("ParseImported() accepted a message without headers")
+	}
+}
+
+func TestHeloOf(t *testing.T) {
+	for data, want := range map[string]string{
+		"Received: from client.example (unknown [192.0.2.1])\r\n  by mx with SMTP;\r\nSubject: x\r\n": "client.example",
+		"Received: from [192.0.2.1] (unknown [192.0.2.1])\r\n":                                        "[192.0.2.1]",
+		"Subject: no Received header\r\n":                                                             "",
+		"":                                                                                            "",
+	} {
+		if got := heloOf([]byte(data)); got != want {
+			t.Errorf("heloOf(%q) = %q, want %q", data, got, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Version is the release of SMTP Translator, set at link time with
+// -ldflags "-X github.com/YoRyan/smtp-translator/smtp.Version=v1.2.3". If it is
+// empty, the module version recorded by the Go toolchain is reported instead.
+var Version string
+
+// BuildInfo describes the binary that is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+
+	// Settings are the build settings other than the version control ones,
+	// such as -tags and CGO_ENABLED.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// ReadBuildInfo returns the BuildInfo of the running binary.
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		case "vcs":
+		default:
+			if s.Value == "" {
+				continue
+			}
+			if info.Settings == nil {
+				info.Settings = make(map[string]string)
+			}
+			info.Settings[s.Key] = s.Value
+		}
+	}
+	return info
+}
+
+// debugInfo is the document served at /debug/info.
+type debugInfo struct {
+	Build     BuildInfo         `json:"build"`
+	Started   time.Time         `json:"started"`
+	Uptime    string            `json:"uptime"`
+	Listeners []infoListener    `json:"listeners"`
+	Backends  infoBackends      `json:"backends"`
+	Config    map[string]string `json:"config,omitempty"`
+}
+
+// An infoListener is an address the server accepts connections on.
+type infoListener struct {
+	Protocol string `json:"protocol"`
+	Addr     string `json:"addr"`
+	TLS      string `json:"tls,omitempty"`
+}
+
+// infoBackends lists what the current configuration has loaded.
+type infoBackends struct {
+	Auth     []string `json:"auth,omitempty"`
+	Spam     string   `json:"spam,omitempty"`
+	Routes   []string `json:"routes,omitempty"`
+	Filters  []string `json:"filters,omitempty"`
+	Script   string   `json:"script,omitempty"`
+	Rules    bool     `json:"rules,omitempty"`
+	Webhooks []string `json:"webhooks,omitempty"`
+	Tenants  []string `json:"tenants,omitempty"`
+	DKIM     bool     `json:"dkim,omitempty"`
+	Queue    string   `json:"queue,omitempty"`
+	Leader   string   `json:"leader_lock,omitempty"`
+	Kafka    string   `json:"kafka,omitempty"`
+	AMQP     string   `json:"amqp,omitempty"`
+	IMAP     string   `json:"imap,omitempty"`
+	POP3     string   `json:"pop3,omitempty"`
+}
+
+// serveInfo describes the running binary, its listeners, and its backends.
+// The effective configuration is included only for requests that carry the
+// admin token.
+func (t *Translator) serveInfo(w http.ResponseWriter, r *http.Request) {
+	c := t.Config()
+	info := debugInfo{
+		Build:    ReadBuildInfo(),
+		Started:  t.started,
+		Uptime:   time.Since(t.started).Round(time.Second).String(),
+		Backends: c.backends()}
+	t.mu.Lock()
+	ln := t.ln
+	t.mu.Unlock()
+	if ln != nil {
+		l := infoListener{Protocol: "smtp", Addr: ln.Addr().String()}
+		switch {
+		case c.tlsListener():
+			l.TLS = "implicit"
+		case c.StarttlsReq:
+			l.TLS = "starttls-required"
+		case c.Starttls:
+			l.TLS = "starttls"
+		}
+		info.Listeners = append(info.Listeners, l)
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		info.Listeners = append(info.Listeners, infoListener{Protocol: "http", Addr: addr.String()})
+	}
+	if t.isAdmin(r) {
+		info.Config = c.Effective
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// isAdmin reports whether r carries the admin token, as a bearer token or a
+// Basic password.
+func (t *Translator) isAdmin(r *http.Request) bool {
+	token := t.Config().AdminToken.Value()
+	if token == "" {
+		return false
+	}
+	given := []byte(r.Header.Get("Authorization"))
+	if _, pw, ok := r.BasicAuth(); ok {
+		given = []byte("Bearer " + pw)
+	}
+	return subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) == 1
+}
+
+// backends describes the backends c has loaded, without their secrets.
+func (c *Config) backends() infoBackends {
+	var b infoBackends
+	if c.AuthDb != nil {
+		b.Auth = append(b.Auth, "file "+c.AuthDb.Path)
+	}
+	for _, be := range c.AuthBackends {
+		if s, ok := be.(fmt.Stringer); ok {
+			b.Auth = append(b.Auth, s.String())
+		} else {
+			b.Auth = append(b.Auth, fmt.Sprintf("%T", be))
+		}
+	}
+	switch s := c.SpamFilter.(type) {
+	case *Spamd:
+		b.Spam = "spamd " + s.Addr
+	case *Rspamd:
+		b.Spam = "rspamd " + s.URL
+	}
+	for _, r := range c.Routes {
+		route := r.Domain + "=" + r.Kind
+		if r.Target != "" {
+			route += ":" + routePasswordRe.ReplaceAllString(r.Target, "${1}xxxxx@")
+		}
+		b.Routes = append(b.Routes, route)
+	}
+	b.Filters = c.Filters
+	if c.Script != nil {
+		b.Script = c.Script.Path
+	}
+	b.Rules = c.Rules != nil
+	for name := range c.Webhooks {
+		b.Webhooks = append(b.Webhooks, name)
+	}
+	sort.Strings(b.Webhooks)
+	for _, tenant := range c.Tenants.All() {
+		b.Tenants = append(b.Tenants, tenant.Name)
+	}
+	b.DKIM = c.DKIM != nil
+	if c.QueueDir != "" {
+		b.Queue = c.QueueDir + " as " + c.Instance
+	} else if u, err := url.Parse(c.QueueRedis); err == nil && c.QueueRedis != "" {
+		b.Queue = u.Redacted() + " as " + c.Instance
+	} else if u, err := url.Parse(c.QueueNATS); err == nil && c.QueueNATS != "" {
+		b.Queue = u.Redacted()
+		if !c.Deliver {
+			b.Queue += " (publish only)"
+		}
+	}
+	if c.LeaderLock != "" {
+		b.Leader = c.LeaderLock + " as " + c.Instance
+	}
+	if u, err := url.Parse(c.Kafka); err == nil && c.Kafka != "" {
+		b.Kafka = u.Redacted()
+	}
+	if u, err := url.Parse(c.AMQP); err == nil && c.AMQP != "" {
+		b.AMQP = u.Redacted()
+	}
+	if u, err := url.Parse(c.IMAP); err == nil && c.IMAP != "" {
+		b.IMAP = u.Redacted()
+	}
+	if u, err := url.Parse(c.POP3); err == nil && c.POP3 != "" {
+		b.POP3 = u.Redacted()
+	}
+	return b
+}
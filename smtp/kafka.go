@@ -0,0 +1,211 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	_ "github.com/segmentio/kafka-go/gzip" // Accept gzip-compressed messages.
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// kafkaClientID identifies the consumer to brokers.
+const kafkaClientID = "smtp-translator"
+
+// kafkaDefaultGroup is the consumer group that instances join if the -kafka
+// URL does not name one.
+const kafkaDefaultGroup = "smtp-translator"
+
+// kafkaTimeout bounds connecting to a broker.
+const kafkaTimeout = 10 * time.Second
+
+// kafkaRetryInterval is how long the consumer waits after an error, or while
+// the instance is on standby, before joining the group again.
+const kafkaRetryInterval = 5 * time.Second
+
+// kafkaMaxBytes bounds the messages each fetch returns for a partition.
+const kafkaMaxBytes = 1 << 20
+
+// errKafkaRetry stops the consumer from moving past a message that should be
+// consumed again later.
+var errKafkaRetry = errors.New("message not queued")
+
+// parseKafkaURL parses and checks a -kafka URL.
+func parseKafkaURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	switch {
+	case err != nil:
+		return nil, err
+	case u.Scheme != "kafka" && u.Scheme != "kafka+tls":
+		return nil, errors.New("not a kafka:// or kafka+tls:// URL")
+	case u.Host == "":
+		return nil, errors.New("no broker")
+	case strings.Trim(u.Path, "/") == "":
+		return nil, errors.New("no topic")
+	}
+	return u, nil
+}
+
+// kafkaReaderConfig returns the configuration of a consumer of the topic at a
+// -kafka URL. Offsets are committed as each message is queued, and a group
+// that has not consumed the topic before starts with the messages published
+// after it first joins.
+func kafkaReaderConfig(rawURL string) (kafka.ReaderConfig, error) {
+	u, err := parseKafkaURL(rawURL)
+	if err != nil {
+		return kafka.ReaderConfig{}, err
+	}
+	group := u.Query().Get("group")
+	if group == "" {
+		group = kafkaDefaultGroup
+	}
+	dialer := &kafka.Dialer{
+		ClientID:  kafkaClientID,
+		Timeout:   kafkaTimeout,
+		DualStack: true}
+	if u.Scheme == "kafka+tls" {
+		dialer.TLS = new(tls.Config)
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		dialer.SASLMechanism = plain.Mechanism{Username: u.User.Username(), Password: password}
+	}
+	return kafka.ReaderConfig{
+		Brokers:     []string{u.Host},
+		GroupID:     group,
+		Topic:       strings.Trim(u.Path, "/"),
+		Dialer:      dialer,
+		MaxBytes:    kafkaMaxBytes,
+		StartOffset: kafka.LastOffset}, nil
+}
+
+// consumeKafka consumes notifications from the Kafka topic at a -kafka URL
+// until the Translator shuts down. Each message is an APIMessage, which is
+// routed, filtered, and queued like one submitted to the HTTP API. Instances
+// that share a group split the topic's partitions between them, and a standby
+// instance leaves the group until it takes over.
+func (t *Translator) consumeKafka(rawURL string) {
+	config, err := kafkaReaderConfig(rawURL)
+	if err != nil {
+		t.logger.Error("bad Kafka URL", "err", err)
+		return
+	}
+	logger := t.logger.With("topic", config.Topic, "group", config.GroupID)
+	config.ErrorLogger = kafka.LoggerFunc(func(format string, args ...any) {
+		logger.Warn("Kafka consumer error", "err", fmt.Sprintf(format, args...))
+	})
+	for {
+		if !t.queue.Standby() {
+			if err := t.readKafka(config); err != nil && err != errKafkaRetry {
+				logger.Error("error consuming from Kafka", "err", err)
+			}
+		}
+		select {
+		case <-time.After(kafkaRetryInterval):
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// readKafka joins the consumer group and queues the messages of the partitions
+// it is assigned, until the Translator shuts down or stands by, or a message
+// cannot be queued. The group is left on return, so that the next member to
+// read the partition of a message that was not queued starts over with it.
+func (t *Translator) readKafka(config kafka.ReaderConfig) error {
+	r := kafka.NewReader(config)
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(kafkaRetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !t.queue.Standby() {
+					continue
+				}
+			case <-t.stopping:
+			case <-ctx.Done():
+			}
+			cancel()
+			return
+		}
+	}()
+	for {
+		m, err := r.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := t.kafkaMessage(m); err != nil {
+			return err
+		}
+		// Commit even if the Translator is shutting down, now that the
+		// message is queued.
+		commitCtx, cancelCommit := context.WithTimeout(context.Background(), kafkaTimeout)
+		err = r.CommitMessages(commitCtx, m)
+		cancelCommit()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// kafkaMessage queues the notification in a message consumed from Kafka. It
+// returns an error if the message should be consumed again later, because the
+// Translator is shutting down or could not queue it; malformed and
+// undeliverable messages are logged and skipped.
+func (t *Translator) kafkaMessage(msg kafka.Message) error {
+	if !t.tryStartHandling() {
+		return errKafkaRetry
+	}
+	defer t.doneHandling()
+
+	logger := t.logger.With("partition", msg.Partition, "offset", msg.Offset)
+	var m APIMessage
+	if err := json.Unmarshal(msg.Value, &m); err != nil {
+		logger.Warn("malformed Kafka message", "err", err)
+		return nil
+	}
+	status, v := t.submit(t.Config(), nil, "", &m)
+	switch {
+	case status == http.StatusServiceUnavailable:
+		logger.Error("could not queue Kafka message", "err", v.(apiError).Error)
+		return errKafkaRetry
+	case status >= http.StatusBadRequest:
+		logger.Warn("rejected Kafka message", "err", v.(apiError).Error)
+	}
+	return nil
+}
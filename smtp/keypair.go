@@ -0,0 +1,167 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPairPollInterval is how often a KeyPair's files are checked for changes.
+const keyPairPollInterval = time.Minute
+
+// A KeyPair holds the server's TLS certificate and private key. It is safe for
+// concurrent use and can be reloaded while the server runs, so that renewed
+// certificates take effect without a restart.
+type KeyPair struct {
+	CertPath string
+	KeyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// LoadKeyPair reads a PEM-encoded certificate and private key from disk.
+func LoadKeyPair(certPath, keyPath string) (*KeyPair, error) {
+	kp := &KeyPair{CertPath: certPath, KeyPath: keyPath}
+	if err := kp.Reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// Reload rereads the certificate and key. If they cannot be loaded, the
+// previous pair remains in effect.
+func (kp *KeyPair) Reload() error {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.CertPath, kp.KeyPath)
+	if err != nil {
+		return err
+	}
+	kp.mu.Lock()
+	kp.cert = &cert
+	kp.modTime = modTime
+	kp.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate. Its signature matches
+// tls.Config.GetCertificate.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert, nil
+}
+
+// KeyPairs is a set of certificates served on the same listener. The
+// certificate for each connection is selected by the server name the client
+// requests (SNI), falling back to the first.
+type KeyPairs []*KeyPair
+
+// loadKeyPairs loads certificates and keys from comma-separated lists of
+// paths, paired in order.
+func loadKeyPairs(certPaths, keyPaths string) (KeyPairs, error) {
+	certs, keys := strings.Split(certPaths, ","), strings.Split(keyPaths, ",")
+	if len(certs) != len(keys) {
+		return nil, errors.New("must specify as many TLS keys as certificates")
+	}
+	var kps KeyPairs
+	for i := range certs {
+		kp, err := LoadKeyPair(strings.TrimSpace(certs[i]), strings.TrimSpace(keys[i]))
+		if err != nil {
+			return nil, err
+		}
+		kps = append(kps, kp)
+	}
+	return kps, nil
+}
+
+// GetCertificate returns the first certificate that suits the client. Its
+// signature matches tls.Config.GetCertificate.
+func (kps KeyPairs) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, kp := range kps {
+		cert, _ := kp.GetCertificate(hello)
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return kps[0].GetCertificate(hello)
+}
+
+// Changed reports whether either file has been modified since the pair was
+// last loaded.
+func (kp *KeyPair) Changed() bool {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return false
+	}
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return !modTime.Equal(kp.modTime)
+}
+
+// lastModified returns the later of the two files' modification times.
+func (kp *KeyPair) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{kp.CertPath, kp.KeyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// WatchKeyPairs reloads each KeyPair whenever its files change, such as when
+// certbot renews the certificate. It watches whichever KeyPairs the current
+// configuration holds.
+func WatchKeyPairs(current func() *Config, logger *slog.Logger) {
+	logger = logger.With("component", "tls")
+	for range time.Tick(keyPairPollInterval) {
+		for _, kp := range current().TLSKeyPairs {
+			if kp.Changed() {
+				reloadKeyPair(kp, logger)
+			}
+		}
+	}
+}
+
+func reloadKeyPair(kp *KeyPair, logger *slog.Logger) {
+	if err := kp.Reload(); err != nil {
+		logger.Error("error reloading TLS certificate", "path", kp.CertPath, "err", err)
+	} else {
+		logger.Info("reloaded TLS certificate", "path", kp.CertPath)
+	}
+}
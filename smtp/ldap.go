@@ -0,0 +1,117 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LDAPAuth authenticates users by binding to an LDAP directory, such as
+// OpenLDAP or Active Directory, with their own credentials.
+type LDAPAuth struct {
+	URL      string
+	StartTLS bool
+
+	// UserDN is a template for the DN to bind as, with %s standing in for the
+	// username; for example, uid=%s,ou=people,dc=example,dc=com or (for Active
+	// Directory) %s@example.com. If it is empty, the user's DN is looked up
+	// instead by searching BaseDN with Filter, optionally binding as BindDN
+	// first.
+	UserDN       string
+	BaseDN       string
+	Filter       string
+	BindDN       string
+	BindPassword string
+}
+
+// String describes the directory without its bind password.
+func (a *LDAPAuth) String() string {
+	return "ldap " + a.URL
+}
+
+// Authenticate implements AuthBackend.
+func (a *LDAPAuth) Authenticate(user, pw string) (bool, error) {
+	// An empty password would perform an unauthenticated bind, which most
+	// directories permit.
+	if user == "" || pw == "" {
+		return false, nil
+	}
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if a.StartTLS {
+		u, err := url.Parse(a.URL)
+		if err != nil {
+			return false, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return false, err
+		}
+	}
+
+	dn, err := a.userDN(conn, user)
+	if err != nil || dn == "" {
+		return false, err
+	}
+	if err := conn.Bind(dn, pw); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *LDAPAuth) userDN(conn *ldap.Conn, user string) (string, error) {
+	if a.UserDN != "" {
+		return fmt.Sprintf(a.UserDN, ldap.EscapeDN(user)), nil
+	}
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return "", err
+		}
+	}
+	req := ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0,
+		int(ldapTimeout/time.Second), false,
+		fmt.Sprintf(a.Filter, ldap.EscapeFilter(user)), []string{"dn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return "", err
+	}
+	if len(res.Entries) != 1 {
+		return "", nil
+	}
+	return res.Entries[0].DN, nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authFailureDelay is how long a client waits for the reply to a failed login.
+const authFailureDelay = 3 * time.Second
+
+// maxRateBacklog is how far over its rate limit a client may fall before new
+// connections from it are refused.
+const maxRateBacklog = time.Minute
+
+// Greetings sent to clients whose connections are refused. Their text is sent
+// verbatim as the SMTP response.
+var (
+	errConnDenied      = errors.New("554 5.7.1 Access denied")
+	errConnLocked      = errors.New("421 4.7.0 Too many failed logins, try again later")
+	errConnRateLimited = errors.New("421 4.7.0 Too many messages, try again later")
+)
+
+// senderRateLimitedReply refuses a recipient whose sender, or its Tenant, goes
+// over its rate limit, so that the client tries again later. The rest of the
+// session carries on.
+const senderRateLimitedReply = "450 4.7.1 Too many messages from this sender, try again later"
+
+// An authLockout counts failed logins per client IP and locks out addresses
+// that fail too often.
+type authLockout struct {
+	maxFailures int
+	period      time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*authFailures
+}
+
+type authFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newAuthLockout(maxFailures int, period time.Duration) *authLockout {
+	return &authLockout{
+		maxFailures: maxFailures,
+		period:      period,
+		failures:    make(map[string]*authFailures)}
+}
+
+// Locked reports whether ip is currently locked out.
+func (l *authLockout) Locked(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.failures[ip.String()]
+	return f != nil && time.Now().Before(f.lockedUntil)
+}
+
+// Fail records a failed login from ip and returns the number of failures it
+// has accumulated within the lockout period.
+func (l *authLockout) Fail(ip net.IP) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, f := range l.failures {
+		if now.Sub(f.first) > l.period && now.After(f.lockedUntil) {
+			delete(l.failures, k)
+		}
+	}
+	f := l.failures[ip.String()]
+	if f == nil {
+		f = &authFailures{first: now}
+		l.failures[ip.String()] = f
+	}
+	f.count++
+	if f.count >= l.maxFailures {
+		f.lockedUntil = now.Add(l.period)
+	}
+	return f.count
+}
+
+// Succeed forgets the failures of ip after a successful login.
+func (l *authLockout) Succeed(ip net.IP) {
+	l.mu.Lock()
+	delete(l.failures, ip.String())
+	l.mu.Unlock()
+}
+
+// A rateLimiter spaces out the notifications each client may submit, using the
+// generic cell rate algorithm to permit bursts of up to the full allowance for
+// its period. Clients are told apart by key, such as an IP address or sender.
+type rateLimiter struct {
+	interval time.Duration
+	burst    time.Duration
+
+	mu  sync.Mutex
+	tat map[string]time.Time // theoretical arrival time of the next request
+}
+
+func newRateLimiter(count int, per time.Duration) *rateLimiter {
+	interval := per / time.Duration(count)
+	return &rateLimiter{
+		interval: interval,
+		burst:    time.Duration(count-1) * interval,
+		tat:      make(map[string]time.Time)}
+}
+
+// Reserve claims the next submission slot for key and returns how long the
+// client must wait before using it.
+func (r *rateLimiter) Reserve(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	tat := r.next(key, now)
+	r.tat[key] = tat.Add(r.interval)
+	if wait := tat.Sub(now) - r.burst; wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// next returns the theoretical arrival time of key's next request, forgetting
+// clients that have fallen idle. r.mu must be held.
+func (r *rateLimiter) next(key string, now time.Time) time.Time {
+	for k, t := range r.tat {
+		if t.Before(now) {
+			delete(r.tat, k)
+		}
+	}
+	tat, ok := r.tat[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	return tat
+}
+
+// Backlog returns how long key's next submission would have to wait.
+func (r *rateLimiter) Backlog(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tat, ok := r.tat[key]
+	if !ok {
+		return 0
+	}
+	if wait := time.Until(tat) - r.burst; wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// reserveAll claims the next submission slot for key from every limiter if
+// none of them would make the client wait, and reports whether it did.
+func reserveAll(limiters []*rateLimiter, key string) bool {
+	for _, l := range limiters {
+		if l.Backlog(key) > 0 {
+			return false
+		}
+	}
+	for _, l := range limiters {
+		l.Reserve(key)
+	}
+	return true
+}
+
+// A Rate is a number of notifications per period of time.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+func (r Rate) String() string {
+	switch r.Per {
+	case time.Minute:
+		return fmt.Sprintf("%d/m", r.Count)
+	case time.Hour:
+		return fmt.Sprintf("%d/h", r.Count)
+	}
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+// parseRates parses a comma-separated list of Rates, each a count over a
+// period of m (minute), h (hour), d (day), or a duration such as 15m.
+func parseRates(list string) ([]Rate, error) {
+	var rates []Rate
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		count, period, ok := strings.Cut(item, "/")
+		n, err := strconv.Atoi(count)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("rate %q: expected count/period, such as 10/m", item)
+		}
+		var per time.Duration
+		switch period {
+		case "m", "min", "minute":
+			per = time.Minute
+		case "h", "hour":
+			per = time.Hour
+		case "d", "day":
+			per = 24 * time.Hour
+		default:
+			if per, err = time.ParseDuration(period); err != nil || per <= 0 {
+				return nil, fmt.Errorf("rate %q: bad period %q", item, period)
+			}
+		}
+		rates = append(rates, Rate{n, per})
+	}
+	return rates, nil
+}
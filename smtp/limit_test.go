@@ -0,0 +1,348 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregdel/pushover"
+)
+
+// serveTranslator starts a Translator with the flags given, delivering to a
+// stand-in for the Pushover API, and returns the address of its SMTP server.
+func serveTranslator(t *testing.T, args ...string) string {
+	t.Helper()
+	po := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":1,"request":"test"}`)
+	}))
+	t.Cleanup(po.Close)
+	endpoint := pushover.APIEndpoint
+	pushover.APIEndpoint = po.URL + "/1"
+	t.Cleanup(func() { pushover.APIEndpoint = endpoint })
+
+	t.Setenv("PUSHOVER_TOKEN", "azGDORePK8gMaC0QOYAMyEEuzJnyUi")
+	c, err := LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Addr = ln.Addr().String()
+	c.HTTPAddr = ""
+	c.SummaryInterval = 0
+	tr := NewTranslator(c, slog.New(slog.DiscardHandler))
+	go tr.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tr.Shutdown(ctx)
+	})
+	return c.Addr
+}
+
+// replyCode returns the SMTP reply code of an error from net/smtp.
+func replyCode(err error) int {
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return terr.Code
+	}
+	return 0
+}
+
+// sendMail sends a message over an open connection.
+func sendMail(c *netsmtp.Client, from string, to ...string) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, "Subject: test\r\n\r\nhello\r\n")
+	return w.Close()
+}
+
+func TestSenderRateLimit(t *testing.T) {
+	addr := serveTranslator(t, "-sender-rate-limit", "2/h")
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const rcpt = "uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net"
+	// Each message counts once, however many recipients it has.
+	for i := range 2 {
+		if err := sendMail(c, "cron@example.com", rcpt, rcpt, rcpt); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	// A rejected or abandoned transaction is not counted either.
+	if err := c.Mail("cron@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(rcpt); replyCode(err) != 450 {
+		t.Fatalf("RCPT over the limit = %v, want 450", err)
+	}
+	if err := c.Rcpt(rcpt); replyCode(err) != 450 {
+		t.Fatalf("second RCPT over the limit = %v, want 450", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	// The session stays open for other senders.
+	if err := sendMail(c, "backup@example.com", rcpt, rcpt); err != nil {
+		t.Fatalf("other sender: %v", err)
+	}
+	if err := sendMail(c, "backup@example.com", rcpt); err != nil {
+		t.Fatalf("other sender's second message: %v", err)
+	}
+	if err := sendMail(c, "backup@example.com", rcpt); replyCode(err) != 450 {
+		t.Fatalf("other sender's third message = %v, want 450", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendSized sends a message with a body of about size bytes.
+func sendSized(c *netsmtp.Client, size int) error {
+	if err := c.Mail("cron@example.com"); err != nil {
+		return err
+	}
+	if err := c.Rcpt("uQiRzpo4DXghDmr9QzzfQu27cmVRsG@api.pushover.net"); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, "Subject: test\r\n\r\n")
+	line := strings.Repeat("x", 998) + "\r\n"
+	for range size / len(line) {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func TestReadLimitReset(t *testing.T) {
+	// Reads fail after about 100 kB without a transaction ending.
+	addr := serveTranslator(t, "-max-size", "30000")
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Each message too large for -max-size is refused on its own, rather
+	// than adding up until the connection is closed.
+	for i := range 3 {
+		if err := sendSized(c, 60000); replyCode(err) != 552 {
+			t.Fatalf("oversized message %d = %v, want 552", i, err)
+		}
+	}
+	for i := range 4 {
+		if err := sendSized(c, 29000); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	for range 100 {
+		if err := c.Mail("cron@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A message far over the limit ends the connection, and it stays over
+	// the limit even though the transaction is reset.
+	if err := sendSized(c, 200000); err == nil {
+		t.Fatal("message over the read limit was accepted")
+	}
+	if err := c.Noop(); err == nil {
+		t.Error("connection still works after going over the read limit")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	// 3/h spaces submissions 20 minutes apart, after a burst of 3.
+	r := newRateLimiter(3, time.Hour)
+	for i := range 3 {
+		if wait := r.Reserve("a"); wait != 0 {
+			t.Fatalf("submission %d waits %v, want none within the burst", i, wait)
+		}
+	}
+	if backlog := r.Backlog("a"); backlog <= 19*time.Minute || backlog > 20*time.Minute {
+		t.Errorf("Backlog() = %v, want about 20m", backlog)
+	}
+	if wait := r.Reserve("a"); wait <= 19*time.Minute || wait > 20*time.Minute {
+		t.Errorf("fourth submission waits %v, want about 20m", wait)
+	}
+	if wait := r.Reserve("a"); wait <= 39*time.Minute || wait > 40*time.Minute {
+		t.Errorf("fifth submission waits %v, want about 40m", wait)
+	}
+	// Keys are limited separately.
+	if backlog := r.Backlog("b"); backlog != 0 {
+		t.Errorf("Backlog() of another key = %v, want 0", backlog)
+	}
+	if wait := r.Reserve("b"); wait != 0 {
+		t.Errorf("another key waits %v, want none", wait)
+	}
+}
+
+func TestRateLimiterForgetsIdleKeys(t *testing.T) {
+	r := newRateLimiter(2, time.Hour)
+	r.Reserve("a")
+	// Pretend that a's slot came and went.
+	r.mu.Lock()
+	r.tat["a"] = time.Now().Add(-time.Second)
+	r.mu.Unlock()
+	r.Reserve("b")
+	r.mu.Lock()
+	_, ok := r.tat["a"]
+	r.mu.Unlock()
+	if ok {
+		t.Error("an idle key was not forgotten")
+	}
+}
+
+func TestReserveAll(t *testing.T) {
+	tight, loose := newRateLimiter(2, time.Hour), newRateLimiter(5, time.Hour)
+	limiters := []*rateLimiter{loose, tight}
+	for i := range 2 {
+		if !reserveAll(limiters, "a") {
+			t.Fatalf("reservation %d was refused", i)
+		}
+	}
+	if reserveAll(limiters, "a") {
+		t.Fatal("reservation over the tighter limit was allowed")
+	}
+	// A refused reservation is not counted against any limiter.
+	for i := range 3 {
+		if wait := loose.Reserve("a"); wait != 0 {
+			t.Fatalf("looser limiter makes reservation %d wait %v", i, wait)
+		}
+	}
+	if !reserveAll(nil, "a") {
+		t.Error("reservation with no limiters was refused")
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	l := newAuthLockout(3, time.Hour)
+	ip, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	for i := 1; i <= 2; i++ {
+		if n := l.Fail(ip); n != i {
+			t.Fatalf("Fail() = %d, want %d", n, i)
+		}
+		if l.Locked(ip) {
+			t.Fatalf("locked out after %d failures", i)
+		}
+	}
+	if n := l.Fail(ip); n != 3 || !l.Locked(ip) {
+		t.Fatalf("after Fail() = %d, Locked() = %v, want locked out", n, l.Locked(ip))
+	}
+	if l.Locked(other) {
+		t.Error("another address is locked out")
+	}
+	l.Succeed(ip)
+	if l.Locked(ip) {
+		t.Error("still locked out after a successful login")
+	}
+	if n := l.Fail(ip); n != 1 {
+		t.Errorf("Fail() after a successful login = %d, want 1", n)
+	}
+}
+
+func TestAuthLockoutExpires(t *testing.T) {
+	l := newAuthLockout(2, time.Hour)
+	ip := net.ParseIP("192.0.2.1")
+	l.Fail(ip)
+	l.Fail(ip)
+	// Pretend that the failures and the lockout were long ago.
+	l.mu.Lock()
+	f := l.failures[ip.String()]
+	f.first, f.lockedUntil = time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+	if l.Locked(ip) {
+		t.Error("lockout did not expire")
+	}
+	if n := l.Fail(ip); n != 1 {
+		t.Errorf("Fail() after the period = %d, want the count to start over", n)
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	for _, tt := range []struct {
+		list string
+		want []Rate
+	}{
+		{"10/m", []Rate{{10, time.Minute}}},
+		{" 10/min, 100/hour ,1000/d", []Rate{{10, time.Minute}, {100, time.Hour}, {1000, 24 * time.Hour}}},
+		{"5/15m", []Rate{{5, 15 * time.Minute}}},
+		{"", nil},
+	} {
+		got, err := parseRates(tt.list)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("parseRates(%q) = %v, %v, want %v", tt.list, got, err, tt.want)
+		}
+	}
+	for _, list := range []string{"10", "0/m", "-1/m", "x/m", "10/fortnight", "10/-1m", "10/0s"} {
+		if _, err := parseRates(list); err == nil {
+			t.Errorf("parseRates(%q) succeeded", list)
+		}
+	}
+	for r, want := range map[Rate]string{
+		{10, time.Minute}:      "10/m",
+		{100, time.Hour}:       "100/h",
+		{5, 15 * time.Minute}:  "5/15m0s",
+		{1000, 24 * time.Hour}: "1000/24h0m0s",
+	} {
+		if got := r.String(); got != want {
+			t.Errorf("%#v.String() = %q, want %q", r, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maildirPollInterval is how often the maildir is checked for new messages.
+const maildirPollInterval = time.Second
+
+// watchMaildir delivers the new messages in the maildir of the current
+// configuration every maildirPollInterval until the Translator shuts down. A
+// standby instance leaves them be.
+func (t *Translator) watchMaildir() {
+	ticker := time.NewTicker(maildirPollInterval)
+	defer ticker.Stop()
+	for {
+		if c := t.Config(); c.Maildir != "" && !t.pausing() {
+			t.pollMaildir(c)
+		}
+		select {
+		case <-ticker.C:
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// pollMaildir delivers every message in the new subdirectory of the maildir.
+func (t *Translator) pollMaildir(c *Config) {
+	entries, err := os.ReadDir(filepath.Join(c.Maildir, "new"))
+	if err != nil {
+		t.logger.Error("error reading maildir", "err", err)
+		return
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if !t.maildirMessage(c, e.Name()) {
+			return
+		}
+	}
+}
+
+// maildirMessage delivers a new message in the maildir, as ParseImported reads
+// its sender and recipients, and moves it to the cur subdirectory, marked
+// seen. It returns false once the Translator is shutting down.
+func (t *Translator) maildirMessage(c *Config, name string) bool {
+	if !t.tryStartHandling() {
+		return false
+	}
+	defer t.doneHandling()
+
+	logger := t.logger.With("file", name)
+	path := filepath.Join(c.Maildir, "new", name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("error reading maildir message", "err", err)
+		return true
+	}
+	if m, err := ParseImported(data); err != nil {
+		logger.Warn("malformed message", "err", err)
+	} else {
+		var rcpts []string
+		for _, rcpt := range m.To {
+			if c.deliverable(m.From, rcpt) {
+				rcpts = append(rcpts, rcpt)
+			} else {
+				logger.Warn("bad address", "to", rcpt)
+			}
+		}
+		s := &Session{Addr: localAddr, ID: nextSessionID.Add(1)}
+		if len(rcpts) == 0 {
+			logger.Warn("no deliverable recipients")
+		} else if t.handleMessage(c, s, m.From, rcpts, m.Data) == AccessMalformed {
+			logger.Warn("malformed message")
+		}
+	}
+	// Like a mail client, mark the message seen, so that one reading the
+	// maildir too can tell it has been handled.
+	if !strings.Contains(name, ":2,") {
+		name += ":2,"
+	}
+	if err := os.Rename(path, filepath.Join(c.Maildir, "cur", name+"S")); err != nil {
+		// Better to lose the message than to deliver it again and
+		// again.
+		logger.Error("error moving maildir message", "err", err)
+		os.Remove(path)
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/queue"
+)
+
+// mboxFromLine matches body lines that must be quoted in an mboxrd mailbox.
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+// WriteMbox appends a message to an mbox in the mboxrd format, which quotes
+// lines that begin with "From " so that ReadMbox can restore them exactly.
+// Line endings are converted to LF.
+func WriteMbox(w io.Writer, sender string, received time.Time, data []byte) error {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From %s %s\n", sender, received.UTC().Format(time.ANSIC))
+	data = bytes.TrimSuffix(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"))
+	for line := range bytes.SplitSeq(data, []byte("\n")) {
+		if mboxFromLine.Match(line) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// ReadMbox calls f with each message in an mboxrd mailbox, unquoted, with LF
+// line endings and without its "From " line, until f returns an error.
+func ReadMbox(r io.Reader, f func(data []byte) error) error {
+	var msg []byte
+	started := false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		// WriteMbox separates messages with a blank line.
+		return f(bytes.TrimSuffix(msg, []byte("\n")))
+	}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				msg, started = nil, true
+			case !started:
+				return fmt.Errorf("not an mbox: %q", line)
+			default:
+				if mboxFromLine.Match(line) {
+					line = line[1:]
+				}
+				msg = append(append(msg, line...), '\n')
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// writeMboxItem appends a queued or dead notification to an mbox, with its
+// recipient in an X-Original-To header. A notification that did not arrive by
+// email is written as a plain text email of its subject and body.
+func writeMboxItem(w io.Writer, it queue.Item) error {
+	d := it.Delivery
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "X-Original-To: %s\r\n", d.Rcpt)
+	if len(d.Data) > 0 {
+		b.Write(d.Data)
+	} else {
+		writeSynthesized(&b, d, it.Queued)
+	}
+	return WriteMbox(w, d.From.Address, it.Queued, b.Bytes())
+}
+
+// writeSynthesized writes an email standing in for a notification that was
+// submitted through the HTTP API.
+func writeSynthesized(b *bytes.Buffer, d *notify.Delivery, queued time.Time) {
+	fmt.Fprintf(b, "From: %s\r\n", d.From.Address)
+	fmt.Fprintf(b, "To: %s\r\n", d.Rcpt)
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", d.Subject))
+	fmt.Fprintf(b, "Date: %s\r\n", queued.Format(time.RFC1123Z))
+	if d.MessageID != "" {
+		fmt.Fprintf(b, "Message-ID: %s\r\n", d.MessageID)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(d.Body, "\n", "\r\n"))
+}
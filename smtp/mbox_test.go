@@ -0,0 +1,96 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxRoundTrip(t *testing.T) {
+	messages := []string{
+		"Subject: one\n\nFrom the top.\nFrom here\n>From there\n>>From everywhere\n",
+		"Subject: two\n\n\nends with a blank line\n\n",
+		"Subject: three\r\n\r\nCRLF line endings\r\n",
+	}
+	var mbox bytes.Buffer
+	received := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, m := range messages {
+		if err := WriteMbox(&mbox, "", received, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first, _, _ := strings.Cut(mbox.String(), "\n"); first != "From MAILER-DAEMON Fri May  1 12:00:00 2020" {
+		t.Errorf("first line = %q", first)
+	}
+	if !strings.Contains(mbox.String(), "\n>From here\n>>From there\n>>>From everywhere\n") {
+		t.Errorf("From lines were not quoted:\n%s", mbox.String())
+	}
+
+	var got []string
+	if err := ReadMbox(&mbox, func(data []byte) error {
+		got = append(got, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(messages) {
+		t.Fatalf("read %d messages, want %d", len(got), len(messages))
+	}
+	for i, m := range messages {
+		// Line endings become LF, and the final newline is dropped with
+		// the separator.
+		want := strings.TrimSuffix(strings.ReplaceAll(m, "\r\n", "\n"), "\n") + "\n"
+		if got[i] != want {
+			t.Errorf("message %d = %q, want %q", i, got[i], want)
+		}
+	}
+}
+
+func TestReadMbox(t *testing.T) {
+	var n int
+	err := ReadMbox(strings.NewReader("From a@example.com Fri May  1 12:00:00 2020\r\nSubject: x\r\n\r\nbody\r\nFrom b Sat May  2 12:00:00 2020\r\nSubject: y\r\n"), func(data []byte) error {
+		n++
+		if bytes.Contains(data, []byte("\r")) || bytes.HasPrefix(data, []byte("From ")) {
+			t.Errorf("message %d = %q", n, data)
+		}
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Errorf("ReadMbox() read %d messages, %v, want 2", n, err)
+	}
+
+	if err := ReadMbox(strings.NewReader(""), func([]byte) error { n++; return nil }); err != nil || n != 2 {
+		t.Errorf("ReadMbox() of nothing = %v, called f", err)
+	}
+	if err := ReadMbox(strings.NewReader("Subject: x\n\nbody\n"), func([]byte) error { return nil }); err == nil {
+		t.Error("ReadMbox() accepted a file that is not an mbox")
+	}
+	stop := errors.New("stop")
+	if err := ReadMbox(strings.NewReader("From a\nx\nFrom b\ny\n"), func([]byte) error { return stop }); err != stop {
+		t.Errorf("ReadMbox() = %v, want f's error", err)
+	}
+}
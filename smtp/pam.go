@@ -0,0 +1,93 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build pam
+
+package smtp
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/msteinert/pam/v2"
+)
+
+// PAMAuth authenticates users against the host's PAM stack, using the service
+// configuration of the same name in /etc/pam.d.
+type PAMAuth struct {
+	Service string
+
+	// Many PAM modules are not safe to call from multiple threads at once.
+	mu sync.Mutex
+}
+
+func newPAMAuth(service string) (AuthBackend, error) {
+	return &PAMAuth{Service: service}, nil
+}
+
+// String names the PAM service.
+func (a *PAMAuth) String() string {
+	return "pam " + a.Service
+}
+
+// Authenticate implements AuthBackend.
+func (a *PAMAuth) Authenticate(user, pw string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	t, err := pam.StartFunc(a.Service, user, func(s pam.Style, msg string) (string, error) {
+		switch s {
+		case pam.PromptEchoOff:
+			return pw, nil
+		case pam.PromptEchoOn:
+			return user, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			return "", nil
+		}
+		return "", errors.New("unsupported PAM conversation style")
+	})
+	if err != nil {
+		return false, err
+	}
+	defer t.End()
+	if err := t.Authenticate(pam.Silent | pam.DisallowNullAuthtok); err != nil {
+		return false, pamError(err)
+	}
+	if err := t.AcctMgmt(pam.Silent | pam.DisallowNullAuthtok); err != nil {
+		return false, pamError(err)
+	}
+	return true, nil
+}
+
+// pamError filters out the PAM errors that merely mean the credentials were
+// rejected.
+func pamError(err error) error {
+	switch err {
+	case pam.ErrAuth, pam.ErrUserUnknown, pam.ErrMaxtries, pam.ErrCredInsufficient,
+		pam.ErrPermDenied, pam.ErrAcctExpired, pam.ErrNewAuthtokReqd:
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pickupPollInterval is how often the pickup directory is checked for new
+// messages.
+const pickupPollInterval = 5 * time.Second
+
+// Subdirectories of the pickup directory that messages are moved to once they
+// have been handled.
+const (
+	pickupDone   = "done"
+	pickupFailed = "failed"
+)
+
+// watchPickup delivers the messages in the pickup directory of the current
+// configuration every pickupPollInterval until the Translator shuts down.
+func (t *Translator) watchPickup() {
+	ticker := time.NewTicker(pickupPollInterval)
+	defer ticker.Stop()
+	for {
+		if c := t.Config(); c.PickupDir != "" {
+			t.pickup(c)
+		}
+		select {
+		case <-ticker.C:
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// pickup delivers every .eml file in the pickup directory. Files whose names
+// start with a period are skipped, so that a message can be written under a
+// hidden name and renamed into place once it is complete.
+func (t *Translator) pickup(c *Config) {
+	entries, err := os.ReadDir(c.PickupDir)
+	if err != nil {
+		t.logger.Error("error reading pickup directory", "err", err)
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || !strings.EqualFold(filepath.Ext(name), ".eml") {
+			continue
+		}
+		if !t.pickupFile(c, name) {
+			return
+		}
+	}
+}
+
+// pickupFile delivers a message from the pickup directory to the recipients in
+// its To:, Cc:, and Bcc: headers, from the address in its From: header, and
+// moves it out of the way. It returns false once the Translator is shutting
+// down.
+func (t *Translator) pickupFile(c *Config, name string) bool {
+	if !t.tryStartHandling() {
+		return false
+	}
+	defer t.doneHandling()
+
+	logger := t.logger.With("file", name)
+	failed := func(msg string, args ...any) bool {
+		logger.Warn(msg, args...)
+		t.movePickup(c, name, pickupFailed)
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(c.PickupDir, name))
+	if err != nil {
+		logger.Error("error reading pickup file", "err", err)
+		return true
+	}
+	to, data, err := HeaderRecipients(data)
+	if err != nil {
+		return failed("malformed message", "err", err)
+	}
+	from := "smtp-translator@" + c.Hostname
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			from = addr.Address
+		}
+	}
+	var rcpts []string
+	for _, rcpt := range to {
+		if c.deliverable(from, rcpt) {
+			rcpts = append(rcpts, rcpt)
+		} else {
+			logger.Warn("bad address", "to", rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return failed("no deliverable recipients")
+	}
+	s := &Session{Addr: localAddr, ID: nextSessionID.Add(1)}
+	if t.handleMessage(c, s, from, rcpts, data) == AccessMalformed {
+		return failed("malformed message")
+	}
+	if !t.movePickup(c, name, pickupDone) {
+		// Better to lose the file than to deliver it again and again.
+		os.Remove(filepath.Join(c.PickupDir, name))
+	}
+	return true
+}
+
+// movePickup moves a file in the pickup directory into one of its
+// subdirectories, creating it if need be, and reports whether it succeeded.
+func (t *Translator) movePickup(c *Config, name, subdir string) bool {
+	dir := filepath.Join(c.PickupDir, subdir)
+	err := os.MkdirAll(dir, 0o755)
+	if err == nil {
+		err = os.Rename(filepath.Join(c.PickupDir, name), filepath.Join(dir, name))
+	}
+	if err != nil {
+		t.logger.Error("error moving pickup file", "file", name, "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pop3Timeout bounds connecting to the POP3 server and each command.
+const pop3Timeout = 30 * time.Second
+
+// pop3PollInterval is how often the mailbox is checked for new messages.
+const pop3PollInterval = time.Minute
+
+// parsePOP3URL parses and checks a -pop3 URL, and returns it with the
+// recipients to deliver its messages to.
+func parsePOP3URL(rawURL string) (u *url.URL, to []string, err error) {
+	u, err = url.Parse(rawURL)
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case u.Scheme != "pop3" && u.Scheme != "pop3s":
+		return nil, nil, errors.New("not a pop3:// or pop3s:// URL")
+	case u.Hostname() == "":
+		return nil, nil, errors.New("no server")
+	case u.User == nil:
+		return nil, nil, errors.New("no username")
+	}
+	if to = urlRecipients(u); len(to) == 0 {
+		return nil, nil, errors.New("no recipients")
+	}
+	return u, to, nil
+}
+
+// A pop3Conn is a connection to a POP3 server.
+type pop3Conn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialPOP3 connects and logs in to the server at a -pop3 URL. With pop3://,
+// the connection is upgraded with STLS if the server offers it.
+func dialPOP3(u *url.URL) (*pop3Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "pop3s" {
+			addr = net.JoinHostPort(u.Hostname(), "995")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "110")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, pop3Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("pop3: %v", err)
+	}
+	if u.Scheme == "pop3s" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	p := &pop3Conn{conn: conn, text: textproto.NewConn(conn)}
+	if err := p.open(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// open logs in.
+func (p *pop3Conn) open(u *url.URL) error {
+	p.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	if _, err := p.reply(); err != nil {
+		return err
+	}
+	if u.Scheme == "pop3" {
+		// Servers that do not support CAPA, from before RFC 2449, do
+		// not support STLS either.
+		if capa, err := p.multiline("CAPA"); err == nil && strings.Contains("\n"+strings.ToUpper(string(capa)), "\nSTLS") {
+			if _, err := p.command("STLS"); err != nil {
+				return err
+			}
+			p.conn = tls.Client(p.conn, &tls.Config{ServerName: u.Hostname()})
+			p.text = textproto.NewConn(p.conn)
+		}
+	}
+	password, _ := u.User.Password()
+	if _, err := p.command("USER %s", u.User.Username()); err != nil {
+		return err
+	}
+	_, err := p.command("PASS %s", password)
+	return err
+}
+
+// count returns the number of messages in the mailbox.
+func (p *pop3Conn) count() (int, error) {
+	status, err := p.command("STAT")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 1 {
+		return 0, fmt.Errorf("pop3: malformed STAT reply: %s", status)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("pop3: malformed STAT reply: %s", status)
+	}
+	return n, nil
+}
+
+// retrieve returns a message.
+func (p *pop3Conn) retrieve(n int) ([]byte, error) {
+	return p.multiline("RETR %d", n)
+}
+
+// delete marks a message to be deleted once the session ends.
+func (p *pop3Conn) delete(n int) error {
+	_, err := p.command("DELE %d", n)
+	return err
+}
+
+// quit ends the session, deleting the messages marked for deletion, and
+// closes the connection.
+func (p *pop3Conn) quit() error {
+	_, err := p.command("QUIT")
+	p.conn.Close()
+	return err
+}
+
+// command sends a command and returns the text of its reply, or an error if it
+// failed.
+func (p *pop3Conn) command(format string, args ...any) (string, error) {
+	p.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	if err := p.text.PrintfLine(format, args...); err != nil {
+		return "", fmt.Errorf("pop3: %v", err)
+	}
+	return p.reply()
+}
+
+// multiline sends a command whose reply continues with dot-encoded lines, and
+// returns them.
+func (p *pop3Conn) multiline(format string, args ...any) ([]byte, error) {
+	if _, err := p.command(format, args...); err != nil {
+		return nil, err
+	}
+	data, err := p.text.ReadDotBytes()
+	if err != nil {
+		return nil, fmt.Errorf("pop3: %v", err)
+	}
+	return data, nil
+}
+
+// reply reads the status line of a reply.
+func (p *pop3Conn) reply() (string, error) {
+	line, err := p.text.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("pop3: %v", err)
+	}
+	if status, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(status), nil
+	}
+	return "", fmt.Errorf("pop3: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+}
+
+// pollPOP3 delivers the messages in the mailbox at a -pop3 URL to the
+// recipients it names every pop3PollInterval, deleting them from the server,
+// until the Translator shuts down. A standby instance polls nothing.
+func (t *Translator) pollPOP3(rawURL string) {
+	for {
+		if !t.queue.Standby() {
+			if err := t.fetchPOP3(rawURL); err != nil {
+				t.logger.Error("error polling POP3", "err", err)
+			}
+		}
+		select {
+		case <-time.After(pop3PollInterval):
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// fetchPOP3 delivers and deletes every message in the mailbox. Deletions take
+// effect only once the session ends cleanly, so if it does not, the messages
+// are delivered again by the next poll.
+func (t *Translator) fetchPOP3(rawURL string) error {
+	u, to, err := parsePOP3URL(rawURL)
+	if err != nil {
+		return err
+	}
+	p, err := dialPOP3(u)
+	if err != nil {
+		return err
+	}
+	n, err := p.count()
+	if err != nil {
+		p.conn.Close()
+		return err
+	}
+	for i := 1; i <= n && !t.pausing(); i++ {
+		data, err := p.retrieve(i)
+		if err != nil {
+			p.conn.Close()
+			return err
+		}
+		if !t.mailboxMessage(t.logger.With("message", i), data, to) {
+			break
+		}
+		if err := p.delete(i); err != nil {
+			p.conn.Close()
+			return err
+		}
+	}
+	return p.quit()
+}
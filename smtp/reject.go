@@ -0,0 +1,71 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+// Reasons given in rejection log lines. These are part of the log format that
+// fail2ban filters match against, so they must not change.
+const (
+	rejectDenied       = "denied"
+	rejectLocked       = "locked-out"
+	rejectRateLimited  = "rate-limited"
+	rejectSenderRate   = "sender-rate-limited"
+	rejectTenantRate   = "tenant-rate-limited"
+	rejectAuthFailed   = "auth-failed"
+	rejectAuthLocked   = "auth-locked-out"
+	rejectAuthTLS      = "auth-needs-tls"
+	rejectAuthMech     = "auth-bad-mechanism"
+	rejectAuthRequired = "auth-required"
+	rejectSender       = "sender-not-allowed"
+	rejectRecipient    = "recipient-not-allowed"
+)
+
+// rcptRejectedReply refuses a recipient for good, as smtpd does by default.
+const rcptRejectedReply = "550 5.1.0 Requested action not taken: mailbox unavailable"
+
+// logRejection records a failed login or refused client in a stable format
+// suitable for fail2ban:
+//
+//	rejected client=192.0.2.1 user="alice" reason=auth-failed
+//
+// The username is quoted so that clients cannot inject their own log lines.
+// Nothing may follow the reason, so l should carry no attributes of its own.
+func logRejection(l *slog.Logger, s *Session, user, reason string) {
+	l.Warn("rejected", "client", s.IP(), "user", quotedString(user), "reason", reason)
+}
+
+// A quotedString is always quoted in plain text logs, and logged as an
+// ordinary string in JSON.
+type quotedString string
+
+func (q quotedString) String() string {
+	return strconv.Quote(string(q))
+}
+
+func (q quotedString) MarshalText() ([]byte, error) {
+	return []byte(q), nil
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretFetchers maps the URL schemes of supported secret managers to
+// functions that retrieve a secret by name.
+var secretFetchers = map[string]func(name string) (string, error){
+	"vault": fetchVaultSecret,
+	"awssm": fetchAWSSecret,
+	"gcpsm": fetchGCPSecret,
+}
+
+var secretClient = &http.Client{Timeout: 10 * time.Second}
+
+// isSecretURL reports whether a path refers to a secret manager rather than a
+// file.
+func isSecretURL(path string) bool {
+	scheme, _, _ := parseSecretURL(path)
+	return scheme != ""
+}
+
+// parseSecretURL splits a secret manager URL of the form
+// scheme://name#field. The scheme is empty if the URL is not one.
+func parseSecretURL(path string) (scheme, name, field string) {
+	i := strings.Index(path, "://")
+	if i < 0 {
+		return "", "", ""
+	}
+	if _, ok := secretFetchers[path[:i]]; !ok {
+		return "", "", ""
+	}
+	scheme, name = path[:i], path[i+3:]
+	if j := strings.LastIndex(name, "#"); j >= 0 {
+		name, field = name[:j], name[j+1:]
+	}
+	return
+}
+
+// fetchSecret retrieves a secret from a secret manager. If the URL names a
+// field, the secret must be a JSON object, and the field's value is returned.
+func fetchSecret(path string) (string, error) {
+	scheme, name, field := parseSecretURL(path)
+	value, err := secretFetchers[scheme](name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	if field == "" {
+		return value, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("%s: secret is not a JSON object", path)
+	}
+	s, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("%s: no such string field", path)
+	}
+	return s, nil
+}
+
+// getJSON performs an HTTP request and decodes its JSON response into v.
+func getJSON(req *http.Request, v interface{}) error {
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// fetchVaultSecret reads a secret from HashiCorp Vault at $VAULT_ADDR, using the
+// token in $VAULT_TOKEN (or $VAULT_TOKEN_FILE). Secrets in both versions of the
+// KV engine are returned as JSON objects of their fields.
+func fetchVaultSecret(name string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("missing env: $VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if path := os.Getenv("VAULT_TOKEN_FILE"); token == "" && path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+name, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	var resp struct {
+		Data map[string]json.RawMessage
+	}
+	if err := getJSON(req, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	// KV version 2 nests the fields, alongside the version metadata.
+	if nested, ok := data["data"]; ok && data["metadata"] != nil {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(data)
+	return string(b), err
+}
+
+// fetchAWSSecret reads a secret from AWS Secrets Manager. The name may be a
+// secret name or ARN. Credentials are taken from the standard environment
+// variables or, failing that, from the ECS task role or EC2 instance profile.
+func fetchAWSSecret(name string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if arn := strings.Split(name, ":"); len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+	if region == "" {
+		return "", errors.New("missing env: $AWS_REGION")
+	}
+	creds, err := awsCredentials()
+	if err != nil {
+		return "", err
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": name})
+	req, err := http.NewRequest("POST",
+		"https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, region, "secretsmanager", time.Now())
+	var resp struct {
+		SecretString string
+		SecretBinary []byte
+	}
+	if err := getJSON(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.SecretBinary != nil {
+		return string(resp.SecretBinary), nil
+	}
+	return resp.SecretString, nil
+}
+
+type awsCreds struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+}
+
+func awsCredentials() (*awsCreds, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCreds{
+			AccessKeyId:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	var creds awsCreds
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		req, err := http.NewRequest("GET", "http://169.254.170.2"+uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &creds, getJSON(req, &creds)
+	}
+
+	// Fall back to the EC2 instance metadata service (IMDSv2).
+	const imds = "http://169.254.169.254/latest/"
+	req, err := http.NewRequest("PUT", imds+"api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "60")
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return nil, errors.New("no AWS credentials found")
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	imdsGet := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", imds+path, nil)
+		if err == nil {
+			req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		}
+		return req, err
+	}
+	req, err = imdsGet("meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err = secretClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	role, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req, err = imdsGet("meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)))
+	if err != nil {
+		return nil, err
+	}
+	return &creds, getJSON(req, &creds)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 authorization to a request.
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func signAWSRequest(req *http.Request, body []byte, creds *awsCreds, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodySum := sha256.Sum256(body)
+	canonReq := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodySum[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	reqSum := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqSum[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyId+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(key))
+}
+
+// fetchGCPSecret reads a secret from Google Cloud Secret Manager. The name is
+// the secret's resource name, projects/PROJECT/secrets/SECRET, optionally
+// followed by /versions/VERSION (the latest by default). An access token is
+// taken from $GOOGLE_OAUTH_ACCESS_TOKEN or else from the metadata server of
+// the Compute Engine, GKE, or Cloud Run instance.
+func fetchGCPSecret(name string) (string, error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		req, err := http.NewRequest("GET",
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		var resp struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := getJSON(req, &resp); err != nil {
+			return "", err
+		}
+		token = resp.AccessToken
+	}
+	req, err := http.NewRequest("GET", "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Payload struct {
+			Data string
+		}
+	}
+	if err := getJSON(req, &resp); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	return string(data), err
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Secret is a string read from the environment, a file, or a secret manager.
+// It is safe for concurrent use and can be reloaded while the server runs.
+type Secret struct {
+	// Source is the file or secret manager URL the secret is read from, or
+	// empty if its value was given directly.
+	Source string
+
+	mu    sync.RWMutex
+	value string
+}
+
+// LoadSecret reads a secret from a file or secret manager URL.
+func LoadSecret(source string) (*Secret, error) {
+	s := &Secret{Source: source}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload rereads the secret from its source. If it cannot be read, the
+// previous value remains in effect.
+func (s *Secret) Reload() error {
+	if s.Source == "" {
+		return nil
+	}
+	value, err := readSecret(s.Source)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.value = value
+	s.mu.Unlock()
+	return nil
+}
+
+// Value returns the current value of the secret. A nil Secret is empty.
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// lookupSecret reads a secret from the named environment variable or, failing
+// that, from the file or secret manager URL named by the same variable with a
+// _FILE suffix, as is conventional for Docker secrets. The boolean reports
+// whether either was set.
+func lookupSecret(name string) (string, bool, error) {
+	s, ok, err := lookupSecretSource(name)
+	return s.Value(), ok, err
+}
+
+// lookupSecretSource is like lookupSecret, but returns a Secret that can be
+// reloaded.
+func lookupSecretSource(name string) (*Secret, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return &Secret{value: value}, true, nil
+	}
+	if path, ok := os.LookupEnv(name + "_FILE"); ok {
+		s, err := LoadSecret(path)
+		return s, true, err
+	}
+	return nil, false, nil
+}
+
+// readSecret reads a secret from a file, ignoring the trailing newline most
+// editors add, or from a secret manager URL.
+func readSecret(path string) (string, error) {
+	if isSecretURL(path) {
+		return fetchSecret(path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// RefreshSecrets periodically rereads the app token and auth file if they come
+// from a secret manager, so that rotated secrets take effect.
+func RefreshSecrets(current func() *Config, interval time.Duration, logger *slog.Logger) {
+	logger = logger.With("component", "secrets")
+	for range time.Tick(interval) {
+		c := current()
+		if c.AppToken != nil && isSecretURL(c.AppToken.Source) {
+			if err := c.AppToken.Reload(); err != nil {
+				logger.Error("error refreshing app token", "err", err)
+			}
+		}
+		if c.AuthDb != nil && isSecretURL(c.AuthDb.Path) {
+			if err := c.AuthDb.Reload(); err != nil {
+				logger.Error("error refreshing auth file", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/notify"
+)
+
+// localAddr stands in for the client address of messages submitted by local
+// programs rather than over the network.
+var localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// Sendmail delivers a message handed over by a local program, as sendmail(8)
+// would, through the same routing, filters, and queue as messages received over
+// SMTP. It returns once every notification has been delivered or has failed
+// for good, or ctx is done, and reports the recipients that have no route and
+// how many notifications failed. Like Batch, Sendmail is used instead of Serve.
+func (t *Translator) Sendmail(ctx context.Context, from string, to []string, data []byte) (refused []string, failed int, err error) {
+	m := &ImportedMessage{From: from, To: to, Data: data}
+	refused, malformed, failed, err := t.Import(ctx, slices.Values([]*ImportedMessage{m}))
+	if malformed > 0 {
+		return refused, 0, errors.New("malformed message")
+	}
+	return refused, failed, err
+}
+
+// deliverable reports whether a recipient of a message from the local host has
+// a route, and if it is routed to Pushover, whether its tokens can be parsed
+// and the sender's Tenant, if any, may send to them.
+func (c *Config) deliverable(from, rcpt string) bool {
+	switch c.routes("", from).Match(rcpt).Kind {
+	case notify.RouteReject:
+		return false
+	case notify.RoutePushover:
+		rcpts := c.Recipients(rcpt)
+		tenant := c.Tenants.Lookup("", from)
+		for _, r := range rcpts {
+			if !tenant.RecipientAllowed(r.UserToken) {
+				return false
+			}
+		}
+		return len(rcpts) > 0
+	}
+	return true
+}
+
+// HeaderRecipients returns the addresses in a message's To:, Cc:, and Bcc:
+// headers, as sendmail -t reads them, along with the message with its Bcc:
+// header removed.
+func HeaderRecipients(data []byte) (rcpts []string, stripped []byte, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		list, err := msg.Header.AddressList(key)
+		if err != nil && err != mail.ErrHeaderNotPresent {
+			return nil, nil, fmt.Errorf("%s: %v", key, err)
+		}
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts, removeHeader(data, "Bcc"), nil
+}
+
+// removeHeader returns data with every instance of a header field removed,
+// including its continuation lines.
+func removeHeader(data []byte, key string) []byte {
+	var out bytes.Buffer
+	skipping := false
+	rest := data
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out.Write(line)
+			out.Write(rest)
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			k, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = strings.EqualFold(string(bytes.TrimSpace(k)), key)
+		}
+		if !skipping {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Session holds the state SMTP Translator keeps about a single client
+// connection. It doubles as the connection's remote address, which is the only
+// per-connection value smtpd passes to its handlers.
+type Session struct {
+	net.Addr
+
+	// ID tells the connection apart from others in the logs.
+	ID uint64
+
+	mu            sync.Mutex
+	user          string
+	authenticated bool
+	trusted       bool
+	tls           bool
+	// charged is set once the current mail transaction has been counted
+	// against its sender's rate limits.
+	charged bool
+
+	// read counts the bytes received since the last mail transaction ended.
+	read atomic.Int64
+}
+
+// IP returns the client's IP address.
+func (s *Session) IP() net.IP {
+	if tcp, ok := s.Addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, _ := net.SplitHostPort(s.Addr.String())
+	return net.ParseIP(host)
+}
+
+// User returns the name the client authenticated as, if any.
+func (s *Session) User() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// Authenticated reports whether the client has logged in or presented a valid
+// certificate. A client may be authenticated without a username.
+func (s *Session) Authenticated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authenticated
+}
+
+// Trusted reports whether the client may submit messages without
+// authenticating.
+func (s *Session) Trusted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trusted
+}
+
+// TLS reports whether the connection has completed a TLS handshake.
+func (s *Session) TLS() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tls
+}
+
+func (s *Session) setUser(user string) {
+	s.mu.Lock()
+	s.user = user
+	s.authenticated = true
+	s.mu.Unlock()
+}
+
+// charge counts the current mail transaction against its sender's rate
+// limits, using reserve, unless it has been already. It reports whether the
+// transaction is within them. reserve runs with the Session locked, so it must
+// not call the Session's methods.
+func (s *Session) charge(reserve func() bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.charged {
+		s.charged = reserve()
+	}
+	return s.charged
+}
+
+// resetTransaction forgets the state of the current mail transaction, and
+// starts counting the bytes received for the next one.
+func (s *Session) resetTransaction() {
+	s.mu.Lock()
+	s.charged = false
+	s.mu.Unlock()
+	s.read.Store(0)
+}
+
+// readLimit returns how many bytes a client may send, counting commands and
+// any TLS overhead, before a message larger than maxSize bytes must be over.
+// It is 0 if maxSize is.
+func readLimit(maxSize int) int64 {
+	if maxSize <= 0 {
+		return 0
+	}
+	return int64(maxSize) + int64(maxSize)/4 + 64<<10
+}
+
+// errReadLimit ends connections that send more than their read limit.
+var errReadLimit = errors.New("client sent too much data")
+
+// sessionOf recovers the Session from a remote address handed to an smtpd
+// handler.
+func sessionOf(addr net.Addr) *Session {
+	if s, ok := addr.(*Session); ok {
+		return s
+	}
+	return &Session{Addr: addr}
+}
+
+// nextSessionID numbers Sessions.
+var nextSessionID atomic.Uint64
+
+// A sessionListener attaches a new Session to every connection it accepts. If
+// the accept function is set, it can inspect and modify each new Session, and
+// connections it returns an error for are closed immediately. If greet is set,
+// the error's text is first sent to the client as an SMTP greeting, which is
+// only possible on unencrypted listeners. If the track function is set, it
+// receives each connection that is let through; if it returns an error, the
+// connection is closed and Accept fails with that error.
+type sessionListener struct {
+	net.Listener
+	accept func(*Session) error
+	track  func(*sessionConn) error
+	greet  bool
+}
+
+func (l sessionListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		session := &Session{Addr: conn.RemoteAddr(), ID: nextSessionID.Add(1)}
+		if l.accept != nil {
+			if err := l.accept(session); err != nil {
+				go func() {
+					if l.greet {
+						conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+						conn.Write([]byte(err.Error() + "\r\n"))
+					}
+					conn.Close()
+				}()
+				continue
+			}
+		}
+		sc := &sessionConn{Conn: conn, session: session}
+		if l.track != nil {
+			if err := l.track(sc); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return sc, nil
+	}
+}
+
+type sessionConn struct {
+	net.Conn
+	session *Session
+	// If limit is positive, reads fail once the session has received this many
+	// bytes since its last mail transaction ended. smtpd buffers each line of
+	// a message whole before enforcing its size limit, so without this, a
+	// client could exhaust memory with one endless line.
+	limit int64
+	// onLimit, if set, is called when reads first fail for going over limit.
+	onLimit func()
+	// overLimit is set once reads have failed for going over limit. They
+	// fail from then on, even if the transaction is reset.
+	overLimit bool
+
+	// onClose, if set, is called the first time the connection is closed.
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *sessionConn) Close() error {
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return c.Conn.Close()
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	if c.overLimit {
+		return 0, errReadLimit
+	}
+	n, err := c.Conn.Read(b)
+	if c.limit > 0 && c.session.read.Add(int64(n)) > c.limit {
+		c.overLimit = true
+		if c.onLimit != nil {
+			c.onLimit()
+		}
+		return n, errReadLimit
+	}
+	return n, err
+}
+
+func (c *sessionConn) RemoteAddr() net.Addr {
+	return c.session
+}
+
+// A connListener yields a single connection that was accepted elsewhere, so that
+// an smtpd.Server can serve it.
+type connListener struct {
+	conn net.Conn
+	done bool
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if l.done {
+		return nil, net.ErrClosed
+	}
+	l.done = true
+	return l.conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// trackTLS wraps a server TLS configuration so that each Session records its
+// completed handshake. If onHandshake is not nil, it also receives the
+// resulting connection state.
+func trackTLS(base *tls.Config, onHandshake func(*Session, tls.ConnectionState)) *tls.Config {
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// The handshake runs on top of the sessionConn, which is our only
+		// way back to the Session.
+		sc, ok := hello.Conn.(*sessionConn)
+		if !ok {
+			return nil, nil
+		}
+		conf := base.Clone()
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			sc.session.mu.Lock()
+			sc.session.tls = true
+			sc.session.mu.Unlock()
+			if onHandshake != nil {
+				onHandshake(sc.session, cs)
+			}
+			return nil
+		}
+		return conf, nil
+	}
+	return cfg
+}
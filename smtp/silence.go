@@ -0,0 +1,157 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// A Silence quiets the notifications that match it for a while, such as
+// during a maintenance window: it drops them, or if Hold is set, keeps them
+// back and queues them when it ends. From and To are patterns as for
+// -sounds: an address, a local part ending in @, or a domain beginning with @.
+// Route matches a route's kind or domain. A notification must match every
+// pattern that is set.
+type Silence struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Route   string    `json:"route,omitempty"`
+	Hold    bool      `json:"hold,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+	Starts  time.Time `json:"starts"`
+	Ends    time.Time `json:"ends"`
+	// Held counts the notifications being kept back.
+	Held int `json:"held"`
+}
+
+// Active reports whether the Silence is in effect at a time.
+func (s *Silence) Active(at time.Time) bool {
+	return !at.Before(s.Starts) && at.Before(s.Ends)
+}
+
+// Match reports whether a Delivery matches the Silence.
+func (s *Silence) Match(d *notify.Delivery) bool {
+	if s.From != "" && (d.From == nil || !parse.MatchAddress(s.From, strings.ToLower(d.From.Address))) {
+		return false
+	}
+	if s.To != "" && !parse.MatchAddress(s.To, strings.ToLower(d.Rcpt)) {
+		return false
+	}
+	if s.Route != "" && !strings.EqualFold(s.Route, d.Route.Kind) && !strings.EqualFold(s.Route, d.Route.Domain) {
+		return false
+	}
+	return true
+}
+
+// A silence is a Silence with the notifications it holds.
+type silence struct {
+	Silence
+	held  []*notify.Delivery
+	timer *time.Timer
+}
+
+// silences keeps the Silences created through the admin API, in memory, and
+// hands held notifications to release when each one ends.
+type silences struct {
+	release func([]*notify.Delivery)
+
+	mu   sync.Mutex
+	list []*silence
+}
+
+// add starts a Silence, filling in its ID. It ends on its own at s.Ends.
+func (ss *silences) add(s Silence) (Silence, error) {
+	s.From, s.To = strings.ToLower(s.From), strings.ToLower(s.To)
+	switch {
+	case s.From == "" && s.To == "" && s.Route == "":
+		return s, errors.New("a silence needs a sender, recipient, or route to match")
+	case !s.Ends.After(s.Starts):
+		return s, errors.New("a silence must end after it starts")
+	case !s.Ends.After(time.Now()):
+		return s, errors.New("a silence must end in the future")
+	}
+	s.ID, s.Held = newID(), 0
+	sl := &silence{Silence: s}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.list = append(ss.list, sl)
+	sl.timer = time.AfterFunc(time.Until(s.Ends), func() { ss.remove(s.ID) })
+	return s, nil
+}
+
+// remove ends a Silence early, releasing what it holds. It reports whether the
+// Silence existed.
+func (ss *silences) remove(id string) bool {
+	ss.mu.Lock()
+	i := slices.IndexFunc(ss.list, func(sl *silence) bool { return sl.ID == id })
+	if i < 0 {
+		ss.mu.Unlock()
+		return false
+	}
+	sl := ss.list[i]
+	ss.list = slices.Delete(ss.list, i, i+1)
+	ss.mu.Unlock()
+	sl.timer.Stop()
+	if len(sl.held) > 0 {
+		// Queuing may wait for room, so don't keep the admin API waiting.
+		go ss.release(sl.held)
+	}
+	return true
+}
+
+// all returns the Silences in the order they were created.
+func (ss *silences) all() []Silence {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	list := make([]Silence, len(ss.list))
+	for i, sl := range ss.list {
+		list[i] = sl.Silence
+		list[i].Held = len(sl.held)
+	}
+	return list
+}
+
+// check returns the first Silence in effect that matches a Delivery, if any,
+// and holds the Delivery if that Silence says to.
+func (ss *silences) check(d *notify.Delivery) (Silence, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	for _, sl := range ss.list {
+		if sl.Active(now) && sl.Match(d) {
+			if sl.Hold {
+				sl.held = append(sl.held, d)
+			}
+			return sl.Silence, true
+		}
+	}
+	return Silence{}, false
+}
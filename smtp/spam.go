@@ -0,0 +1,131 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A SpamFilter scores a raw email message. Higher scores are spammier.
+type SpamFilter interface {
+	Score(msg []byte, client net.IP, from string) (float64, error)
+}
+
+// spamTimeout bounds a single request to a spam filter.
+const spamTimeout = 30 * time.Second
+
+// Spamd scores messages with SpamAssassin's spamd, using the SPAMC protocol.
+// Addr is a host:port, or the path of a Unix socket.
+type Spamd struct {
+	Addr string
+}
+
+// Score implements SpamFilter.
+func (s *Spamd) Score(msg []byte, client net.IP, from string) (float64, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.Addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, s.Addr, spamTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(spamTimeout))
+
+	// https://svn.apache.org/repos/asf/spamassassin/trunk/spamd/PROTOCOL
+	fmt.Fprintf(conn, "CHECK SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(msg))
+	if _, err := conn.Write(msg); err != nil {
+		return 0, err
+	}
+	r := textproto.NewReader(bufio.NewReader(conn))
+	status, err := r.ReadLine()
+	if err != nil {
+		return 0, err
+	}
+	if f := strings.Fields(status); len(f) < 2 || f[1] != "0" {
+		return 0, errors.New("spamd: " + status)
+	}
+	headers, err := r.ReadMIMEHeader()
+	if err != nil && headers == nil {
+		return 0, err
+	}
+	// Spam: True ; 15.0 / 5.0
+	spam := headers.Get("Spam")
+	i, j := strings.Index(spam, ";"), strings.Index(spam, "/")
+	if i < 0 || j < i {
+		return 0, errors.New("spamd: bad Spam header: " + spam)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(spam[i+1:j]), 64)
+}
+
+// Rspamd scores messages with rspamd's HTTP protocol. URL is the address of
+// its normal worker, such as http://localhost:11333.
+type Rspamd struct {
+	URL      string
+	Password string
+}
+
+// Score implements SpamFilter.
+func (s *Rspamd) Score(msg []byte, client net.IP, from string) (float64, error) {
+	req, err := http.NewRequest("POST", strings.TrimRight(s.URL, "/")+"/checkv2", bytes.NewReader(msg))
+	if err != nil {
+		return 0, err
+	}
+	// https://rspamd.com/doc/developers/protocol.html
+	req.Header.Set("IP", client.String())
+	req.Header.Set("From", from)
+	if s.Password != "" {
+		req.Header.Set("Password", s.Password)
+	}
+	resp, err := (&http.Client{Timeout: spamTimeout}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("rspamd: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var result struct {
+		Score float64
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, err
+	}
+	return result.Score, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSpamd answers one SPAMC request on a listener with reply, and sends
+// the message it received on the channel returned.
+func fakeSpamd(t *testing.T, reply string) (addr string, got <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := textproto.NewReader(bufio.NewReader(conn))
+		request, _ := r.ReadLine()
+		headers, _ := r.ReadMIMEHeader()
+		n, _ := strconv.Atoi(headers.Get("Content-Length"))
+		msg := make([]byte, n)
+		io.ReadFull(r.R, msg)
+		ch <- request + "\n" + string(msg)
+		io.WriteString(conn, reply)
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestSpamd(t *testing.T) {
+	const msg = "Subject: hi\r\n\r\nBuy now\r\n"
+	addr, got := fakeSpamd(t, "SPAMD/1.1 0 EX_OK\r\nSpam: True ; 15.2 / 5.0\r\n\r\n")
+	score, err := (&Spamd{Addr: addr}).Score([]byte(msg), net.ParseIP("192.0.2.1"), "a@example.com")
+	if err != nil || score != 15.2 {
+		t.Fatalf("Score() = %v, %v, want 15.2", score, err)
+	}
+	if request := <-got; request != "CHECK SPAMC/1.5\n"+msg {
+		t.Errorf("spamd received %q", request)
+	}
+
+	for _, reply := range []string{
+		"SPAMD/1.1 76 Bad header line\r\n\r\n",
+		"SPAMD/1.1 0 EX_OK\r\nSpam: True\r\n\r\n",
+		"SPAMD/1.1 0 EX_OK\r\nSpam: False ; lots / 5.0\r\n\r\n",
+		"SPAMD/1.1 0 EX_OK\r\n\r\n",
+		"",
+	} {
+		addr, _ := fakeSpamd(t, reply)
+		if score, err := (&Spamd{Addr: addr}).Score([]byte(msg), net.ParseIP("192.0.2.1"), ""); err == nil {
+			t.Errorf("Score() with reply %q = %v, want an error", reply, score)
+		}
+	}
+}
+
+func TestRspamd(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path != "/checkv2":
+			http.NotFound(w, r)
+		case r.Header.Get("Password") != "secret":
+			http.Error(w, "unauthorized", http.StatusForbidden)
+		case r.Header.Get("IP") != "192.0.2.1" || r.Header.Get("From") != "a@example.com":
+			http.Error(w, "bad headers", http.StatusBadRequest)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, `{"is_skipped":false,"score":%d.5,"required_score":15.0,"action":"no action"}`, len(body))
+		}
+	}))
+	defer srv.Close()
+	ip := net.ParseIP("192.0.2.1")
+	score, err := (&Rspamd{URL: srv.URL + "/", Password: "secret"}).Score([]byte("Subject: hi\r\n\r\n"), ip, "a@example.com")
+	if err != nil || score != 15.5 {
+		t.Errorf("Score() = %v, %v, want 15.5", score, err)
+	}
+	if _, err := (&Rspamd{URL: srv.URL, Password: "wrong"}).Score(nil, ip, "a@example.com"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Score() with the wrong password = %v, want a 403 error", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A Tally counts the final outcomes of deliveries.
+type Tally struct {
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+}
+
+// StatsCounts are cumulative counts of what SMTP Translator has done.
+// Messages are counted once each when they are accepted; deliveries are counted
+// for each recipient, by route kind and by recipient address, which may be an
+// alias.
+type StatsCounts struct {
+	Since      time.Time         `json:"since"`
+	Accepted   int64             `json:"accepted"`
+	Dropped    int64             `json:"dropped"`
+	Delivered  int64             `json:"delivered"`
+	Failed     int64             `json:"failed"`
+	Backends   map[string]*Tally `json:"backends"`
+	Recipients map[string]*Tally `json:"recipients"`
+}
+
+// Stats keeps StatsCounts in a JSON file, so that they survive restarts. It is
+// safe for concurrent use, and a nil Stats counts nothing.
+type Stats struct {
+	Path string
+
+	mu     sync.Mutex
+	counts StatsCounts
+}
+
+// OpenStats reads the counts stored in a file, or starts from zero if it does
+// not exist yet.
+func OpenStats(path string) (*Stats, error) {
+	s := &Stats{Path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		s.counts.Since = time.Now()
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.counts); err != nil {
+			return nil, err
+		}
+	}
+	if s.counts.Backends == nil {
+		s.counts.Backends = make(map[string]*Tally)
+	}
+	if s.counts.Recipients == nil {
+		s.counts.Recipients = make(map[string]*Tally)
+	}
+	return s, nil
+}
+
+// Counts returns a copy of the current counts.
+func (s *Stats) Counts() StatsCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counts
+	c.Backends = make(map[string]*Tally, len(s.counts.Backends))
+	for k, v := range s.counts.Backends {
+		t := *v
+		c.Backends[k] = &t
+	}
+	c.Recipients = make(map[string]*Tally, len(s.counts.Recipients))
+	for k, v := range s.counts.Recipients {
+		t := *v
+		c.Recipients[k] = &t
+	}
+	return c
+}
+
+// Accept counts an accepted message.
+func (s *Stats) Accept() error {
+	return s.update(func(c *StatsCounts) { c.Accepted++ })
+}
+
+// Drop counts a recipient that a filter, script, or spam check discarded.
+func (s *Stats) Drop() error {
+	return s.update(func(c *StatsCounts) { c.Dropped++ })
+}
+
+// Deliver counts the final outcome of delivering to a recipient along a route
+// of the given kind.
+func (s *Stats) Deliver(kind, rcpt string, delivered bool) error {
+	return s.update(func(c *StatsCounts) {
+		b, r := c.Backends[kind], c.Recipients[rcpt]
+		if b == nil {
+			b = new(Tally)
+			c.Backends[kind] = b
+		}
+		if r == nil {
+			r = new(Tally)
+			c.Recipients[rcpt] = r
+		}
+		if delivered {
+			c.Delivered++
+			b.Delivered++
+			r.Delivered++
+		} else {
+			c.Failed++
+			b.Failed++
+			r.Failed++
+		}
+	})
+}
+
+// update changes the counts and saves them.
+func (s *Stats) update(f func(*StatsCounts)) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.counts)
+	data, err := json.Marshal(&s.counts)
+	if err != nil {
+		return err
+	}
+	// Replace the file in one step, so that a crash cannot leave it torn.
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".stats-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -0,0 +1,347 @@
+// The gRPC submission service of SMTP Translator, which mirrors the HTTP API at
+// /api/v1/messages. It is served on the -http-addr port when -api is set.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: submission.proto
+
+package submissionpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// A Message is a notification. to holds one or more recipient addresses, which
+// are routed just like those given in RCPT TO, and body is required. The
+// optional fields override any set by the address or a profile.
+type Message struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	To            []string               `protobuf:"bytes,1,rep,name=to,proto3" json:"to,omitempty"`
+	From          string                 `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
+	Title         string                 `protobuf:"bytes,3,opt,name=title,proto3" json:"title,omitempty"`
+	Body          string                 `protobuf:"bytes,4,opt,name=body,proto3" json:"body,omitempty"`
+	Html          *bool                  `protobuf:"varint,5,opt,name=html,proto3,oneof" json:"html,omitempty"`
+	Priority      *int32                 `protobuf:"varint,6,opt,name=priority,proto3,oneof" json:"priority,omitempty"`
+	Retry         int32                  `protobuf:"varint,7,opt,name=retry,proto3" json:"retry,omitempty"`
+	Expire        int32                  `protobuf:"varint,8,opt,name=expire,proto3" json:"expire,omitempty"`
+	Device        string                 `protobuf:"bytes,9,opt,name=device,proto3" json:"device,omitempty"`
+	Sound         string                 `protobuf:"bytes,10,opt,name=sound,proto3" json:"sound,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_submission_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_submission_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_submission_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Message) GetTo() []string {
+	if x != nil {
+		return x.To
+	}
+	return nil
+}
+
+func (x *Message) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *Message) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *Message) GetBody() string {
+	if x != nil {
+		return x.Body
+	}
+	return ""
+}
+
+func (x *Message) GetHtml() bool {
+	if x != nil && x.Html != nil {
+		return *x.Html
+	}
+	return false
+}
+
+func (x *Message) GetPriority() int32 {
+	if x != nil && x.Priority != nil {
+		return *x.Priority
+	}
+	return 0
+}
+
+func (x *Message) GetRetry() int32 {
+	if x != nil {
+		return x.Retry
+	}
+	return 0
+}
+
+func (x *Message) GetExpire() int32 {
+	if x != nil {
+		return x.Expire
+	}
+	return 0
+}
+
+func (x *Message) GetDevice() string {
+	if x != nil {
+		return x.Device
+	}
+	return ""
+}
+
+func (x *Message) GetSound() string {
+	if x != nil {
+		return x.Sound
+	}
+	return ""
+}
+
+// A Receipt identifies a queued message, as in the logs, and says how many
+// notifications were queued for it.
+type Receipt struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Queued        int32                  `protobuf:"varint,2,opt,name=queued,proto3" json:"queued,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Receipt) Reset() {
+	*x = Receipt{}
+	mi := &file_submission_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Receipt) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Receipt) ProtoMessage() {}
+
+func (x *Receipt) ProtoReflect() protoreflect.Message {
+	mi := &file_submission_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Receipt.ProtoReflect.Descriptor instead.
+func (*Receipt) Descriptor() ([]byte, []int) {
+	return file_submission_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Receipt) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Receipt) GetQueued() int32 {
+	if x != nil {
+		return x.Queued
+	}
+	return 0
+}
+
+// A BatchResult answers one message of a batch with the gRPC status code and
+// message that Send would have failed with, or with its receipt.
+type BatchResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          int32                  `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Receipt       *Receipt               `protobuf:"bytes,3,opt,name=receipt,proto3" json:"receipt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchResult) Reset() {
+	*x = BatchResult{}
+	mi := &file_submission_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchResult) ProtoMessage() {}
+
+func (x *BatchResult) ProtoReflect() protoreflect.Message {
+	mi := &file_submission_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchResult.ProtoReflect.Descriptor instead.
+func (*BatchResult) Descriptor() ([]byte, []int) {
+	return file_submission_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BatchResult) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *BatchResult) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *BatchResult) GetReceipt() *Receipt {
+	if x != nil {
+		return x.Receipt
+	}
+	return nil
+}
+
+var File_submission_proto protoreflect.FileDescriptor
+
+const file_submission_proto_rawDesc = "" +
+	"\n" +
+	"\x10submission.proto\x12\x11smtptranslator.v1\"\x83\x02\n" +
+	"\aMessage\x12\x0e\n" +
+	"\x02to\x18\x01 \x03(\tR\x02to\x12\x12\n" +
+	"\x04from\x18\x02 \x01(\tR\x04from\x12\x14\n" +
+	"\x05title\x18\x03 \x01(\tR\x05title\x12\x12\n" +
+	"\x04body\x18\x04 \x01(\tR\x04body\x12\x17\n" +
+	"\x04html\x18\x05 \x01(\bH\x00R\x04html\x88\x01\x01\x12\x1f\n" +
+	"\bpriority\x18\x06 \x01(\x05H\x01R\bpriority\x88\x01\x01\x12\x14\n" +
+	"\x05retry\x18\a \x01(\x05R\x05retry\x12\x16\n" +
+	"\x06expire\x18\b \x01(\x05R\x06expire\x12\x16\n" +
+	"\x06device\x18\t \x01(\tR\x06device\x12\x14\n" +
+	"\x05sound\x18\n" +
+	" \x01(\tR\x05soundB\a\n" +
+	"\x05_htmlB\v\n" +
+	"\t_priority\"1\n" +
+	"\aReceipt\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06queued\x18\x02 \x01(\x05R\x06queued\"q\n" +
+	"\vBatchResult\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\x05R\x04code\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x124\n" +
+	"\areceipt\x18\x03 \x01(\v2\x1a.smtptranslator.v1.ReceiptR\areceipt2\x99\x01\n" +
+	"\n" +
+	"Submission\x12>\n" +
+	"\x04Send\x12\x1a.smtptranslator.v1.Message\x1a\x1a.smtptranslator.v1.Receipt\x12K\n" +
+	"\tSendBatch\x12\x1a.smtptranslator.v1.Message\x1a\x1e.smtptranslator.v1.BatchResult(\x010\x01B5Z3github.com/YoRyan/smtp-translator/smtp/submissionpbb\x06proto3"
+
+var (
+	file_submission_proto_rawDescOnce sync.Once
+	file_submission_proto_rawDescData []byte
+)
+
+func file_submission_proto_rawDescGZIP() []byte {
+	file_submission_proto_rawDescOnce.Do(func() {
+		file_submission_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_submission_proto_rawDesc), len(file_submission_proto_rawDesc)))
+	})
+	return file_submission_proto_rawDescData
+}
+
+var file_submission_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_submission_proto_goTypes = []any{
+	(*Message)(nil),     // 0: smtptranslator.v1.Message
+	(*Receipt)(nil),     // 1: smtptranslator.v1.Receipt
+	(*BatchResult)(nil), // 2: smtptranslator.v1.BatchResult
+}
+var file_submission_proto_depIdxs = []int32{
+	1, // 0: smtptranslator.v1.BatchResult.receipt:type_name -> smtptranslator.v1.Receipt
+	0, // 1: smtptranslator.v1.Submission.Send:input_type -> smtptranslator.v1.Message
+	0, // 2: smtptranslator.v1.Submission.SendBatch:input_type -> smtptranslator.v1.Message
+	1, // 3: smtptranslator.v1.Submission.Send:output_type -> smtptranslator.v1.Receipt
+	2, // 4: smtptranslator.v1.Submission.SendBatch:output_type -> smtptranslator.v1.BatchResult
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_submission_proto_init() }
+func file_submission_proto_init() {
+	if File_submission_proto != nil {
+		return
+	}
+	file_submission_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_submission_proto_rawDesc), len(file_submission_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_submission_proto_goTypes,
+		DependencyIndexes: file_submission_proto_depIdxs,
+		MessageInfos:      file_submission_proto_msgTypes,
+	}.Build()
+	File_submission_proto = out.File
+	file_submission_proto_goTypes = nil
+	file_submission_proto_depIdxs = nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+// summaryTopSenders is how many senders a summary lists.
+const summaryTopSenders = 5
+
+// A summary tallies what happens between one summary notification and the
+// next.
+type summary struct {
+	mu           sync.Mutex
+	since        time.Time
+	accepted     int
+	dispositions map[string]int
+	senders      map[string]int
+}
+
+func newSummary() *summary {
+	return &summary{since: time.Now(), dispositions: make(map[string]int), senders: make(map[string]int)}
+}
+
+// accept counts a message from a sender.
+func (s *summary) accept(from string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accepted++
+	s.senders[from]++
+}
+
+// record counts an audited disposition.
+func (s *summary) record(disposition string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispositions[disposition]++
+}
+
+// reset writes out the tally and starts a new one.
+func (s *summary) reset() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Since %s:\n", s.since.Format("Mon Jan 2 15:04"))
+	fmt.Fprintf(&b, "%d messages accepted\n", s.accepted)
+	fmt.Fprintf(&b, "%d delivered, %d failed, %d dropped, %d rejected\n",
+		s.dispositions[AuditDelivered], s.dispositions[AuditFailed],
+		s.dispositions[AuditDropped], s.dispositions[AuditRejected])
+	senders := make([]string, 0, len(s.senders))
+	for from := range s.senders {
+		senders = append(senders, from)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		if s.senders[senders[i]] != s.senders[senders[j]] {
+			return s.senders[senders[i]] > s.senders[senders[j]]
+		}
+		return senders[i] < senders[j]
+	})
+	if len(senders) > summaryTopSenders {
+		senders = senders[:summaryTopSenders]
+	}
+	if len(senders) > 0 {
+		b.WriteString("\nTop senders:\n")
+		for _, from := range senders {
+			fmt.Fprintf(&b, "%s: %d\n", from, s.senders[from])
+		}
+	}
+	s.since = time.Now()
+	s.accepted = 0
+	s.dispositions = make(map[string]int)
+	s.senders = make(map[string]int)
+	return b.String()
+}
+
+// sendSummaries queues a summary notification to the configured recipient
+// every SummaryInterval until the Translator shuts down.
+func (t *Translator) sendSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.stopping:
+			return
+		}
+		c := t.Config()
+		body := t.summary.reset()
+		if c.SummaryTo == "" {
+			continue
+		}
+		from := "smtp-translator@" + c.Hostname
+		sndr := c.Sender("", from)
+		sndr.ShowAddress = false
+		if c.Routes.Match(c.SummaryTo).Kind == notify.RoutePushover && sndr.AppToken != "" {
+			if limits, err := notify.AppLimits(sndr.AppToken); err != nil {
+				t.logger.Warn("error checking Pushover limits", "err", err)
+			} else {
+				body += fmt.Sprintf("\n%d of %d Pushover messages left until %s\n",
+					limits.Remaining, limits.Total, limits.NextReset.Format("Jan 2"))
+			}
+		}
+		env := &parse.Envelope{
+			From:      sndr,
+			Subject:   "SMTP Translator summary for " + c.Hostname,
+			Body:      body,
+			Plaintext: true,
+			ID:        newID()}
+		ds := c.Deliveries(env, c.SummaryTo)
+		if len(ds) == 0 {
+			t.logger.Warn("bad address", "id", env.ID, "to", c.SummaryTo)
+			continue
+		}
+		if t.enqueue(ds) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+	"gopkg.in/yaml.v3"
+)
+
+// A Tenant is a household or team that shares an instance with others. The
+// messages its members send use its own app token, and so its own Pushover
+// quota, and its own routing table, are limited to its own recipients, and are
+// counted against its own rate limits, so that tenants' tokens and traffic
+// don't mix.
+type Tenant struct {
+	Name string
+	// AppToken, if set, overrides every app token but a user's own.
+	AppToken string
+	// Routes, if set, replace the server's routing table.
+	Routes notify.Routes
+	// Recipients, if set, are the only Pushover user tokens that members
+	// may send to.
+	Recipients []string
+	// RateLimits cap the notifications of all members together.
+	RateLimits []Rate
+}
+
+// tenantFile is a Tenant as written in a tenants file.
+type tenantFile struct {
+	Members    string `yaml:"members"`
+	AppToken   string `yaml:"app-token"`
+	Routes     string `yaml:"routes"`
+	Recipients string `yaml:"recipients"`
+	RateLimit  string `yaml:"rate-limit"`
+}
+
+// Tenants are the Tenants read from a tenants file.
+type Tenants struct {
+	Path   string
+	byName map[string]*Tenant
+	// members maps usernames, addresses, and @domains to tenant names.
+	members AppTokens
+}
+
+// LoadTenants reads a YAML file that maps names to Tenants. Members are
+// usernames, From: addresses, or @domains, as for -app-tokens, and belong to
+// one Tenant each. For example:
+//
+//	smith:
+//	  members: alice, bob, @smith.example
+//	  app-token: azGDORePK8gMaC0QOYAMyEEuzJnyUi
+//	  routes: smith.example=relay:smtp://mail.smith.example, *=pushover
+//	  recipients: uQiRzpo4DXghDmr9QzzfQu27cmVRsG
+//	  rate-limit: 20/h, 200/d
+func LoadTenants(path string, patterns *parse.Tokens) (*Tenants, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var doc map[string]tenantFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ts := &Tenants{Path: path, byName: make(map[string]*Tenant), members: make(AppTokens)}
+	for name, tf := range doc {
+		tn := &Tenant{Name: name, AppToken: tf.AppToken, Recipients: parseList(tf.Recipients, false)}
+		members := parseList(tf.Members, false)
+		if len(members) == 0 {
+			return nil, fmt.Errorf("%s: %s: no members", path, name)
+		}
+		for _, m := range members {
+			// Addresses are case-insensitive, but usernames are not.
+			if strings.Contains(m, "@") {
+				m = strings.ToLower(m)
+			}
+			if other, ok := ts.members[m]; ok {
+				return nil, fmt.Errorf("%s: %s: %s is already a member of %s", path, name, m, other)
+			}
+			ts.members[m] = name
+		}
+		if tn.AppToken != "" && !patterns.IsAppToken(tn.AppToken) {
+			return nil, fmt.Errorf("%s: %s: invalid app token: %s", path, name, tn.AppToken)
+		}
+		for _, token := range tn.Recipients {
+			if !patterns.IsUserToken(token) {
+				return nil, fmt.Errorf("%s: %s: invalid user token: %s", path, name, token)
+			}
+		}
+		if tf.Routes != "" {
+			if tn.Routes, err = notify.ParseRoutes(tf.Routes); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+		if tn.RateLimits, err = parseRates(tf.RateLimit); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		ts.byName[name] = tn
+	}
+	return ts, nil
+}
+
+// Lookup returns the Tenant of an authenticated user or a From: address,
+// preferring the user, then the full address, and then its domain. It returns
+// nil if neither belongs to a Tenant.
+func (ts *Tenants) Lookup(user, from string) *Tenant {
+	if ts == nil {
+		return nil
+	}
+	return ts.byName[ts.members.Lookup(user, from)]
+}
+
+// All returns the Tenants in order of name.
+func (ts *Tenants) All() []*Tenant {
+	if ts == nil {
+		return nil
+	}
+	list := make([]*Tenant, 0, len(ts.byName))
+	for _, tn := range ts.byName {
+		list = append(list, tn)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// newTenantLimiters prepares the rate limiters for each Tenant, keeping those
+// of Tenants in the old configuration whose limits have not changed.
+func newTenantLimiters(ts *Tenants, old *Config, prev map[string][]*rateLimiter) map[string][]*rateLimiter {
+	limiters := make(map[string][]*rateLimiter)
+	for _, tn := range ts.All() {
+		if old != nil && old.Tenants != nil {
+			if was, ok := old.Tenants.byName[tn.Name]; ok && slices.Equal(was.RateLimits, tn.RateLimits) {
+				limiters[tn.Name] = prev[tn.Name]
+				continue
+			}
+		}
+		for _, r := range tn.RateLimits {
+			limiters[tn.Name] = append(limiters[tn.Name], newRateLimiter(r.Count, r.Per))
+		}
+	}
+	return limiters
+}
+
+// RecipientAllowed reports whether the Tenant's members may send to a
+// Pushover user token. Recipients on other routes have no token and are always
+// allowed.
+func (tn *Tenant) RecipientAllowed(token string) bool {
+	return tn == nil || token == "" || len(tn.Recipients) == 0 || slices.Contains(tn.Recipients, token)
+}
+
+// routes returns the routing table for a message from a user or a From:
+// address: its Tenant's, if the Tenant has one, or the server's.
+func (c *Config) routes(user, from string) notify.Routes {
+	if tn := c.Tenants.Lookup(user, from); tn != nil && tn.Routes != nil {
+		return tn.Routes
+	}
+	return c.Routes
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+// tlsVersions maps -tls-min-version values to protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps -tls-curves names to key exchange mechanisms.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// parseTLSVersion parses a version number such as "1.2".
+func parseTLSVersion(v string) (uint16, error) {
+	if version, ok := tlsVersions[v]; ok {
+		return version, nil
+	}
+	return 0, errors.New("unknown TLS version: " + v)
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names as
+// spelled by the crypto/tls package, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure suites are accepted so that
+// they can be enabled for old clients.
+func parseCipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		id, ok := known[name]
+		if !ok {
+			return nil, errors.New("unknown cipher suite: " + name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseCurves parses a comma-separated list of key exchange names, in order of
+// preference.
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := tlsCurves[strings.ToUpper(strings.Replace(name, "-", "", 1))]
+		if !ok {
+			return nil, errors.New("unknown TLS curve: " + name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,1086 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package smtp is the SMTP server half of SMTP Translator. A Translator accepts
+// email from clients, authenticates and vets it according to a Config, and
+// queues a notification for each recipient.
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YoRyan/smtp-translator/notify"
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/YoRyan/smtp-translator/plugin"
+	"github.com/YoRyan/smtp-translator/queue"
+	"github.com/mhale/smtpd"
+)
+
+// A Translator is a running instance of SMTP Translator. Its configuration can
+// be replaced while it runs without disturbing connected clients or queued
+// notifications.
+type Translator struct {
+	// ReloadConfig, if set, rereads the configuration and applies it with
+	// Reload when asked to by the admin API. It must be set before serving.
+	ReloadConfig func() error
+
+	logger     *slog.Logger
+	rootLogger *slog.Logger
+	queue      *queue.Queue
+	alerts     *alerter
+	vars       *expvar.Map
+	summary    *summary
+	recent     *recentOutcomes
+	silences   *silences
+	started    time.Time
+	// If js is not nil, notifications are published to it rather than queued
+	// here.
+	js *queue.JetStream
+
+	mu      sync.Mutex
+	config  *Config
+	server  *smtpd.Server
+	lockout *authLockout
+	limiter *rateLimiter
+	// senderLimiters enforce config.SenderRateLimits, in the same order.
+	senderLimiters []*rateLimiter
+	// tenantLimiters enforce the RateLimits of each of config.Tenants, by
+	// name.
+	tenantLimiters map[string][]*rateLimiter
+
+	// State for Shutdown.
+	ln       net.Listener
+	http     *http.Server
+	closing  bool
+	stopping chan struct{}
+	conns    map[*sessionConn]struct{}
+	sessions sync.WaitGroup
+	drained  chan struct{}
+	// handling counts messages that have been accepted over SMTP but not yet
+	// queued. smtpd acknowledges each message before passing it to us in a
+	// goroutine of its own, so they can outlive their sessions. handled is
+	// signaled as each finishes.
+	handling int
+	handled  *sync.Cond
+}
+
+// ShutdownTimeout is how long Run waits for clients and queued notifications
+// when its context is canceled.
+const ShutdownTimeout = 10 * time.Second
+
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("smtp: Translator closed")
+
+// ListenAndServe runs an instance of SMTP Translator. It takes a server
+// configuration and a logger.
+func ListenAndServe(c *Config, logger *slog.Logger) error {
+	return NewTranslator(c, logger).ListenAndServe()
+}
+
+// NewTranslator prepares an instance of SMTP Translator. It takes a server
+// configuration and a logger.
+func NewTranslator(c *Config, logger *slog.Logger) *Translator {
+	t := &Translator{
+		logger:     logger.With("component", "smtp"),
+		rootLogger: logger,
+		conns:      make(map[*sessionConn]struct{}),
+		drained:    make(chan struct{}),
+		stopping:   make(chan struct{}),
+		started:    time.Now(),
+		summary:    newSummary(),
+		recent:     new(recentOutcomes),
+		alerts:     &alerter{logger: logger.With("component", "alert")}}
+	t.handled = sync.NewCond(&t.mu)
+	t.silences = &silences{release: t.release}
+	// Hold enough Deliveries for Pushover to take a full batch of them.
+	t.queue = queue.New(notify.MaxBatchUsers, logger, t.report)
+	t.vars = t.newVars()
+	t.Reload(c)
+	return t
+}
+
+// Config returns the current configuration.
+func (t *Translator) Config() *Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.config
+}
+
+// Reload replaces the configuration. Clients that are already connected finish
+// their sessions under the old one. The listening address and whether TLS is
+// used from the start of each connection cannot be changed this way.
+func (t *Translator) Reload(c *Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.config
+	if old != nil && (c.Addr != old.Addr || c.HTTPAddr != old.HTTPAddr || c.tlsListener() != old.tlsListener()) {
+		t.logger.Warn("restart SMTP Translator to change the listening addresses or TLS mode")
+	}
+	// Keep track of lockouts and rates across reloads, unless their limits
+	// have changed.
+	if old == nil || c.AuthMaxFailures != old.AuthMaxFailures || c.AuthLockout != old.AuthLockout {
+		t.lockout = nil
+		if c.AuthMaxFailures > 0 {
+			t.lockout = newAuthLockout(c.AuthMaxFailures, c.AuthLockout)
+		}
+	}
+	if old == nil || c.RateLimit != old.RateLimit {
+		t.limiter = nil
+		if c.RateLimit > 0 {
+			t.limiter = newRateLimiter(c.RateLimit, time.Minute)
+		}
+	}
+	if old == nil || !slices.Equal(c.SenderRateLimits, old.SenderRateLimits) {
+		t.senderLimiters = nil
+		for _, r := range c.SenderRateLimits {
+			t.senderLimiters = append(t.senderLimiters, newRateLimiter(r.Count, r.Per))
+		}
+	}
+	t.config = c
+	t.tenantLimiters = newTenantLimiters(c.Tenants, old, t.tenantLimiters)
+	t.server = t.newServer(c, t.lockout, t.limiter, t.senderLimiters, t.tenantLimiters)
+	t.queue.SetParallel(c.Parallel)
+	if old != nil && old.AuditLog != nil {
+		old.AuditLog.Close()
+	}
+	if old != nil && old.AccessLog != nil {
+		old.AccessLog.Close()
+	}
+	if old != nil && old.History != nil {
+		old.History.Close()
+	}
+	// Keep counting where the old configuration left off.
+	if old != nil && old.Stats != nil && c.Stats != nil && c.Stats.Path == old.Stats.Path {
+		c.Stats = old.Stats
+	}
+}
+
+// Deliveries addresses a copy of base to each destination of a recipient
+// address, along the Route for its domain. It returns nil if the address
+// cannot be delivered to.
+func (c *Config) Deliveries(base *parse.Envelope, rcpt string) (ds []*notify.Delivery) {
+	var from string
+	if base.From != nil {
+		from = base.From.Address
+	}
+	route := c.routes(base.User, from).Match(rcpt)
+	var rcpts []*parse.Recipient
+	switch route.Kind {
+	case notify.RouteReject:
+		return nil
+	case notify.RoutePushover:
+		rcpts = c.Recipients(rcpt)
+	default:
+		rcpts = []*parse.Recipient{{}}
+	}
+	for _, r := range rcpts {
+		// A profile in the address beats one in the headers.
+		if r.Profile != "" {
+			c.Profiles.Apply(r, r.Profile)
+		} else if base.Profile != "" {
+			c.Profiles.Apply(r, base.Profile)
+		}
+		c.SoundRules.Apply(r, base)
+		c.PriorityRules.Apply(r, base)
+		env := *base
+		env.To, env.Rcpt = r, rcpt
+		c.Rewrites.Apply(&env)
+		if c.ShowRecipient {
+			body, footer := strings.TrimRight(env.Body, "\r\n"), "\n\n"+c.text().DeliveredTo+" "+rcpt
+			if route.Kind == notify.RoutePushover {
+				env.Body = notify.AppendFooter(body, footer)
+			} else {
+				env.Body = body + footer
+			}
+		}
+		ds = append(ds, &notify.Delivery{Envelope: &env, Route: route, Text: c.text(), SkipValidation: c.SkipValidation, DKIM: c.DKIM})
+	}
+	return
+}
+
+// text returns the Text to phrase notifications with.
+func (c *Config) text() *notify.Text {
+	if c.Text == nil {
+		return notify.DefaultText
+	}
+	return c.Text
+}
+
+func (c *Config) tokens() *parse.Tokens {
+	if c.Tokens == nil {
+		return parse.DefaultTokens
+	}
+	return c.Tokens
+}
+
+// tlsListener reports whether connections are encrypted from the start, rather
+// than upgraded with STARTTLS.
+func (c *Config) tlsListener() bool {
+	return len(c.TLSKeyPairs) > 0 && !c.Starttls && !c.StarttlsReq
+}
+
+func (t *Translator) audit(r AuditRecord) {
+	c := t.Config()
+	if err := c.AuditLog.Record(r); err != nil {
+		t.logger.Error("error writing audit log", "err", err)
+	}
+	t.vars.Add(r.Disposition, 1)
+	t.summary.record(r.Disposition)
+	if r.Disposition == AuditDropped {
+		t.count(c.Stats.Drop())
+	}
+}
+
+// count logs an error from updating the Stats.
+func (t *Translator) count(err error) {
+	if err != nil {
+		t.logger.Error("error saving statistics", "err", err)
+	}
+}
+
+// newServer builds an SMTP server for one generation of the configuration.
+func (t *Translator) newServer(c *Config, lockout *authLockout, limiter *rateLimiter, senderLimiters []*rateLimiter, tenantLimiters map[string][]*rateLimiter) *smtpd.Server {
+	passwordAuth := c.AuthDb != nil || len(c.AuthBackends) > 0
+	certAuth := c.ClientCAs != nil
+	// Clients with certificates or on trusted networks never issue AUTH, so
+	// if they are allowed, authentication is enforced at RCPT time instead.
+	rcptAuth := certAuth || (passwordAuth && len(c.UnauthNets) > 0)
+	server := &smtpd.Server{
+		Appname:      "SMTP-Translator",
+		AuthMechs:    authMechs(c.AuthMechs, c.AuthTLSOnly),
+		AuthRequired: passwordAuth && !rcptAuth,
+		Hostname:     c.Hostname,
+		MaxSize:      c.MaxSize,
+		Timeout:      5 * time.Minute,
+		TLSListener:  !c.Starttls && !c.StarttlsReq,
+		TLSRequired:  c.StarttlsReq,
+		AuthHandler: func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+			if !passwordAuth {
+				return !certAuth, nil
+			}
+			s := sessionOf(remoteAddr)
+			if c.AuthTLSOnly && !s.TLS() {
+				logRejection(t.rootLogger, s, string(username), rejectAuthTLS)
+				return false, errAuthEncryption
+			}
+			if lockout != nil && lockout.Locked(s.IP()) {
+				logRejection(t.rootLogger, s, string(username), rejectAuthLocked)
+				time.Sleep(authFailureDelay)
+				return false, errAuthLocked
+			}
+			var (
+				ok  bool
+				err error
+			)
+			switch mechanism {
+			case "PLAIN", "LOGIN":
+				ok, err = authPlaintext(c, string(username), string(password))
+				if err != nil {
+					t.logger.Error("error authenticating", "conn", s.ID, "user", string(username), "err", err)
+					err = errAuthUnavailable
+				}
+			case "CRAM-MD5":
+				if c.AuthDb == nil {
+					break
+				}
+				// username = username, password = hmac, shared = challenge
+				// (see github.com/mhale/smtpd/smtpd.go)
+				ok, err = authCramMd5(c.AuthDb, string(username), password, shared)
+			default:
+				logRejection(t.rootLogger, s, string(username), rejectAuthMech)
+				err = errAuthMechanism
+			}
+			switch {
+			case ok:
+				t.logger.Debug("authenticated", "conn", s.ID, "user", string(username), "mechanism", mechanism)
+				s.setUser(string(username))
+				if lockout != nil {
+					lockout.Succeed(s.IP())
+				}
+			case err == nil:
+				logRejection(t.rootLogger, s, string(username), rejectAuthFailed)
+				if lockout == nil {
+					break
+				}
+				if n := lockout.Fail(s.IP()); n >= c.AuthMaxFailures {
+					t.logger.Warn("locking out client", "conn", s.ID, "client", s.IP(), "failures", n)
+				}
+				// Slow down password guessing.
+				time.Sleep(authFailureDelay)
+			}
+			return ok, err
+		},
+		HandlerRcptReply: func(remoteAddr net.Addr, from string, to string) string {
+			s := sessionOf(remoteAddr)
+			reject := func(reason string) string {
+				t.audit(AuditRecord{
+					Client:      s.IP().String(),
+					User:        s.User(),
+					From:        from,
+					To:          to,
+					Disposition: AuditRejected,
+					Result:      reason})
+				return rcptRejectedReply
+			}
+			if rcptAuth && !s.Authenticated() && !s.Trusted() {
+				logRejection(t.rootLogger, s, s.User(), rejectAuthRequired)
+				return reject(rejectAuthRequired)
+			}
+			if user := s.User(); user != "" && c.AuthDb != nil && !c.AuthDb.SenderAllowed(user, from) {
+				logRejection(t.rootLogger, s, user, rejectSender)
+				return reject(rejectSender)
+			}
+			tenant := c.Tenants.Lookup(s.User(), from)
+			route := c.routes(s.User(), from).Match(to)
+			if route.Kind == notify.RouteReject {
+				return reject("no-route")
+			}
+			var rcpts []*parse.Recipient
+			if route.Kind == notify.RoutePushover {
+				if rcpts = c.Recipients(to); len(rcpts) == 0 {
+					return reject("invalid-recipient")
+				}
+			}
+			for _, rcpt := range rcpts {
+				if user := s.User(); user != "" && c.AuthDb != nil && !c.AuthDb.RecipientAllowed(user, rcpt.UserToken) {
+					logRejection(t.rootLogger, s, user, rejectRecipient)
+					return reject(rejectRecipient)
+				}
+				if !tenant.RecipientAllowed(rcpt.UserToken) {
+					logRejection(t.rootLogger, s, s.User(), rejectRecipient)
+					return reject(rejectRecipient)
+				}
+			}
+			// A message counts once against the rate limits of its
+			// sender and Tenant, however many recipients it has.
+			var rejection string
+			key := senderKey(s, from)
+			within := s.charge(func() bool {
+				if !reserveAll(senderLimiters, key) {
+					rejection = rejectSenderRate
+				} else if tenant != nil && !reserveAll(tenantLimiters[tenant.Name], tenant.Name) {
+					rejection = rejectTenantRate
+				}
+				return rejection == ""
+			})
+			if !within {
+				logRejection(t.rootLogger, s, s.User(), rejection)
+				reject(rejection)
+				return senderRateLimitedReply
+			}
+			// Hold the client back until it is within its rate.
+			if limiter != nil {
+				time.Sleep(limiter.Reserve(s.IP().String()))
+			}
+			return ""
+		},
+		// Count the message as handled before the client is told it was
+		// accepted, so that Shutdown cannot close the queue under it.
+		HandlerAccept: func(net.Addr) { t.startHandling() },
+		// Reset the transaction, and the count of bytes read against
+		// the size limit, before the next command is read.
+		HandlerReset: func(remoteAddr net.Addr) {
+			sessionOf(remoteAddr).resetTransaction()
+		},
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) {
+			defer t.doneHandling()
+			t.handleMessage(c, sessionOf(remoteAddr), from, to, data)
+		}}
+	if len(c.TLSKeyPairs) > 0 {
+		server.TLSConfig = &tls.Config{
+			GetCertificate:   c.TLSKeyPairs.GetCertificate,
+			MinVersion:       c.TLSMinVersion,
+			CipherSuites:     c.TLSCipherSuites,
+			CurvePreferences: c.TLSCurves}
+		var onHandshake func(*Session, tls.ConnectionState)
+		if certAuth {
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			server.TLSConfig.ClientCAs = c.ClientCAs
+			onHandshake = func(s *Session, cs tls.ConnectionState) {
+				authenticateCert(s, cs, c.ClientCertUser)
+			}
+		}
+		server.TLSConfig = trackTLS(server.TLSConfig, onHandshake)
+	}
+	return server
+}
+
+// handleMessage parses a message that a client has submitted and queues a
+// notification for each of its recipients, which have already been checked.
+// It returns the result to record in the access log.
+func (t *Translator) handleMessage(c *Config, s *Session, from string, to []string, data []byte) (result string) {
+	parsedSndr := c.Sender(s.User(), from)
+	id := newID()
+
+	record := func(rcpt, messageID, disposition, result string) {
+		t.audit(AuditRecord{
+			ID:          id,
+			Client:      s.IP().String(),
+			User:        s.User(),
+			From:        from,
+			To:          rcpt,
+			MessageID:   messageID,
+			Disposition: disposition,
+			Result:      result})
+	}
+
+	result = AccessAccepted
+	defer func() {
+		err := t.Config().AccessLog.Record(AccessRecord{
+			Conn:   s.ID,
+			Client: s.IP().String(),
+			Helo:   heloOf(data),
+			User:   s.User(),
+			TLS:    s.TLS(),
+			From:   from,
+			Rcpts:  len(to),
+			Size:   len(data),
+			ID:     id,
+			Result: result})
+		if err != nil {
+			t.logger.Error("error writing access log", "err", err)
+		}
+	}()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		result = AccessMalformed
+		t.logger.Error("malformed email message", "conn", s.ID, "id", id, "err", err)
+		for _, rcpt := range to {
+			record(rcpt, "", AuditFailed, err.Error())
+		}
+		return
+	}
+	messageID := msg.Header.Get("Message-Id")
+	t.count(c.Stats.Accept())
+	t.vars.Add("accepted", 1)
+	t.summary.accept(from)
+	t.logger.Debug("received message", "conn", s.ID, "id", id, "message_id", messageID, "from", from, "to", to, "size", len(data))
+
+	spam := false
+	if c.SpamFilter != nil {
+		score, err := c.SpamFilter.Score(data, s.IP(), from)
+		if err != nil {
+			// Fail open; a missed alert is worse than junk.
+			t.logger.Error("error checking message for spam", "conn", s.ID, "id", id, "message_id", messageID, "err", err)
+		} else if spam = score >= c.SpamThreshold; spam && !c.SpamTag {
+			result = AccessSpam
+			t.logger.Info("dropped spam", "conn", s.ID, "id", id, "message_id", messageID, "from", from, "score", score)
+			for _, rcpt := range to {
+				record(rcpt, messageID, AuditDropped, fmt.Sprintf("spam score %.1f", score))
+			}
+			return
+		}
+	}
+	if c.FromName {
+		parsedSndr.Name = parse.DisplayName(msg.Header.Get("From"))
+	}
+	env, err := parse.MakeEnvelope(parsedSndr, nil, msg)
+	if err != nil {
+		result = AccessMalformed
+		t.logger.Error("error parsing message", "conn", s.ID, "id", id, "message_id", messageID, "err", err)
+		for _, rcpt := range to {
+			record(rcpt, messageID, AuditFailed, err.Error())
+		}
+		return
+	}
+	if spam {
+		env.Subject = c.text().Spam + " " + env.Subject
+	}
+	env.Client = s.IP().String()
+	env.User = s.User()
+	env.MessageID = messageID
+	env.ID = id
+	env.Data = data
+	env.Plaintext = c.Plaintext
+	if _, ok := c.Profiles[env.Profile]; env.Profile != "" && !ok {
+		t.logger.Warn("ignoring unknown profile", "conn", s.ID, "id", id, "message_id", messageID, "profile", env.Profile)
+		env.Profile = ""
+	}
+	for _, rcpt := range to {
+		renv, targets := env, []string{rcpt}
+		var rules *plugin.SieveResult
+		if c.Rules != nil {
+			rules = c.Rules.Run(plugin.NewSieveMessage(env, msg.Header, rcpt))
+			targets = rules.Redirect
+			if rules.Keep {
+				targets = append([]string{rcpt}, targets...)
+			}
+			if len(targets) == 0 {
+				t.logger.Info("rules dropped message", "conn", s.ID, "id", id, "message_id", messageID, "to", rcpt)
+				record(rcpt, messageID, AuditDropped, "rules")
+				continue
+			}
+			if rules.SetSubject {
+				e := *env
+				e.Subject = rules.Subject
+				renv = &e
+			}
+		}
+		for _, addr := range targets {
+			ds := c.Deliveries(renv, addr)
+			if len(ds) == 0 {
+				t.logger.Warn("bad address", "conn", s.ID, "id", id, "message_id", messageID, "to", addr)
+			}
+			for _, d := range ds {
+				if rules != nil && rules.SetPriority {
+					d.Envelope.To.SetPriority(rules.Priority)
+				}
+				disposition, by := AuditDropped, t.filter(c, d.Envelope)
+				if by == "" {
+					disposition, by = t.silenced(d)
+				}
+				if by != "" {
+					record(rcpt, messageID, disposition, by)
+					continue
+				}
+				if err := t.push(d); err != nil {
+					t.logger.Error("could not queue message", "conn", s.ID, "id", id, "message_id", messageID, "to", addr, "err", err)
+					continue
+				}
+				t.logger.Debug("queued", "conn", s.ID, "id", id, "message_id", messageID, "to", addr)
+			}
+		}
+	}
+	return
+}
+
+// filter checks an Envelope against the suppressions and passes it through the
+// configured filter plugins and script. If one of them drops it, filter returns
+// "suppressed", "filter", or "script"; otherwise, it returns the empty string.
+func (t *Translator) filter(c *Config, e *parse.Envelope) string {
+	if sup := c.Suppressions.Match(e); sup != nil {
+		t.logger.Info("suppressed message", "id", e.ID, "message_id", e.MessageID, "match", sup, "to", e.Rcpt)
+		return "suppressed"
+	}
+	for _, f := range c.Filters {
+		keep, err := plugin.Filter(f, e)
+		if err != nil {
+			// Fail open, as with spam filtering.
+			t.logger.Error("error running filter", "id", e.ID, "message_id", e.MessageID, "err", err)
+		} else if !keep {
+			t.logger.Info("filter dropped message", "id", e.ID, "message_id", e.MessageID, "filter", f, "to", e.Rcpt)
+			return "filter"
+		}
+	}
+	if c.Script != nil {
+		keep, err := c.Script.Run(e)
+		if err != nil {
+			t.logger.Error("error running script", "id", e.ID, "message_id", e.MessageID, "err", err)
+		} else if !keep {
+			t.logger.Info("script dropped message", "id", e.ID, "message_id", e.MessageID, "to", e.Rcpt)
+			return "script"
+		}
+	}
+	return ""
+}
+
+// silenced checks a Delivery against the Silences in effect. If one matches,
+// silenced returns the disposition to record, dropped or deferred if it is
+// held, and the Silence responsible; otherwise, it returns empty strings.
+func (t *Translator) silenced(d *notify.Delivery) (disposition, by string) {
+	sl, ok := t.silences.check(d)
+	switch {
+	case !ok:
+		return "", ""
+	case sl.Hold:
+		t.logger.Info("held message", "id", d.ID, "message_id", d.MessageID, "silence", sl.ID, "until", sl.Ends, "to", d.Rcpt)
+		return AuditDeferred, "silence " + sl.ID
+	}
+	t.logger.Info("silenced message", "id", d.ID, "message_id", d.MessageID, "silence", sl.ID, "to", d.Rcpt)
+	return AuditDropped, "silence " + sl.ID
+}
+
+// release queues the notifications held by a Silence that has ended.
+func (t *Translator) release(ds []*notify.Delivery) {
+	t.logger.Info("releasing held notifications", "count", len(ds))
+	if err := t.enqueue(ds); err != nil {
+		t.logger.Error("error releasing held notifications", "count", len(ds), "err", err)
+	}
+}
+
+// report records the outcome of a queued Delivery in the audit log and
+// statistics, and raises alerts about failures.
+func (t *Translator) report(d *notify.Delivery, outcome string, err error) {
+	r := AuditRecord{
+		ID:          d.ID,
+		Client:      d.Client,
+		User:        d.User,
+		From:        d.From.Address,
+		To:          d.Rcpt,
+		MessageID:   d.MessageID,
+		Disposition: outcome}
+	if err != nil {
+		r.Result = err.Error()
+	}
+	t.audit(r)
+	t.alerts.report(t.Config(), d, outcome, err)
+	t.recent.add(d, outcome, err)
+	if outcome == queue.Failed && t.Config().DeadLetterDir != "" {
+		if derr := saveDeadLetter(t.Config().DeadLetterDir, d, err); derr != nil {
+			t.logger.Error("error saving dead letter", "id", d.ID, "err", derr)
+		}
+	}
+	if outcome != queue.Deferred {
+		c := t.Config()
+		t.count(c.Stats.Deliver(d.Route.Kind, d.Rcpt, outcome == queue.Delivered))
+		if herr := c.History.Record(d, outcome, err); herr != nil {
+			t.logger.Error("error writing history", "err", herr)
+		}
+	}
+}
+
+// newID returns a random identifier for a message.
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ListenAndServe listens on the configured address and accepts connections
+// until the listener fails or the Translator is shut down.
+func (t *Translator) ListenAndServe() error {
+	ln, err := t.Listen()
+	if err != nil {
+		return err
+	}
+	return t.Serve(ln)
+}
+
+// Run serves on the configured address until ctx is canceled, and then shuts
+// down, giving connected clients and queued notifications up to
+// ShutdownTimeout to finish.
+func (t *Translator) Run(ctx context.Context) error {
+	ln, err := t.Listen()
+	if err != nil {
+		return err
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- t.Serve(ln)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	err = t.Shutdown(ctx)
+	<-served
+	return err
+}
+
+// Listen opens the configured address. Clients can connect as soon as it
+// returns, though they are not served until Serve is called.
+func (t *Translator) Listen() (net.Listener, error) {
+	return net.Listen("tcp", t.Config().Addr)
+}
+
+// ListenHTTP opens the configured address for the HTTP interface, or returns
+// nil if there is none.
+func (t *Translator) ListenHTTP() (net.Listener, error) {
+	addr := t.Config().HTTPAddr
+	if addr == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve accepts connections on ln until it fails or the Translator is shut
+// down, and delivers the notifications they submit. After Shutdown, it returns
+// ErrServerClosed. A Translator serves only one listener.
+func (t *Translator) Serve(ln net.Listener) error {
+	return t.ServeListeners(ln, nil)
+}
+
+// ServeListeners is Serve, but if httpLn is not nil, it serves the HTTP
+// interface there rather than listening on the configured address itself.
+func (t *Translator) ServeListeners(ln, httpLn net.Listener) error {
+	if err := t.openQueue(); err != nil {
+		ln.Close()
+		if httpLn != nil {
+			httpLn.Close()
+		}
+		return err
+	}
+	t.mu.Lock()
+	if t.closing || t.ln != nil {
+		t.mu.Unlock()
+		ln.Close()
+		if httpLn != nil {
+			httpLn.Close()
+		}
+		return ErrServerClosed
+	}
+	t.ln = ln
+	c := t.config
+	if httpLn != nil || c.HTTPAddr != "" {
+		t.http = &http.Server{Addr: c.HTTPAddr, Handler: t.Handler(), Protocols: new(http.Protocols)}
+		// gRPC clients speak HTTP/2 without TLS.
+		t.http.Protocols.SetHTTP1(true)
+		t.http.Protocols.SetUnencryptedHTTP2(true)
+		go t.serveHTTP(t.http, httpLn)
+	}
+	t.mu.Unlock()
+	go func() {
+		t.queue.Run()
+		if t.js != nil {
+			t.js.Close()
+		}
+		close(t.drained)
+	}()
+	if c.SummaryInterval > 0 {
+		go t.sendSummaries(c.SummaryInterval)
+	}
+	go t.watchPickup()
+	go t.watchMaildir()
+	if c.Kafka != "" {
+		go t.consumeKafka(c.Kafka)
+	}
+	if c.AMQP != "" {
+		go t.consumeAMQP(c.AMQP)
+	}
+	if c.IMAP != "" {
+		go t.pollIMAP(c.IMAP)
+	}
+	if c.POP3 != "" {
+		go t.pollPOP3(c.POP3)
+	}
+
+	// smtpd's own Serve would hide the connections from us, so replicate it
+	// with a listener that tracks each client's Session.
+	ln = sessionListener{Listener: ln, greet: !c.tlsListener(), accept: t.accept, track: t.track}
+	if c.tlsListener() {
+		ln = tls.NewListener(ln, &tls.Config{GetConfigForClient: t.tlsConfigForClient})
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			t.mu.Lock()
+			closing := t.closing
+			t.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			return err
+		}
+		// Each connection is served by the generation of the server that is
+		// current when it arrives.
+		t.mu.Lock()
+		server := t.server
+		t.mu.Unlock()
+		go server.Serve(&connListener{conn: conn})
+	}
+}
+
+// openQueue joins the configured leader election and keeps the queue in the
+// configured queue directory or Redis server, taking over what this and other
+// instances left there, or connects to NATS. It does nothing if the server has
+// already been started.
+func (t *Translator) openQueue() error {
+	t.mu.Lock()
+	c, started := t.config, t.closing || t.ln != nil
+	t.mu.Unlock()
+	if started {
+		return nil
+	}
+	if c.LeaderLock != "" {
+		if err := t.queue.SetLeader(queue.NewLeaderLock(c.LeaderLock, c.Instance, c.QueueLease)); err != nil {
+			return err
+		}
+	}
+	if c.QueueNATS != "" {
+		js, err := queue.DialJetStream(c.QueueNATS, c.QueueLease, t.rootLogger)
+		if err != nil {
+			return err
+		}
+		t.js = js
+		if c.Deliver {
+			go js.Consume(t.queue, t.restore, t.stopping)
+		}
+		return nil
+	}
+	var store queue.Store
+	var err error
+	switch {
+	case c.QueueDir != "":
+		store, err = queue.OpenDirStore(c.QueueDir, c.Instance, c.QueueLease)
+	case c.QueueRedis != "":
+		store, err = queue.OpenRedisStore(c.QueueRedis, c.Instance, c.QueueLease)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.queue.SetStore(store, t.restore); err != nil {
+		t.logger.Error("could not read the whole queue store", "err", err)
+	}
+	return nil
+}
+
+// restore fills in the parts of a Delivery taken from the queue directory that
+// it does not keep.
+func (t *Translator) restore(d *notify.Delivery) {
+	c := t.Config()
+	d.Text, d.DKIM = c.text(), c.DKIM
+}
+
+// Shutdown stops the Translator gracefully. It stops accepting connections,
+// waits for connected clients to finish their sessions, and then waits for
+// queued notifications to be sent. If ctx is done first, Shutdown closes the
+// remaining connections, abandons the queue, and returns ctx's error.
+func (t *Translator) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closing {
+		t.closing = true
+		close(t.stopping)
+	}
+	ln, httpServer := t.ln, t.http
+	t.mu.Unlock()
+	if ln == nil {
+		return nil
+	}
+	ln.Close()
+	// Keep answering health checks, which now fail readiness, until the end.
+	if httpServer != nil {
+		defer httpServer.Close()
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		t.sessions.Wait()
+		t.mu.Lock()
+		for t.handling > 0 {
+			t.handled.Wait()
+		}
+		t.mu.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		t.mu.Lock()
+		for sc := range t.conns {
+			sc.Conn.Close()
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+
+	t.queue.Close()
+	select {
+	case <-t.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue queues Deliveries from outside an SMTP session. It fails with
+// ErrServerClosed once the Translator is shutting down.
+func (t *Translator) enqueue(ds []*notify.Delivery) error {
+	// Count as a session, so that Shutdown waits before closing the queue.
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		return ErrServerClosed
+	}
+	t.sessions.Add(1)
+	t.mu.Unlock()
+	defer t.sessions.Done()
+	for _, d := range ds {
+		if err := t.push(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push queues a Delivery, or publishes it to NATS if that is where
+// notifications go. If it cannot be published, it is queued here instead.
+func (t *Translator) push(d *notify.Delivery) error {
+	if t.js != nil {
+		err := t.js.Publish(d)
+		if err == nil {
+			return nil
+		}
+		t.logger.Error("could not publish to NATS, queueing here", "id", d.ID, "message_id", d.MessageID, "to", d.Rcpt, "err", err)
+	}
+	return t.queue.Push(d)
+}
+
+// startHandling counts a message as accepted but not yet queued, so that
+// Shutdown waits for it before closing the queue.
+func (t *Translator) startHandling() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handling++
+}
+
+// tryStartHandling is startHandling for messages from sources other than SMTP,
+// which may still be read after Shutdown has begun. It reports false, and
+// counts nothing, once the Translator is shutting down.
+func (t *Translator) tryStartHandling() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.handling++
+	return true
+}
+
+// doneHandling undoes startHandling and tryStartHandling.
+func (t *Translator) doneHandling() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handling--
+	t.handled.Broadcast()
+}
+
+// pausing reports whether the Translator is shutting down or standing by for
+// another instance, when sources of notifications other than SMTP should stop
+// consuming.
+func (t *Translator) pausing() bool {
+	select {
+	case <-t.stopping:
+		return true
+	default:
+		return t.queue.Standby()
+	}
+}
+
+// closeWhenPausing closes c once the Translator is shutting down or standing
+// by, unless the returned function is called first.
+func (t *Translator) closeWhenPausing(c io.Closer) (cancel func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !t.queue.Standby() {
+					continue
+				}
+			case <-t.stopping:
+			case <-done:
+				return
+			}
+			c.Close()
+			return
+		}
+	}()
+	return func() { close(done) }
+}
+
+// track counts a connection as open until it is closed, so that Shutdown can
+// wait for it.
+func (t *Translator) track(sc *sessionConn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return ErrServerClosed
+	}
+	t.conns[sc] = struct{}{}
+	t.sessions.Add(1)
+	sc.limit = readLimit(t.config.MaxSize)
+	sc.onLimit = func() {
+		t.logger.Warn("closing connection that sent too much data", "conn", sc.session.ID, "client", sc.session.IP(), "limit", sc.limit)
+	}
+	sc.onClose = func() {
+		t.mu.Lock()
+		delete(t.conns, sc)
+		t.mu.Unlock()
+		t.sessions.Done()
+	}
+	return nil
+}
+
+// senderKey identifies the sender of a message for SenderRateLimits: the
+// authenticated user, or failing that, the envelope sender.
+func senderKey(s *Session, from string) string {
+	if user := s.User(); user != "" {
+		return "user:" + user
+	}
+	return "from:" + strings.ToLower(from)
+}
+
+// accept vets each new connection against the current configuration.
+func (t *Translator) accept(s *Session) error {
+	t.mu.Lock()
+	c, lockout, limiter := t.config, t.lockout, t.limiter
+	t.mu.Unlock()
+	ip := s.IP()
+	if c.DenyNets.Contains(ip) || (len(c.AllowNets) > 0 && !c.AllowNets.Contains(ip)) {
+		logRejection(t.rootLogger, s, "", rejectDenied)
+		return errConnDenied
+	}
+	if lockout != nil && lockout.Locked(ip) {
+		logRejection(t.rootLogger, s, "", rejectLocked)
+		return errConnLocked
+	}
+	if limiter != nil && limiter.Backlog(ip.String()) > maxRateBacklog {
+		logRejection(t.rootLogger, s, "", rejectRateLimited)
+		return errConnRateLimited
+	}
+	s.trusted = c.UnauthNets.Contains(ip)
+	t.logger.Debug("accepted connection", "conn", s.ID, "client", ip)
+	return nil
+}
+
+// tlsConfigForClient supplies the current server's TLS configuration to
+// connections that are encrypted from the start.
+func (t *Translator) tlsConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.Lock()
+	cfg := t.server.TLSConfig
+	t.mu.Unlock()
+	if cfg == nil {
+		return nil, errors.New("TLS is no longer configured")
+	}
+	if conf, err := cfg.GetConfigForClient(hello); conf != nil || err != nil {
+		return conf, err
+	}
+	return cfg, nil
+}
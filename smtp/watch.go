@@ -0,0 +1,104 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchPollInterval is how often the files of a configuration with Watch set
+// are checked for changes.
+const watchPollInterval = 5 * time.Second
+
+// A fileState is what is known about a file to tell whether it has changed.
+// Kubernetes updates mounted ConfigMaps and secrets by repointing a symlink,
+// so the file it resolves to counts as well as its size and modification time.
+type fileState struct {
+	target  string
+	size    int64
+	modTime int64
+}
+
+// statFiles returns the state of each file. A file that is missing has the
+// zero state.
+func statFiles(paths []string) map[string]fileState {
+	states := make(map[string]fileState)
+	for _, path := range paths {
+		var st fileState
+		if fi, err := os.Stat(path); err == nil {
+			st.target, _ = filepath.EvalSymlinks(path)
+			st.size, st.modTime = fi.Size(), fi.ModTime().UnixNano()
+		}
+		states[path] = st
+	}
+	return states
+}
+
+// WatchConfig calls reload whenever one of the files that the current
+// configuration was read from changes, as long as it has Watch set. This
+// applies updates to mounted files where sending SIGHUP is awkward, as in most
+// container orchestrators. If reload fails, the files are watched for the
+// next change.
+func WatchConfig(current func() *Config, reload func() error, logger *slog.Logger) {
+	logger = logger.With("component", "watch")
+	c := current()
+	states := statFiles(c.Files)
+	for range time.Tick(watchPollInterval) {
+		if next := current(); next != c {
+			// Reloaded some other way.
+			c, states = next, statFiles(next.Files)
+			continue
+		}
+		if !c.Watch {
+			continue
+		}
+		now := statFiles(c.Files)
+		if maps.Equal(now, states) {
+			continue
+		}
+		for path, st := range now {
+			if st != states[path] {
+				logger.Info("file changed, reloading configuration", "path", path)
+				break
+			}
+		}
+		states = now
+		if reload() == nil {
+			// The new configuration may name other files. Those it
+			// shares are compared to what they were before reloading,
+			// so that a change made meanwhile isn't missed.
+			c = current()
+			fresh := statFiles(c.Files)
+			for path := range fresh {
+				if st, ok := now[path]; ok {
+					fresh[path] = st
+				}
+			}
+			states = fresh
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package smtp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"gopkg.in/yaml.v3"
+)
+
+// A Webhook turns JSON payloads POSTed by another service, such as Grafana or
+// Uptime Kuma, into notifications. Each field of the notification is an
+// expression in the expr language (https://expr-lang.org) that can read the
+// payload's top-level keys as variables, or the whole payload as payload, and
+// follow paths into it, as in alerts[0].labels.alertname.
+type Webhook struct {
+	Name string
+	// To lists the recipient addresses.
+	To []string
+	// From is the sender address, which selects the app token like any other.
+	From string
+	// If Token is set, requests must carry it, either as a bearer token or in
+	// the token query parameter, instead of logging in.
+	Token string
+
+	title, body, priority, sound, device, drop *vm.Program
+}
+
+// webhookFile is a Webhook as written in a webhooks file.
+type webhookFile struct {
+	To       string `yaml:"to"`
+	From     string `yaml:"from"`
+	Token    string `yaml:"token"`
+	Title    string `yaml:"title"`
+	Body     string `yaml:"body"`
+	Priority string `yaml:"priority"`
+	Sound    string `yaml:"sound"`
+	Device   string `yaml:"device"`
+	Drop     string `yaml:"drop"`
+}
+
+// LoadWebhooks reads a YAML file that maps names to Webhooks. For example:
+//
+//	grafana:
+//	  to: ops@pushover.net
+//	  title: title
+//	  body: message
+//	  priority: 'status == "firing" ? 1 : -1'
+func LoadWebhooks(path string) (map[string]*Webhook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var doc map[string]webhookFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	hooks := make(map[string]*Webhook)
+	for name, wf := range doc {
+		hook := &Webhook{Name: name, To: parseList(wf.To, false), From: wf.From, Token: wf.Token}
+		if len(hook.To) == 0 {
+			return nil, fmt.Errorf("%s: %s: no recipients", path, name)
+		} else if wf.Body == "" {
+			return nil, fmt.Errorf("%s: %s: no body", path, name)
+		}
+		for _, field := range []struct {
+			name string
+			src  string
+			dst  **vm.Program
+			typ  expr.Option
+		}{
+			{"title", wf.Title, &hook.title, expr.AsKind(reflect.String)},
+			{"body", wf.Body, &hook.body, expr.AsKind(reflect.String)},
+			{"priority", wf.Priority, &hook.priority, expr.AsInt()},
+			{"sound", wf.Sound, &hook.sound, expr.AsKind(reflect.String)},
+			{"device", wf.Device, &hook.device, expr.AsKind(reflect.String)},
+			{"drop", wf.Drop, &hook.drop, expr.AsBool()},
+		} {
+			if field.src == "" {
+				continue
+			}
+			prog, err := expr.Compile(field.src, expr.AllowUndefinedVariables(), field.typ)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s: %v", path, name, field.name, err)
+			}
+			*field.dst = prog
+		}
+		hooks[name] = hook
+	}
+	return hooks, nil
+}
+
+// Map evaluates the Webhook's expressions against a payload. It returns nil if
+// the payload should be dropped.
+func (h *Webhook) Map(payload any) (*APIMessage, error) {
+	env := map[string]any{}
+	if obj, ok := payload.(map[string]any); ok {
+		for k, v := range obj {
+			env[k] = v
+		}
+	}
+	env["payload"] = payload
+	if h.drop != nil {
+		drop, err := expr.Run(h.drop, env)
+		if err != nil {
+			return nil, fmt.Errorf("drop: %v", err)
+		} else if drop.(bool) {
+			return nil, nil
+		}
+	}
+	m := &APIMessage{To: h.To, From: h.From}
+	for _, field := range []struct {
+		name string
+		prog *vm.Program
+		dst  *string
+	}{{"title", h.title, &m.Title}, {"body", h.body, &m.Body}, {"sound", h.sound, &m.Sound}, {"device", h.device, &m.Device}} {
+		if field.prog == nil {
+			continue
+		}
+		out, err := expr.Run(field.prog, env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field.name, err)
+		}
+		*field.dst = out.(string)
+	}
+	if h.priority != nil {
+		out, err := expr.Run(h.priority, env)
+		if err != nil {
+			return nil, fmt.Errorf("priority: %v", err)
+		}
+		priority := out.(int)
+		m.Priority = &priority
+	}
+	return m, nil
+}
+
+// serveWebhook maps a payload POSTed to a Webhook into a notification and
+// submits it like one from the HTTP API.
+func (t *Translator) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	c := t.Config()
+	hook := c.Webhooks[r.PathValue("name")]
+	if hook == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ip, user, ok := t.apiAuth(w, r, c, hook.Token)
+	if !ok {
+		return
+	}
+	var payload any
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize)).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	m, err := hook.Map(payload)
+	if err != nil {
+		t.logger.Warn("error mapping webhook", "webhook", hook.Name, "client", ip, "err", err)
+		writeJSON(w, http.StatusUnprocessableEntity, apiError{Error: err.Error()})
+		return
+	} else if m == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if m.From == "" {
+		m.From = hook.Name + "@" + c.Hostname
+	}
+	status, v := t.submit(c, ip, user, m)
+	writeJSON(w, status, v)
+}
+
+// hasToken reports whether a request carries a webhook's token.
+func hasToken(r *http.Request, token string) bool {
+	given := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && auth[:7] == "Bearer " {
+		given = auth[7:]
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
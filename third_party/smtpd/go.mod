@@ -0,0 +1,3 @@
+module github.com/mhale/smtpd
+
+go 1.13
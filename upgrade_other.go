@@ -0,0 +1,172 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv tells a process started by upgrade what the files it inherits
+// are: a comma-separated list of "smtp", "http", and "ready", for file
+// descriptors 3 onward.
+const upgradeEnv = "SMTP_TRANSLATOR_UPGRADE"
+
+// upgradeTimeout is how long upgrade waits for the new process to be ready.
+const upgradeTimeout = time.Minute
+
+// inheritedListeners returns the listeners that were handed down by the
+// process that started this one to upgrade itself, or nil if there are none.
+// ready must be called once they are being served.
+func inheritedListeners() (ln, httpLn net.Listener, ready func(), err error) {
+	ready = func() {}
+	roles, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+	for i, role := range strings.Split(roles, ",") {
+		f := os.NewFile(uintptr(3+i), role)
+		switch role {
+		case "smtp", "http":
+			var l net.Listener
+			l, err = net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, nil, ready, fmt.Errorf("inherited %s listener: %v", role, err)
+			}
+			if role == "smtp" {
+				ln = l
+			} else {
+				httpLn = l
+			}
+		case "ready":
+			ready = func() {
+				f.Write([]byte{1})
+				f.Close()
+			}
+		}
+	}
+	if ln == nil {
+		return nil, nil, ready, errors.New("no SMTP listener inherited")
+	}
+	return
+}
+
+// upgradeOnSignal hands the listeners off to a new process whenever this one
+// receives SIGUSR2, and once that process is serving them, stops this one as
+// SIGTERM would.
+func upgradeOnSignal(logger *slog.Logger, ln, httpLn net.Listener) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		pid, err := upgrade(ln, httpLn)
+		if err != nil {
+			logger.Error("error upgrading", "err", err)
+			continue
+		}
+		logger.Info("handed off to new process, stopping", "pid", pid)
+		sdNotify(fmt.Sprintf("MAINPID=%d", pid))
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		return
+	}
+}
+
+// upgrade starts the executable again, possibly a newer one, with the same
+// arguments, passes it the listeners, and waits for it to report that it is
+// serving them. It returns the new process's ID.
+func upgrade(ln, httpLn net.Listener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	var roles []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range []struct {
+		role string
+		ln   net.Listener
+	}{{"smtp", ln}, {"http", httpLn}} {
+		if l.ln == nil {
+			continue
+		}
+		fl, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("%s listener cannot be handed off", l.role)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, err
+		}
+		roles = append(roles, l.role)
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	roles = append(roles, "ready")
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	// The new process is not the one the systemd watchdog is watching until
+	// we say it is.
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, upgradeEnv+"=") && !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"="+strings.Join(roles, ","))
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+	// Only the new process may hold the write end, so that the read fails if
+	// it exits without being ready.
+	w.Close()
+	files = files[:len(files)-1]
+
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if n, _ := r.Read(make([]byte, 1)); n == 0 {
+		cmd.Process.Kill()
+		return 0, errors.New("new process exited or timed out before it was ready")
+	}
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/YoRyan/smtp-translator/parse"
+	"github.com/YoRyan/smtp-translator/smtp"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// wizardConfig is the configuration file the init wizard writes. Its keys are
+// the flags they set.
+type wizardConfig struct {
+	Addr           string `yaml:"addr"`
+	Hostname       string `yaml:"hostname"`
+	TokenFile      string `yaml:"token-file"`
+	TLSCert        string `yaml:"tls-cert,omitempty"`
+	TLSKey         string `yaml:"tls-key,omitempty"`
+	Starttls       bool   `yaml:"starttls,omitempty"`
+	StarttlsAlways bool   `yaml:"starttls-always,omitempty"`
+	Auth           string `yaml:"auth,omitempty"`
+	AuthTLSOnly    bool   `yaml:"auth-tls-only,omitempty"`
+	// The token patterns are written only if they differ from the defaults.
+	AppTokenPattern  string `yaml:"app-token-pattern,omitempty"`
+	UserTokenPattern string `yaml:"user-token-pattern,omitempty"`
+}
+
+// initCommand interactively writes a configuration file, along with files for
+// the app token and credentials.
+func initCommand(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fs.String("o", "smtp-translator.yaml", "write the configuration to this `file`")
+	appTokenPattern := fs.String("app-token-pattern", "",
+		"recognize app tokens with this regular `expression` instead of a\\w+")
+	userTokenPattern := fs.String("user-token-pattern", "",
+		"recognize user tokens with this regular `expression` instead of u\\w+")
+	fs.Parse(args)
+	tokens, err := parse.NewTokens(*appTokenPattern, *userTokenPattern)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+	w := &wizard{r: bufio.NewReader(os.Stdin), w: os.Stdout, tokens: tokens}
+	if err := w.run(*out, *appTokenPattern, *userTokenPattern); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// A wizard asks questions on a terminal. It recognizes tokens with tokens.
+type wizard struct {
+	r      *bufio.Reader
+	w      io.Writer
+	tokens *parse.Tokens
+}
+
+// ask prints a question and returns the answer, or def if the answer is blank.
+func (wz *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(wz.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(wz.w, "%s: ", question)
+	}
+	line, err := wz.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// confirm asks a yes or no question.
+func (wz *wizard) confirm(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		answer, err := wz.ask(question+" ("+choices+")", "")
+		switch {
+		case err != nil:
+			return false, err
+		case answer == "":
+			return def, nil
+		case strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes"):
+			return true, nil
+		case strings.EqualFold(answer, "n") || strings.EqualFold(answer, "no"):
+			return false, nil
+		}
+	}
+}
+
+// writeFile writes a file, asking before overwriting an existing one.
+func (wz *wizard) writeFile(path string, data []byte, perm os.FileMode) error {
+	if _, err := os.Stat(path); err == nil {
+		overwrite, err := wz.confirm(path+" exists. Overwrite it?", false)
+		if err != nil {
+			return err
+		} else if !overwrite {
+			return errors.New("not overwriting " + path)
+		}
+	}
+	if err := ioutil.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	fmt.Fprintln(wz.w, "Wrote", path)
+	return nil
+}
+
+// run writes the configuration file out. The token patterns are those that
+// wz.tokens was made from, and are written to the file as well.
+func (wz *wizard) run(out, appTokenPattern, userTokenPattern string) error {
+	fmt.Fprintln(wz.w, "This will write a configuration file for SMTP Translator to", out+".")
+	fmt.Fprintln(wz.w, "Press Enter to accept the [default].")
+	fmt.Fprintln(wz.w)
+	dir, err := filepath.Abs(filepath.Dir(out))
+	if err != nil {
+		return err
+	}
+	c := wizardConfig{
+		TokenFile:        filepath.Join(dir, "pushover_token"),
+		AppTokenPattern:  appTokenPattern,
+		UserTokenPattern: userTokenPattern}
+
+	var token string
+	for {
+		if token, err = wz.ask("Pushover app token", ""); err != nil {
+			return err
+		}
+		if !wz.tokens.IsAppToken(token) {
+			if appTokenPattern == "" {
+				fmt.Fprintln(wz.w, "App tokens are letters and digits and begin with \"a\".")
+			} else {
+				fmt.Fprintln(wz.w, "App tokens must match", appTokenPattern+".")
+			}
+			continue
+		}
+		user, err := wz.ask("Your Pushover user key, to test the token (blank to skip)", "")
+		if err != nil {
+			return err
+		} else if user == "" {
+			break
+		}
+		if _, err := validateTokens(token, wz.tokens.ParseRecipient(user+"@")); err != nil {
+			fmt.Fprintln(wz.w, err)
+			if ok, err := wz.confirm("Use this app token anyway?", false); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+		} else {
+			fmt.Fprintln(wz.w, "The app token works.")
+		}
+		break
+	}
+
+	if c.Addr, err = wz.ask("Address and port to listen on", ":25"); err != nil {
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	if c.Hostname, err = wz.ask("Hostname to advertise", host); err != nil {
+		return err
+	}
+
+	if c.TLSCert, err = wz.ask("TLS certificate file (blank for no TLS)", ""); err != nil {
+		return err
+	}
+	if c.TLSCert != "" {
+		if c.TLSKey, err = wz.ask("TLS key file", ""); err != nil {
+			return err
+		}
+		if _, err := smtp.LoadKeyPair(c.TLSCert, c.TLSKey); err != nil {
+			fmt.Fprintln(wz.w, "Warning:", err)
+		}
+		for {
+			mode, err := wz.ask("Encryption: starttls (optional), starttls-always, or tls (on connect)", "starttls-always")
+			if err != nil {
+				return err
+			}
+			c.Starttls, c.StarttlsAlways = mode == "starttls", mode == "starttls-always"
+			if c.Starttls || c.StarttlsAlways || mode == "tls" {
+				break
+			}
+		}
+	}
+
+	var creds []byte
+	if login, err := wz.confirm("Require clients to log in?", c.TLSCert != ""); err != nil {
+		return err
+	} else if login {
+		// Without TLS, PLAIN and LOGIN are withheld, and CRAM-MD5 needs the
+		// plaintext password.
+		hashed := c.TLSCert != ""
+		if hashed {
+			fmt.Fprintln(wz.w, "Passwords are stored as bcrypt hashes, so clients must log in with PLAIN or LOGIN.")
+		} else {
+			fmt.Fprintln(wz.w, "Without TLS, clients log in with CRAM-MD5, so passwords are stored in plaintext.")
+		}
+		for {
+			user, err := wz.ask("Username (blank when done)", "")
+			if err != nil {
+				return err
+			} else if user == "" {
+				break
+			} else if strings.Contains(user, ":") {
+				fmt.Fprintln(wz.w, "Usernames cannot contain colons.")
+				continue
+			}
+			pw, err := wz.ask("Password (will be shown)", "")
+			if err != nil {
+				return err
+			} else if pw == "" {
+				continue
+			}
+			if hashed {
+				hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+				if err != nil {
+					return err
+				}
+				pw = string(hash)
+			}
+			creds = append(creds, []byte(user+":"+pw+"\n")...)
+		}
+		if len(creds) > 0 {
+			c.Auth = filepath.Join(dir, "creds.txt")
+			c.AuthTLSOnly = c.TLSCert != ""
+		}
+	}
+
+	data, err := yaml.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(wz.w)
+	if err := wz.writeFile(c.TokenFile, []byte(token+"\n"), 0600); err != nil {
+		return err
+	}
+	if c.Auth != "" {
+		if err := wz.writeFile(c.Auth, creds, 0600); err != nil {
+			return err
+		}
+	}
+	if err := wz.writeFile(out, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintln(wz.w, "Start SMTP Translator with: smtp-translator -config", out)
+	return nil
+}
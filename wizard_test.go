@@ -0,0 +1,64 @@
+// Copyright (c) 2019-2020 Ryan Young
+//
+// The MIT License (MIT)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/YoRyan/smtp-translator/parse"
+)
+
+func TestWizardTokenPattern(t *testing.T) {
+	const pattern = `k[0-9]{4}`
+	tokens, err := parse.NewTokens(pattern, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token in Pushover's format is refused, then the app token is
+	// accepted without testing it, and every other answer is the default.
+	answers := "azGDORePK8gMaC0QOYAMyEEuzJnyUi\nk1234\n\n\n\n\n\n"
+	var out strings.Builder
+	wz := &wizard{r: bufio.NewReader(strings.NewReader(answers)), w: &out, tokens: tokens}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "smtp-translator.yaml")
+	if err := wz.run(config, pattern, ""); err != nil {
+		t.Fatalf("run() = %v, output:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "App tokens must match "+pattern+".") {
+		t.Errorf("output does not explain the pattern:\n%s", out.String())
+	}
+	if token, err := os.ReadFile(filepath.Join(dir, "pushover_token")); err != nil || string(token) != "k1234\n" {
+		t.Errorf("token file = %q, %v", token, err)
+	}
+	data, err := os.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "app-token-pattern: k[0-9]{4}\n") || strings.Contains(string(data), "user-token-pattern") {
+		t.Errorf("configuration does not keep the patterns given:\n%s", data)
+	}
+}